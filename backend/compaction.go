@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"llm-mux/backend/internal/providers"
+	"llm-mux/backend/internal/state"
+)
+
+const (
+	compactionSummarize        = "summarize"
+	compactionWindow           = "window"
+	defaultCompactionThreshold = 95
+	// compactionKeepPercent is the share of the window the history may fill
+	// after compaction, leaving room for the answer and the next turns.
+	compactionKeepPercent = 50
+)
+
+// runCompaction is the outcome of compacting a run's shared history:
+// BaseHistory plus the new summary, and the targets that needed it.
+type runCompaction struct {
+	history    []state.Message
+	summarized map[string]bool
+}
+
+// compactRun stores one compaction summary for the whole run when the history
+// nears the context window of any of its targets. The summary answers the
+// latest turn one of them has to drop, so every target starts from it.
+func (m *runManager) compactRun(ctx context.Context, spec runSpec) runCompaction {
+	result := runCompaction{history: spec.BaseHistory}
+	if spec.Config.Compaction.Mode != compactionSummarize {
+		return result
+	}
+	position := map[string]int{}
+	for i, msg := range state.ActivePath(spec.BaseHistory, spec.HistoryLeafID) {
+		position[msg.ID] = i
+	}
+
+	var summarizer providers.Target
+	var fromID, leafID string
+	var limit int
+	summarized := map[string]bool{}
+	for _, t := range spec.Targets {
+		if _, ok := resolveAdapter(m.registry, spec.Config, t.Provider); !ok {
+			continue
+		}
+		targetID := t.Provider + ":" + t.Model
+		msgs := targetMessages(spec.BaseHistory, spec.HistoryLeafID, targetID)
+		cut, targetLimit := m.compactionCut(spec, t, msgs)
+		if cut == 0 {
+			continue
+		}
+		summarized[targetID] = true
+		last := msgs[cut-1]
+		lastID := last.ID
+		if last.Role != "user" {
+			lastID = last.ParentID
+		}
+		if leafID == "" {
+			summarizer, limit = t, targetLimit
+			if msgs[0].Compaction {
+				fromID = msgs[0].ID
+			}
+		}
+		if leafID == "" || position[lastID] > position[leafID] {
+			leafID = lastID
+		}
+	}
+	if leafID == "" {
+		return result
+	}
+
+	summary, err := m.summarizeForCompaction(ctx, spec, summarizer, fromID, leafID, limit)
+	if err != nil {
+		log.Printf("compaction summary for %s:%s failed, dropping old turns instead: %v", summarizer.Provider, summarizer.Model, err)
+		return result
+	}
+	result.history = append(append([]state.Message(nil), spec.BaseHistory...), summary)
+	result.summarized = summarized
+	return result
+}
+
+// compactHistory shrinks a target's history when it nears the target's context
+// window. In summarize mode the run's summary is already part of msgs; what
+// still does not fit, or everything old when the summary failed, is dropped
+// for this request. History is returned unchanged when compaction is off, the
+// window is unknown or everything fits.
+func (m *runManager) compactHistory(spec runSpec, t providers.Target, msgs []state.Message, summarized bool, emit func(providers.StreamEvent) error) []state.Message {
+	mode := spec.Config.Compaction.Mode
+	if mode != compactionSummarize && mode != compactionWindow {
+		return msgs
+	}
+	targetID := t.Provider + ":" + t.Model
+	if summarized {
+		_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "compacted", Content: compactionSummarize})
+	}
+	cut, _ := m.compactionCut(spec, t, msgs)
+	if cut == 0 {
+		return msgs
+	}
+	_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "compacted", Content: compactionWindow})
+	return msgs[cut:]
+}
+
+// compactionCut returns where msgs have to be cut for t, at the first turn
+// from which the rest fits the budget, along with t's context window. The cut
+// is 0 when the window is unknown or the history is below the threshold.
+func (m *runManager) compactionCut(spec runSpec, t providers.Target, msgs []state.Message) (int, int) {
+	limit, err := m.catalog.ContextLimit(spec.Config, t.Provider, t.Model)
+	if err != nil || limit <= 0 {
+		return 0, 0
+	}
+	threshold := spec.Config.Compaction.ThresholdPercent
+	if threshold <= 0 {
+		threshold = defaultCompactionThreshold
+	}
+	if estimateTokens(t, historyFromMessages(msgs), spec.Prompt)*100 < limit*threshold {
+		return 0, limit
+	}
+	budget := limit * compactionKeepPercent / 100
+	for i := range msgs {
+		if msgs[i].Role == "user" && estimateTokens(t, historyFromMessages(msgs[i:]), spec.Prompt) <= budget {
+			return i, limit
+		}
+	}
+	return len(msgs), limit
+}
+
+// summarizeForCompaction has t summarize the turns from fromID to leafID in a
+// summary run, the way /summarize does, and returns the stored summary.
+func (m *runManager) summarizeForCompaction(ctx context.Context, spec runSpec, t providers.Target, fromID, leafID string, limit int) (state.Message, error) {
+	// The summary request itself has to fit; very long pasts lose their start.
+	starts := []string{fromID}
+	seen := fromID == ""
+	for _, msg := range state.ActivePath(spec.BaseHistory, leafID) {
+		if seen && msg.Role == "user" && msg.ID != fromID {
+			starts = append(starts, msg.ID)
+		}
+		seen = seen || msg.ID == fromID
+	}
+	var prompt string
+	for _, from := range starts {
+		var err error
+		prompt, err = m.store.BuildCompactionPrompt(spec.ChatID, from, leafID)
+		if err != nil {
+			return state.Message{}, err
+		}
+		if estimateTokens(t, nil, prompt)*100 <= limit*80 {
+			break
+		}
+	}
+
+	summarySpec := runSpec{
+		ChatID:      spec.ChatID,
+		Prompt:      prompt,
+		Targets:     []providers.Target{t},
+		Config:      spec.Config,
+		ParentID:    leafID,
+		MarkSummary: true,
+		Compaction:  true,
+	}
+	summarySpec.Config.Compaction.Mode = ""
+	run := m.start(summarySpec)
+	events, err := run.wait(ctx)
+	if err != nil {
+		run.cancel()
+		return state.Message{}, err
+	}
+	for _, ev := range events {
+		switch ev.Event {
+		case "error":
+			return state.Message{}, errors.New(ev.Error)
+		case "cancelled":
+			return state.Message{}, errors.New("summary cancelled")
+		}
+	}
+
+	chat, ok := m.store.GetChatTree(spec.ChatID)
+	if !ok {
+		return state.Message{}, errors.New("chat not found")
+	}
+	for i := len(chat.Messages) - 1; i >= 0; i-- {
+		msg := chat.Messages[i]
+		if msg.Compaction && msg.ParentID == leafID && msg.DeletedAt == nil && msg.Status == "" {
+			return msg, nil
+		}
+	}
+	return state.Message{}, errors.New("empty summary")
+}
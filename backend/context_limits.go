@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,10 +10,10 @@ import (
 	"strconv"
 	"strings"
 	"sync"
-	"time"
 
 	"llm-mux/backend/internal/providers"
 	"llm-mux/backend/internal/state"
+	"llm-mux/backend/internal/tokenizer"
 )
 
 type contextLimitsRequest struct {
@@ -31,6 +30,7 @@ type contextLimitItem struct {
 	Model            string `json:"model"`
 	MaxContextTokens int    `json:"maxContextTokens,omitempty"`
 	EstimatedTokens  int    `json:"estimatedTokens,omitempty"`
+	Tokenizer        string `json:"tokenizer,omitempty"`
 	RemainingTokens  *int   `json:"remainingTokens,omitempty"`
 	UsedPercent      *int   `json:"usedPercent,omitempty"`
 	Error            string `json:"error,omitempty"`
@@ -40,12 +40,11 @@ type contextLimitsResponse struct {
 	Limits []contextLimitItem `json:"limits"`
 }
 
-func resolveContextLimits(req contextLimitsRequest, stored providers.ProviderConfig, baseHistory []state.Message) []contextLimitItem {
+func resolveContextLimits(catalog *modelCatalog, req contextLimitsRequest, stored providers.ProviderConfig, baseHistory []state.Message, leafID string) []contextLimitItem {
 	effective := mergeConfig(stored, req.Config)
 	out := make([]contextLimitItem, len(req.Targets))
 	prompt := mergePromptAndAttachments(req.Prompt, req.Attachments)
 
-	client := &http.Client{Timeout: 12 * time.Second}
 	var wg sync.WaitGroup
 	for i := range req.Targets {
 		wg.Add(1)
@@ -54,6 +53,7 @@ func resolveContextLimits(req contextLimitsRequest, stored providers.ProviderCon
 			t := req.Targets[i]
 			provider := strings.ToLower(strings.TrimSpace(t.Provider))
 			model := strings.TrimSpace(t.Model)
+			t.Provider, t.Model = provider, model
 			targetID := provider + ":" + model
 			item := contextLimitItem{
 				TargetID: targetID,
@@ -66,24 +66,14 @@ func resolveContextLimits(req contextLimitsRequest, stored providers.ProviderCon
 				return
 			}
 
-			var (
-				limit int
-				err   error
-			)
-			switch provider {
-			case "openrouter":
-				limit, err = fetchOpenRouterContextLimit(client, effective.OpenRouter, model)
-			case "ollama":
-				limit, err = fetchOllamaContextLimit(client, effective.Ollama, model)
-			default:
-				err = fmt.Errorf("unsupported provider")
-			}
+			limit, err := catalog.ContextLimit(effective, provider, model)
 			if err != nil {
 				item.Error = err.Error()
 			} else {
 				item.MaxContextTokens = limit
 			}
-			item.EstimatedTokens = estimateContextTokens(baseHistory, targetID, prompt)
+			item.EstimatedTokens = estimateContextTokens(baseHistory, leafID, t, prompt)
+			item.Tokenizer = tokenizer.For(provider, model).Name()
 			if item.MaxContextTokens > 0 {
 				remaining := item.MaxContextTokens - item.EstimatedTokens
 				item.RemainingTokens = &remaining
@@ -100,102 +90,78 @@ func resolveContextLimits(req contextLimitsRequest, stored providers.ProviderCon
 	return out
 }
 
-func estimateContextTokens(baseHistory []state.Message, targetID, prompt string) int {
-	history := buildTargetHistory(baseHistory, targetID)
-	chars := 0
-	for _, m := range history {
-		chars += len(m.Content)
-	}
-	chars += len(prompt)
-	if chars <= 0 {
-		return 1
+// fetchContextLimit asks a provider about a single model. Providers that only
+// report context windows in their model list are left to the catalog.
+func fetchContextLimit(client *http.Client, cfg providers.ProviderConfig, provider, model string) (int, error) {
+	switch provider {
+	case "openrouter":
+		return fetchOpenRouterContextLimit(client, cfg.OpenRouter, model)
+	case "ollama":
+		return fetchOllamaContextLimit(client, cfg.Ollama, model)
+	case "anthropic":
+		return anthropicContextLimit(model)
+	case "gemini":
+		return fetchGeminiContextLimit(client, cfg.Gemini, model)
+	default:
+		if _, ok := cfg.Endpoint(provider); ok {
+			return 0, fmt.Errorf("context length unavailable")
+		}
+		return 0, fmt.Errorf("unsupported provider")
 	}
-	return int(math.Ceil(float64(chars) / 4.0))
 }
 
-func fetchOpenRouterContextLimit(client *http.Client, cfg providers.OpenRouterConfig, model string) (int, error) {
-	baseURL := strings.TrimSpace(cfg.BaseURL)
-	if baseURL == "" {
-		baseURL = "https://openrouter.ai/api/v1"
-	}
-	baseURL = strings.TrimSuffix(baseURL, "/")
+func estimateContextTokens(baseHistory []state.Message, leafID string, t providers.Target, prompt string) int {
+	return estimateTokens(t, buildTargetHistory(baseHistory, leafID, t.Provider+":"+t.Model), prompt)
+}
 
-	// Fast path: single model endpoint.
-	httpReq, err := http.NewRequest(http.MethodGet, baseURL+"/models/"+url.PathEscape(model), nil)
-	if err == nil {
-		if strings.TrimSpace(cfg.APIKey) != "" {
-			httpReq.Header.Set("Authorization", "Bearer "+strings.TrimSpace(cfg.APIKey))
-		}
-		resp, reqErr := client.Do(httpReq)
-		if reqErr == nil {
-			defer resp.Body.Close()
-			if resp.StatusCode < 300 {
-				var raw struct {
-					Data struct {
-						ContextLength any `json:"context_length"`
-					} `json:"data"`
-				}
-				if decErr := json.NewDecoder(resp.Body).Decode(&raw); decErr == nil {
-					if n, ok := toInt(raw.Data.ContextLength); ok && n > 0 {
-						return n, nil
-					}
-				}
-			}
-		}
-	}
+// estimateTokens counts a request to t with the tokenizer of its model,
+// including the system prompt and per-message framing.
+func estimateTokens(t providers.Target, history []providers.HistoryMessage, prompt string) int {
+	return tokenizer.CountRequest(tokenizer.For(t.Provider, t.Model), t.SystemPrompt, history, prompt)
+}
 
-	// Fallback: list endpoint.
-	listReq, err := http.NewRequest(http.MethodGet, baseURL+"/models", nil)
+func fetchOpenRouterContextLimit(client *http.Client, cfg providers.OpenRouterConfig, model string) (int, error) {
+	httpReq, err := http.NewRequest(http.MethodGet, openRouterBaseURL(cfg)+"/models/"+url.PathEscape(model), nil)
 	if err != nil {
 		return 0, err
 	}
 	if strings.TrimSpace(cfg.APIKey) != "" {
-		listReq.Header.Set("Authorization", "Bearer "+strings.TrimSpace(cfg.APIKey))
-	}
-	resp, err := client.Do(listReq)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode >= 300 {
-		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
-		return 0, fmt.Errorf("openrouter %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		httpReq.Header.Set("Authorization", "Bearer "+strings.TrimSpace(cfg.APIKey))
 	}
-
 	var raw struct {
-		Data []struct {
-			ID            string `json:"id"`
-			ContextLength any    `json:"context_length"`
+		Data struct {
+			ContextLength any `json:"context_length"`
 		} `json:"data"`
 	}
-	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+	if err := getJSON(client, httpReq, "openrouter", &raw); err != nil {
 		return 0, err
 	}
-	want := strings.ToLower(strings.TrimSpace(model))
-	for _, item := range raw.Data {
-		if strings.ToLower(strings.TrimSpace(item.ID)) != want {
-			continue
-		}
-		if n, ok := toInt(item.ContextLength); ok && n > 0 {
-			return n, nil
-		}
+	if n, ok := toInt(raw.Data.ContextLength); ok && n > 0 {
+		return n, nil
 	}
 	return 0, fmt.Errorf("context length unavailable")
 }
 
-func fetchOllamaContextLimit(client *http.Client, cfg providers.OllamaConfig, model string) (int, error) {
-	baseURL := strings.TrimSpace(cfg.BaseURL)
-	if baseURL == "" {
-		baseURL = "http://localhost:11434"
+// The Anthropic models endpoint does not report context windows, and every
+// current Claude model shares the same 200k window on the standard tier.
+func anthropicContextLimit(model string) (int, error) {
+	if !strings.HasPrefix(strings.ToLower(strings.TrimSpace(model)), "claude-") {
+		return 0, fmt.Errorf("context length unavailable")
+	}
+	return 200000, nil
+}
+
+func fetchGeminiContextLimit(client *http.Client, cfg providers.GeminiConfig, model string) (int, error) {
+	apiKey := strings.TrimSpace(cfg.APIKey)
+	if apiKey == "" {
+		return 0, fmt.Errorf("gemini.apiKey is required")
 	}
-	baseURL = strings.TrimSuffix(baseURL, "/")
 
-	body, _ := json.Marshal(map[string]string{"model": model})
-	httpReq, err := http.NewRequest(http.MethodPost, baseURL+"/api/show", bytes.NewReader(body))
+	httpReq, err := http.NewRequest(http.MethodGet, providers.GeminiBaseURL(cfg)+"/models/"+url.PathEscape(providers.GeminiModelName(model)), nil)
 	if err != nil {
 		return 0, err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-goog-api-key", apiKey)
 
 	resp, err := client.Do(httpReq)
 	if err != nil {
@@ -204,33 +170,32 @@ func fetchOllamaContextLimit(client *http.Client, cfg providers.OllamaConfig, mo
 	defer resp.Body.Close()
 	if resp.StatusCode >= 300 {
 		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
-		return 0, fmt.Errorf("ollama %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		return 0, fmt.Errorf("gemini %d: %s", resp.StatusCode, strings.TrimSpace(string(b)))
 	}
 
 	var raw struct {
-		ModelInfo map[string]any `json:"model_info"`
-		Details   map[string]any `json:"details"`
+		InputTokenLimit any `json:"inputTokenLimit"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
 		return 0, err
 	}
-	for k, v := range raw.ModelInfo {
-		if strings.Contains(strings.ToLower(k), "context_length") {
-			if n, ok := toInt(v); ok && n > 0 {
-				return n, nil
-			}
-		}
-	}
-	for k, v := range raw.Details {
-		if strings.Contains(strings.ToLower(k), "context") {
-			if n, ok := toInt(v); ok && n > 0 {
-				return n, nil
-			}
-		}
+	if n, ok := toInt(raw.InputTokenLimit); ok && n > 0 {
+		return n, nil
 	}
 	return 0, fmt.Errorf("context length unavailable")
 }
 
+func fetchOllamaContextLimit(client *http.Client, cfg providers.OllamaConfig, model string) (int, error) {
+	info, err := fetchOllamaModel(client, cfg, model)
+	if err != nil {
+		return 0, err
+	}
+	if info.ContextLength <= 0 {
+		return 0, fmt.Errorf("context length unavailable")
+	}
+	return info.ContextLength, nil
+}
+
 func toInt(v any) (int, bool) {
 	switch n := v.(type) {
 	case float64:
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"regexp"
+	"strings"
+	"time"
+
+	"llm-mux/backend/internal/state"
+)
+
+// chatExportFormat tags JSON exports so they can be imported again.
+const chatExportFormat = "llm-mux-chat"
+
+type chatExport struct {
+	Format     string     `json:"format"`
+	Version    int        `json:"version"`
+	ExportedAt time.Time  `json:"exportedAt"`
+	FolderName string     `json:"folderName,omitempty"`
+	Chat       state.Chat `json:"chat"`
+}
+
+// exportTurn is one user message with the responses that answered it.
+type exportTurn struct {
+	User      *state.Message
+	Responses []state.Message
+}
+
+func exportTurns(messages []state.Message) []exportTurn {
+	turns := []exportTurn{}
+	for i := range messages {
+		msg := messages[i]
+		if msg.Role == "user" || len(turns) == 0 {
+			turns = append(turns, exportTurn{})
+		}
+		if msg.Role == "user" {
+			turns[len(turns)-1].User = &msg
+			continue
+		}
+		turns[len(turns)-1].Responses = append(turns[len(turns)-1].Responses, msg)
+	}
+	return turns
+}
+
+// exportChat renders chat in format (md, json or html) and returns the body,
+// its content type and the file extension.
+func exportChat(chat state.Chat, folderName, format string, versions bool) ([]byte, string, string, error) {
+	if !versions {
+		for i := range chat.Messages {
+			chat.Messages[i].History = nil
+			chat.Messages[i].HistoryIndex = 0
+		}
+	}
+	switch format {
+	case "", "md", "markdown":
+		return []byte(exportMarkdown(chat, versions)), "text/markdown; charset=utf-8", "md", nil
+	case "json":
+		payload, err := json.MarshalIndent(chatExport{
+			Format:     chatExportFormat,
+			Version:    1,
+			ExportedAt: time.Now().UTC(),
+			FolderName: folderName,
+			Chat:       chat,
+		}, "", "  ")
+		if err != nil {
+			return nil, "", "", err
+		}
+		return payload, "application/json", "json", nil
+	case "html":
+		var buf bytes.Buffer
+		if err := exportHTMLTemplate.Execute(&buf, htmlExportView(chat, versions)); err != nil {
+			return nil, "", "", err
+		}
+		return buf.Bytes(), "text/html; charset=utf-8", "html", nil
+	default:
+		return nil, "", "", fmt.Errorf("unsupported export format %q (want md, json or html)", format)
+	}
+}
+
+func exportMarkdown(chat state.Chat, versions bool) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", singleLine(chat.Title))
+	fmt.Fprintf(&b, "_Exported %s_\n", time.Now().UTC().Format("2006-01-02 15:04 MST"))
+
+	for _, turn := range exportTurns(chat.Messages) {
+		b.WriteString("\n---\n\n")
+		if turn.User != nil {
+			b.WriteString("## User\n\n")
+			writeMarkdownMessage(&b, *turn.User, versions)
+		}
+		for _, resp := range turn.Responses {
+			fmt.Fprintf(&b, "### %s\n\n", state.ResponseLabel(resp.Provider, resp.Model))
+			writeMarkdownMessage(&b, resp, versions)
+		}
+	}
+	return b.String()
+}
+
+func writeMarkdownMessage(b *strings.Builder, msg state.Message, versions bool) {
+	if versions && len(msg.History) > 1 {
+		for i, v := range msg.History {
+			current := ""
+			if i == msg.HistoryIndex {
+				current = " (shown)"
+			}
+			fmt.Fprintf(b, "#### Version %d of %d%s\n\n", i+1, len(msg.History), current)
+			writeMarkdownBody(b, v.Content, v.Attachments, v.Status, v.Error, v.ErrorStatus)
+		}
+		return
+	}
+	writeMarkdownBody(b, msg.Content, msg.Attachments, msg.Status, msg.Error, msg.ErrorStatus)
+}
+
+func writeMarkdownBody(b *strings.Builder, content string, attachments []state.TextAttachment, status, errText string, errStatus int) {
+	if strings.TrimSpace(content) != "" {
+		b.WriteString(strings.TrimSpace(content))
+		b.WriteString("\n\n")
+	}
+	if label := statusLabel(status, errText, errStatus); label != "" {
+		fmt.Fprintf(b, "> %s\n\n", label)
+	}
+	for _, a := range attachments {
+		fence := markdownFence(a.Content)
+		fmt.Fprintf(b, "**Attachment: %s**\n\n%s\n%s\n%s\n\n", a.Name, fence, strings.TrimRight(a.Content, "\n"), fence)
+	}
+}
+
+var backtickRun = regexp.MustCompile("`{3,}")
+
+// markdownFence returns a code fence longer than any backtick run in content.
+func markdownFence(content string) string {
+	fence := "```"
+	for _, run := range backtickRun.FindAllString(content, -1) {
+		if len(run) >= len(fence) {
+			fence = strings.Repeat("`", len(run)+1)
+		}
+	}
+	return fence
+}
+
+func statusLabel(status, errText string, errStatus int) string {
+	switch status {
+	case state.MessageStatusError:
+		if errStatus > 0 {
+			return fmt.Sprintf("Error (%d): %s", errStatus, errText)
+		}
+		return "Error: " + errText
+	case state.MessageStatusCancelled:
+		return "Cancelled"
+	case state.MessageStatusInterrupted:
+		return "Interrupted"
+	}
+	return ""
+}
+
+type htmlVersion struct {
+	Label       string
+	Content     string
+	Attachments []state.TextAttachment
+	Status      string
+}
+
+type htmlMessage struct {
+	Label    string
+	Versions []htmlVersion
+}
+
+type htmlTurn struct {
+	User      *htmlMessage
+	Responses []htmlMessage
+}
+
+type htmlView struct {
+	Title      string
+	ExportedAt string
+	Turns      []htmlTurn
+}
+
+func htmlExportView(chat state.Chat, versions bool) htmlView {
+	view := htmlView{Title: singleLine(chat.Title), ExportedAt: time.Now().UTC().Format("2006-01-02 15:04 MST")}
+	for _, turn := range exportTurns(chat.Messages) {
+		t := htmlTurn{}
+		if turn.User != nil {
+			m := htmlExportMessage(*turn.User, "User", versions)
+			t.User = &m
+		}
+		for _, resp := range turn.Responses {
+			t.Responses = append(t.Responses, htmlExportMessage(resp, state.ResponseLabel(resp.Provider, resp.Model), versions))
+		}
+		view.Turns = append(view.Turns, t)
+	}
+	return view
+}
+
+func htmlExportMessage(msg state.Message, label string, versions bool) htmlMessage {
+	out := htmlMessage{Label: label}
+	if versions && len(msg.History) > 1 {
+		for i, v := range msg.History {
+			name := fmt.Sprintf("Version %d of %d", i+1, len(msg.History))
+			if i == msg.HistoryIndex {
+				name += " (shown)"
+			}
+			out.Versions = append(out.Versions, htmlVersion{
+				Label:       name,
+				Content:     strings.TrimSpace(v.Content),
+				Attachments: v.Attachments,
+				Status:      statusLabel(v.Status, v.Error, v.ErrorStatus),
+			})
+		}
+		return out
+	}
+	out.Versions = []htmlVersion{{
+		Content:     strings.TrimSpace(msg.Content),
+		Attachments: msg.Attachments,
+		Status:      statusLabel(msg.Status, msg.Error, msg.ErrorStatus),
+	}}
+	return out
+}
+
+var exportHTMLTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: system-ui, -apple-system, "Segoe UI", sans-serif; margin: 0 auto; max-width: 1200px; padding: 24px; color: #1f2328; background: #fff; }
+h1 { margin-bottom: 4px; }
+.meta { color: #656d76; margin-bottom: 24px; }
+.turn { border-top: 1px solid #d0d7de; padding: 16px 0; }
+.responses { display: grid; gap: 12px; grid-template-columns: repeat(auto-fit, minmax(320px, 1fr)); margin-top: 12px; }
+.message { border: 1px solid #d0d7de; border-radius: 8px; padding: 12px; }
+.message.user { background: #f6f8fa; }
+.label { font-weight: 600; margin-bottom: 8px; }
+.version-label { color: #656d76; font-size: 0.9em; margin: 8px 0 4px; }
+.content { white-space: pre-wrap; word-wrap: break-word; margin: 0; font: inherit; }
+.status { color: #cf222e; margin-top: 8px; }
+details { margin-top: 8px; }
+details pre { background: #f6f8fa; padding: 8px; overflow-x: auto; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<div class="meta">Exported {{.ExportedAt}}</div>
+{{define "message"}}
+<div class="label">{{.Label}}</div>
+{{range .Versions}}
+{{if .Label}}<div class="version-label">{{.Label}}</div>{{end}}
+<pre class="content">{{.Content}}</pre>
+{{if .Status}}<div class="status">{{.Status}}</div>{{end}}
+{{range .Attachments}}<details><summary>Attachment: {{.Name}}</summary><pre>{{.Content}}</pre></details>{{end}}
+{{end}}
+{{end}}
+{{range .Turns}}
+<section class="turn">
+{{with .User}}<div class="message user">{{template "message" .}}</div>{{end}}
+{{if .Responses}}<div class="responses">{{range .Responses}}<div class="message">{{template "message" .}}</div>{{end}}</div>{{end}}
+</section>
+{{end}}
+</body>
+</html>
+`))
+
+func singleLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func exportFilename(title, ext string) string {
+	name := strings.Trim(unsafeFilenameChars.ReplaceAllString(title, "-"), "-.")
+	if len(name) > 60 {
+		name = strings.Trim(name[:60], "-.")
+	}
+	if name == "" {
+		name = "chat"
+	}
+	return name + "." + ext
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"llm-mux/backend/internal/state"
+)
+
+// maxImportBytes caps upload size; ChatGPT exports of long-time users are large.
+const maxImportBytes = 256 << 20
+
+const (
+	importFormatLLMMux    = "llm-mux"
+	importFormatChatGPT   = "chatgpt"
+	importFormatOpenWebUI = "openwebui"
+)
+
+var errUnknownImportFormat = errors.New("unrecognized import format (want a ChatGPT, Open WebUI or llm-mux JSON export)")
+
+// parseImport detects the export format of raw and converts every conversation
+// in it. Branching conversations become one chat per branch.
+func parseImport(raw []byte) (string, []state.Chat, error) {
+	raw = bytes.TrimSpace(raw)
+	var items []json.RawMessage
+	switch {
+	case len(raw) > 0 && raw[0] == '[':
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return "", nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	case len(raw) > 0 && raw[0] == '{':
+		items = []json.RawMessage{raw}
+	default:
+		return "", nil, errUnknownImportFormat
+	}
+	if len(items) == 0 {
+		return "", nil, errors.New("export contains no conversations")
+	}
+
+	var probe struct {
+		Format  string          `json:"format"`
+		Mapping json.RawMessage `json:"mapping"`
+		Chat    json.RawMessage `json:"chat"`
+	}
+	if err := json.Unmarshal(items[0], &probe); err != nil {
+		return "", nil, fmt.Errorf("invalid JSON: %w", err)
+	}
+	var format string
+	var convert func(json.RawMessage) ([]state.Chat, error)
+	switch {
+	case probe.Format == chatExportFormat:
+		format, convert = importFormatLLMMux, importLLMMux
+	case len(probe.Mapping) > 0:
+		format, convert = importFormatChatGPT, importChatGPT
+	case len(probe.Chat) > 0:
+		format, convert = importFormatOpenWebUI, importOpenWebUI
+	default:
+		return "", nil, errUnknownImportFormat
+	}
+
+	chats := []state.Chat{}
+	for i, item := range items {
+		converted, err := convert(item)
+		if err != nil {
+			return "", nil, fmt.Errorf("conversation %d: %w", i+1, err)
+		}
+		chats = append(chats, converted...)
+	}
+	return format, chats, nil
+}
+
+func importLLMMux(raw json.RawMessage) ([]state.Chat, error) {
+	var export chatExport
+	if err := json.Unmarshal(raw, &export); err != nil {
+		return nil, err
+	}
+	if export.Format != chatExportFormat {
+		return nil, errUnknownImportFormat
+	}
+	if export.Version > 1 {
+		return nil, fmt.Errorf("export version %d is newer than this build supports", export.Version)
+	}
+	return []state.Chat{export.Chat}, nil
+}
+
+type chatGPTConversation struct {
+	Title       string                 `json:"title"`
+	CreateTime  float64                `json:"create_time"`
+	UpdateTime  float64                `json:"update_time"`
+	Mapping     map[string]chatGPTNode `json:"mapping"`
+	CurrentNode string                 `json:"current_node"`
+}
+
+type chatGPTNode struct {
+	Message  *chatGPTMessage `json:"message"`
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+}
+
+type chatGPTMessage struct {
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string            `json:"content_type"`
+		Parts       []json.RawMessage `json:"parts"`
+		Text        string            `json:"text"`
+	} `json:"content"`
+	Recipient string `json:"recipient"`
+	Metadata  struct {
+		ModelSlug string `json:"model_slug"`
+		Hidden    bool   `json:"is_visually_hidden_from_conversation"`
+	} `json:"metadata"`
+}
+
+func importChatGPT(raw json.RawMessage) ([]state.Chat, error) {
+	var conv chatGPTConversation
+	if err := json.Unmarshal(raw, &conv); err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]*importNode, len(conv.Mapping))
+	for id, node := range conv.Mapping {
+		n := &importNode{parent: node.Parent, children: node.Children}
+		if m := node.Message; m != nil && !m.Metadata.Hidden && (m.Recipient == "" || m.Recipient == "all") {
+			n.msg = importedMessage(m.Author.Role, chatGPTText(m), m.Metadata.ModelSlug, unixTime(m.CreateTime))
+		}
+		nodes[id] = n
+	}
+	return chatsFromTree(conv.Title, unixTime(conv.CreateTime), unixTime(conv.UpdateTime), nodes, conv.CurrentNode), nil
+}
+
+// chatGPTText joins the text parts of a message; images and other non-text
+// parts are dropped.
+func chatGPTText(m *chatGPTMessage) string {
+	var parts []string
+	for _, raw := range m.Content.Parts {
+		var s string
+		if json.Unmarshal(raw, &s) == nil && s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return m.Content.Text
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+type openWebUIExport struct {
+	Title     string        `json:"title"`
+	CreatedAt float64       `json:"created_at"`
+	UpdatedAt float64       `json:"updated_at"`
+	Chat      openWebUIChat `json:"chat"`
+}
+
+type openWebUIChat struct {
+	Title     string             `json:"title"`
+	Timestamp float64            `json:"timestamp"`
+	Messages  []openWebUIMessage `json:"messages"`
+	History   struct {
+		Messages  map[string]openWebUIMessage `json:"messages"`
+		CurrentID string                      `json:"currentId"`
+	} `json:"history"`
+}
+
+type openWebUIMessage struct {
+	ID          string   `json:"id"`
+	ParentID    string   `json:"parentId"`
+	ChildrenIDs []string `json:"childrenIds"`
+	Role        string   `json:"role"`
+	Content     string   `json:"content"`
+	Model       string   `json:"model"`
+	Timestamp   float64  `json:"timestamp"`
+}
+
+func importOpenWebUI(raw json.RawMessage) ([]state.Chat, error) {
+	var export openWebUIExport
+	if err := json.Unmarshal(raw, &export); err != nil {
+		return nil, err
+	}
+	title := export.Title
+	if strings.TrimSpace(title) == "" {
+		title = export.Chat.Title
+	}
+	created := unixTime(export.CreatedAt)
+	if created.IsZero() {
+		created = unixTime(export.Chat.Timestamp)
+	}
+
+	nodes := map[string]*importNode{}
+	current := export.Chat.History.CurrentID
+	if len(export.Chat.History.Messages) > 0 {
+		for id, m := range export.Chat.History.Messages {
+			nodes[id] = &importNode{
+				parent:   m.ParentID,
+				children: m.ChildrenIDs,
+				msg:      importedMessage(m.Role, m.Content, m.Model, unixTime(m.Timestamp)),
+			}
+		}
+	} else {
+		// Older exports only carry the visible thread as a flat list.
+		prev := ""
+		for i, m := range export.Chat.Messages {
+			id := m.ID
+			if id == "" {
+				id = fmt.Sprintf("message-%d", i)
+			}
+			nodes[id] = &importNode{parent: prev, msg: importedMessage(m.Role, m.Content, m.Model, unixTime(m.Timestamp))}
+			if prev != "" {
+				nodes[prev].children = append(nodes[prev].children, id)
+			}
+			prev = id
+		}
+		current = prev
+	}
+	return chatsFromTree(title, created, unixTime(export.UpdatedAt), nodes, current), nil
+}
+
+// importNode is one message of a conversation tree; msg is nil for nodes that
+// are not imported (system prompts, tool calls, empty messages).
+type importNode struct {
+	parent   string
+	children []string
+	msg      *state.Message
+}
+
+// chatsFromTree turns a message tree into chats. The branch ending at current
+// becomes the main chat; every other branch becomes a fork that shares the
+// message IDs of the common prefix, like ForkChatFromMessage produces.
+func chatsFromTree(title string, created, updated time.Time, nodes map[string]*importNode, current string) []state.Chat {
+	roots := []string{}
+	for id, n := range nodes {
+		if _, ok := nodes[n.parent]; !ok {
+			roots = append(roots, id)
+		}
+	}
+	sort.Strings(roots)
+
+	var leaves []string
+	visited := map[string]bool{}
+	var walk func(id string)
+	walk = func(id string) {
+		if visited[id] {
+			return
+		}
+		visited[id] = true
+		n := nodes[id]
+		isLeaf := true
+		for _, child := range n.children {
+			if _, ok := nodes[child]; ok {
+				isLeaf = false
+				walk(child)
+			}
+		}
+		if isLeaf {
+			leaves = append(leaves, id)
+		}
+	}
+	for _, id := range roots {
+		walk(id)
+	}
+	if _, ok := nodes[current]; !ok && len(leaves) > 0 {
+		current = leaves[len(leaves)-1]
+	}
+
+	path := func(id string) []state.Message {
+		var msgs []state.Message
+		seen := map[string]bool{}
+		for n, ok := nodes[id]; ok && !seen[id]; n, ok = nodes[id] {
+			seen[id] = true
+			if n.msg != nil {
+				msgs = append(msgs, *n.msg)
+			}
+			id = n.parent
+		}
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+		// Messages without a timestamp inherit the one before them.
+		last := created
+		for i := range msgs {
+			if msgs[i].CreatedAt.IsZero() {
+				msgs[i].CreatedAt = last
+			}
+			last = msgs[i].CreatedAt
+		}
+		return msgs
+	}
+
+	if updated.IsZero() {
+		updated = created
+	}
+	chats := []state.Chat{}
+	var produced [][]state.Message
+	for i, id := range append([]string{current}, leaves...) {
+		msgs := path(id)
+		if len(msgs) == 0 || isPrefixOfAny(msgs, produced) {
+			continue
+		}
+		chatTitle := strings.TrimSpace(title)
+		if i > 0 {
+			chatTitle += " (Fork)"
+		}
+		produced = append(produced, msgs)
+		chats = append(chats, state.Chat{
+			Title:     strings.TrimSpace(chatTitle),
+			Messages:  msgs,
+			CreatedAt: created,
+			UpdatedAt: updated,
+		})
+	}
+	return chats
+}
+
+func isPrefixOfAny(msgs []state.Message, paths [][]state.Message) bool {
+	for _, p := range paths {
+		if len(msgs) > len(p) {
+			continue
+		}
+		prefix := true
+		for i := range msgs {
+			if msgs[i].ID != p[i].ID {
+				prefix = false
+				break
+			}
+		}
+		if prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// importedMessage converts a user or assistant message; anything else, and
+// messages without text, yield nil. Assistant messages keep the original model
+// name but no provider or target, as no configured provider ran them, and are
+// shared with every model, since the source had a single thread.
+func importedMessage(role, content, model string, created time.Time) *state.Message {
+	if role != "user" && role != "assistant" {
+		return nil
+	}
+	if strings.TrimSpace(content) == "" {
+		return nil
+	}
+	msg := &state.Message{
+		ID:        state.NewID("msg"),
+		Role:      role,
+		Content:   content,
+		Inclusion: "always",
+		CreatedAt: created,
+	}
+	if role == "assistant" {
+		msg.Model = strings.TrimSpace(model)
+	}
+	return msg
+}
+
+// unixTime converts export timestamps, which come in seconds or milliseconds.
+func unixTime(v float64) time.Time {
+	if v <= 0 {
+		return time.Time{}
+	}
+	if v > 1e12 {
+		return time.UnixMilli(int64(v)).UTC()
+	}
+	sec := int64(v)
+	return time.Unix(sec, int64((v-float64(sec))*1e9)).UTC()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"llm-mux/backend/internal/state"
+)
+
+// describeChats renders chats as "title: role:content model, ..." for
+// comparison.
+func describeChats(chats []state.Chat) []string {
+	out := []string{}
+	for _, c := range chats {
+		var msgs []string
+		for _, m := range c.Messages {
+			s := m.Role + ":" + m.Content
+			if m.TargetID != "" {
+				s += " " + m.TargetID
+			} else if m.Model != "" {
+				s += " (" + m.Model + ")"
+			}
+			msgs = append(msgs, s)
+		}
+		out = append(out, c.Title+": "+strings.Join(msgs, ", "))
+	}
+	return out
+}
+
+const chatGPTBranching = `[{
+	"title": "Trip",
+	"create_time": 1700000000.5,
+	"update_time": 1700000100,
+	"current_node": "a2",
+	"mapping": {
+		"root": {"message": null, "parent": "", "children": ["sys"]},
+		"sys": {"message": {"author": {"role": "system"}, "content": {"content_type": "text", "parts": ["be nice"]}}, "parent": "root", "children": ["u1"]},
+		"u1": {"message": {"author": {"role": "user"}, "create_time": 1700000001, "content": {"content_type": "text", "parts": ["where to?", {"asset": "img"}]}}, "parent": "sys", "children": ["a1", "a2"]},
+		"a1": {"message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Paris"]}, "metadata": {"model_slug": "gpt-4o"}}, "parent": "u1", "children": []},
+		"a2": {"message": {"author": {"role": "assistant"}, "content": {"content_type": "text", "parts": ["Rome"]}, "metadata": {"model_slug": "gpt-4o"}}, "parent": "u1", "children": ["t1"]},
+		"t1": {"message": {"author": {"role": "assistant"}, "recipient": "browser", "content": {"content_type": "code", "text": "search()"}}, "parent": "a2", "children": []}
+	}
+}]`
+
+const openWebUIHistory = `[{
+	"title": "Maths",
+	"created_at": 1700000000,
+	"chat": {
+		"history": {
+			"currentId": "m3",
+			"messages": {
+				"m1": {"id": "m1", "parentId": null, "childrenIds": ["m2", "m3"], "role": "user", "content": "2+2?", "timestamp": 1700000001},
+				"m2": {"id": "m2", "parentId": "m1", "childrenIds": [], "role": "assistant", "content": "5", "model": "llama3"},
+				"m3": {"id": "m3", "parentId": "m1", "childrenIds": [], "role": "assistant", "content": "4", "model": "llama3"}
+			}
+		}
+	}
+}]`
+
+const openWebUIFlat = `{
+	"chat": {
+		"title": "Old",
+		"timestamp": 1700000000000,
+		"messages": [
+			{"role": "user", "content": "hi"},
+			{"role": "assistant", "content": "  "},
+			{"role": "assistant", "content": "hello", "model": "qwen"}
+		]
+	}
+}`
+
+const llmMuxExport = `{
+	"format": "llm-mux-chat",
+	"version": 1,
+	"chat": {"title": "Mine", "messages": [
+		{"id": "msg_1", "role": "user", "content": "q"},
+		{"id": "msg_2", "role": "assistant", "content": "a", "provider": "ollama", "model": "m", "targetId": "ollama:m"}
+	]}
+}`
+
+func TestParseImport(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		format string
+		want   []string
+		err    string
+	}{
+		{"chatgpt branches", chatGPTBranching, importFormatChatGPT, []string{
+			"Trip: user:where to?, assistant:Rome (gpt-4o)",
+			"Trip (Fork): user:where to?, assistant:Paris (gpt-4o)",
+		}, ""},
+		{"open webui history", openWebUIHistory, importFormatOpenWebUI, []string{
+			"Maths: user:2+2?, assistant:4 (llama3)",
+			"Maths (Fork): user:2+2?, assistant:5 (llama3)",
+		}, ""},
+		{"open webui flat list", openWebUIFlat, importFormatOpenWebUI, []string{
+			"Old: user:hi, assistant:hello (qwen)",
+		}, ""},
+		{"llm-mux export", llmMuxExport, importFormatLLMMux, []string{
+			"Mine: user:q, assistant:a ollama:m",
+		}, ""},
+		{"newer llm-mux export", `{"format": "llm-mux-chat", "version": 2, "chat": {}}`, "", nil, "newer than this build"},
+		{"unknown object", `{"foo": 1}`, "", nil, "unrecognized import format"},
+		{"not JSON", `hello`, "", nil, "unrecognized import format"},
+		{"broken JSON", `[{"mapping": `, "", nil, "invalid JSON"},
+		{"empty list", `[]`, "", nil, "no conversations"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, chats, err := parseImport([]byte(tt.raw))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if format != tt.format {
+				t.Fatalf("format = %q, want %q", format, tt.format)
+			}
+			got := describeChats(chats)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("chats:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// Forks share the IDs of the common prefix and missing timestamps fall back
+// to the one before them.
+func TestParseImportChatGPTTree(t *testing.T) {
+	_, chats, err := parseImport([]byte(chatGPTBranching))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chats) != 2 {
+		t.Fatalf("got %d chats", len(chats))
+	}
+	first, fork := chats[0].Messages, chats[1].Messages
+	if first[0].ID != fork[0].ID || first[1].ID == fork[1].ID {
+		t.Fatalf("prefix IDs not shared: %s/%s %s/%s", first[0].ID, fork[0].ID, first[1].ID, fork[1].ID)
+	}
+	if want := time.Unix(1700000001, 0).UTC(); !first[1].CreatedAt.Equal(want) {
+		t.Fatalf("reply time = %v, want %v", first[1].CreatedAt, want)
+	}
+	if want := time.Unix(1700000000, 5e8).UTC(); !chats[0].CreatedAt.Equal(want) {
+		t.Fatalf("chat time = %v, want %v", chats[0].CreatedAt, want)
+	}
+}
+
+func TestUnixTime(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want time.Time
+	}{
+		{0, time.Time{}},
+		{-5, time.Time{}},
+		{1700000000, time.Unix(1700000000, 0).UTC()},
+		{1700000000.25, time.Unix(1700000000, 25e7).UTC()},
+		{1700000000123, time.UnixMilli(1700000000123).UTC()},
+	}
+	for _, tt := range tests {
+		if got := unixTime(tt.in); !got.Equal(tt.want) {
+			t.Errorf("unixTime(%v) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	AnthropicVersion          = "2023-06-01"
+	anthropicDefaultMaxTokens = 4096
+)
+
+type AnthropicAdapter struct {
+	http *http.Client
+}
+
+func NewAnthropicAdapter() *AnthropicAdapter {
+	return &AnthropicAdapter{
+		http: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+func (a *AnthropicAdapter) Name() string { return "anthropic" }
+
+func (a *AnthropicAdapter) Stream(ctx context.Context, req StreamRequest, emit func(StreamEvent) error) error {
+	apiKey := strings.TrimSpace(req.Config.Anthropic.APIKey)
+	if apiKey == "" {
+		return fmt.Errorf("anthropic.apiKey is required")
+	}
+
+	baseURL := AnthropicBaseURL(req.Config.Anthropic)
+
+	maxTokens := req.Target.MaxTokens
+	if maxTokens <= 0 {
+		maxTokens = req.Config.Anthropic.MaxTokens
+	}
+	if maxTokens <= 0 {
+		maxTokens = anthropicDefaultMaxTokens
+	}
+
+	targetID := req.Target.Provider + ":" + req.Target.Model
+	system, messages := anthropicMessages(req.Target.SystemPrompt, req.History, req.Prompt)
+
+	body := map[string]any{
+		"model":      req.Target.Model,
+		"messages":   messages,
+		"max_tokens": maxTokens,
+		"stream":     true,
+	}
+	if system != "" {
+		body["system"] = system
+	}
+	if req.Target.Temperature != nil {
+		body["temperature"] = *req.Target.Temperature
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, baseURL+"/messages", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("x-api-key", apiKey)
+	httpReq.Header.Set("anthropic-version", AnthropicVersion)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := a.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return newHTTPError("anthropic", resp)
+	}
+
+	usage := Usage{}
+	reader := bufio.NewScanner(resp.Body)
+	reader.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+
+	for reader.Scan() {
+		line := strings.TrimSpace(reader.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+
+		type anthropicUsage struct {
+			InputTokens              int `json:"input_tokens"`
+			OutputTokens             int `json:"output_tokens"`
+			CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+			CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+		}
+		var ev struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+			Message struct {
+				Usage anthropicUsage `json:"usage"`
+			} `json:"message"`
+			Usage *anthropicUsage `json:"usage"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &ev); err != nil {
+			continue
+		}
+
+		switch ev.Type {
+		case "message_start":
+			u := ev.Message.Usage
+			usage.PromptTokens = u.InputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+			usage.CompletionTokens = u.OutputTokens
+		case "message_delta":
+			// message_delta carries cumulative output tokens.
+			if ev.Usage != nil {
+				usage.CompletionTokens = ev.Usage.OutputTokens
+			}
+		case "content_block_delta":
+			if ev.Delta.Type != "text_delta" || ev.Delta.Text == "" {
+				continue
+			}
+			if err := emit(StreamEvent{
+				TargetID: targetID,
+				Provider: req.Target.Provider,
+				Model:    req.Target.Model,
+				Event:    "chunk",
+				Content:  ev.Delta.Text,
+			}); err != nil {
+				return err
+			}
+		case "message_stop":
+			return emit(StreamEvent{
+				TargetID: targetID,
+				Provider: req.Target.Provider,
+				Model:    req.Target.Model,
+				Event:    "usage",
+				Usage:    &usage,
+			})
+		case "error":
+			return fmt.Errorf("anthropic stream error (%s): %s", ev.Error.Type, ev.Error.Message)
+		}
+	}
+
+	return reader.Err()
+}
+
+// anthropicMessages lifts system content into the top-level system field and
+// folds the history into strictly alternating user/assistant turns starting
+// with a user turn, which the Messages API requires.
+func anthropicMessages(systemPrompt string, history []HistoryMessage, prompt string) (string, []map[string]string) {
+	systemParts := []string{}
+	if strings.TrimSpace(systemPrompt) != "" {
+		systemParts = append(systemParts, strings.TrimSpace(systemPrompt))
+	}
+
+	messages := []map[string]string{}
+	push := func(role, content string) {
+		if n := len(messages); n > 0 && messages[n-1]["role"] == role {
+			messages[n-1]["content"] += "\n\n" + content
+			return
+		}
+		messages = append(messages, map[string]string{"role": role, "content": content})
+	}
+
+	for _, m := range history {
+		content := strings.TrimSpace(m.Content)
+		if content == "" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(m.Role)) {
+		case "system":
+			systemParts = append(systemParts, content)
+		case "assistant":
+			if len(messages) == 0 {
+				push("user", "(continuing an earlier conversation)")
+			}
+			push("assistant", content)
+		case "user":
+			push("user", content)
+		}
+	}
+	push("user", prompt)
+
+	return strings.Join(systemParts, "\n\n"), messages
+}
+
+func AnthropicBaseURL(cfg AnthropicConfig) string {
+	baseURL := strings.TrimSpace(cfg.BaseURL)
+	if baseURL == "" {
+		baseURL = "https://api.anthropic.com/v1"
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
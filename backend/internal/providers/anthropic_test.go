@@ -0,0 +1,188 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestAnthropicMessages(t *testing.T) {
+	tests := []struct {
+		name       string
+		system     string
+		history    []HistoryMessage
+		prompt     string
+		wantSystem string
+		want       []map[string]string
+	}{
+		{
+			name:   "plain turns",
+			prompt: "q2",
+			history: []HistoryMessage{
+				{Role: "user", Content: "q1"},
+				{Role: "assistant", Content: "a1"},
+			},
+			want: []map[string]string{
+				{"role": "user", "content": "q1"},
+				{"role": "assistant", "content": "a1"},
+				{"role": "user", "content": "q2"},
+			},
+		},
+		{
+			name:   "leading assistant turn",
+			prompt: "q",
+			history: []HistoryMessage{
+				{Role: "assistant", Content: "summary"},
+			},
+			want: []map[string]string{
+				{"role": "user", "content": "(continuing an earlier conversation)"},
+				{"role": "assistant", "content": "summary"},
+				{"role": "user", "content": "q"},
+			},
+		},
+		{
+			name:   "consecutive user turns",
+			prompt: "q3",
+			history: []HistoryMessage{
+				{Role: "user", Content: "q1"},
+				{Role: "user", Content: "q2"},
+			},
+			want: []map[string]string{
+				{"role": "user", "content": "q1\n\nq2\n\nq3"},
+			},
+		},
+		{
+			name:   "consecutive assistant turns and blanks",
+			prompt: "q2",
+			history: []HistoryMessage{
+				{Role: "user", Content: "q1"},
+				{Role: "assistant", Content: "a"},
+				{Role: "assistant", Content: "  "},
+				{Role: "assistant", Content: "b"},
+			},
+			want: []map[string]string{
+				{"role": "user", "content": "q1"},
+				{"role": "assistant", "content": "a\n\nb"},
+				{"role": "user", "content": "q2"},
+			},
+		},
+		{
+			name:   "system folding",
+			system: " be brief ",
+			prompt: "q2",
+			history: []HistoryMessage{
+				{Role: "System", Content: "use metric"},
+				{Role: "user", Content: "q1"},
+				{Role: "system", Content: "no emoji"},
+				{Role: "assistant", Content: "a1"},
+			},
+			wantSystem: "be brief\n\nuse metric\n\nno emoji",
+			want: []map[string]string{
+				{"role": "user", "content": "q1"},
+				{"role": "assistant", "content": "a1"},
+				{"role": "user", "content": "q2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			system, messages := anthropicMessages(tt.system, tt.history, tt.prompt)
+			if system != tt.wantSystem {
+				t.Errorf("system = %q, want %q", system, tt.wantSystem)
+			}
+			if !reflect.DeepEqual(messages, tt.want) {
+				t.Errorf("messages = %v, want %v", messages, tt.want)
+			}
+		})
+	}
+}
+
+// anthropicRecordedStream is a /v1/messages stream as the API sends it.
+const anthropicRecordedStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_01","type":"message","role":"assistant","content":[],"model":"claude-sonnet-4-5","stop_reason":null,"stop_sequence":null,"usage":{"input_tokens":12,"cache_creation_input_tokens":0,"cache_read_input_tokens":30,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: ping
+data: {"type": "ping"}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":", world"}}
+
+event: content_block_stop
+data: {"type":"content_block_stop","index":0}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":5}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+func TestAnthropicStream(t *testing.T) {
+	var body map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/messages" || r.Header.Get("x-api-key") != "key" || r.Header.Get("anthropic-version") != AnthropicVersion {
+			t.Errorf("request %s with key %q, version %q", r.URL.Path, r.Header.Get("x-api-key"), r.Header.Get("anthropic-version"))
+		}
+		raw, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Errorf("request body: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, anthropicRecordedStream)
+	}))
+	defer srv.Close()
+
+	req := StreamRequest{
+		Prompt: "hi",
+		Target: Target{Provider: "anthropic", Model: "claude-sonnet-4-5", SystemPrompt: "be brief"},
+		Config: ProviderConfig{Anthropic: AnthropicConfig{APIKey: "key", BaseURL: srv.URL}},
+	}
+	var events []StreamEvent
+	err := NewAnthropicAdapter().Stream(context.Background(), req, func(ev StreamEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body["system"] != "be brief" || body["max_tokens"] != float64(anthropicDefaultMaxTokens) {
+		t.Errorf("body = %v", body)
+	}
+	want := []StreamEvent{
+		{TargetID: "anthropic:claude-sonnet-4-5", Provider: "anthropic", Model: "claude-sonnet-4-5", Event: "chunk", Content: "Hello"},
+		{TargetID: "anthropic:claude-sonnet-4-5", Provider: "anthropic", Model: "claude-sonnet-4-5", Event: "chunk", Content: ", world"},
+		{TargetID: "anthropic:claude-sonnet-4-5", Provider: "anthropic", Model: "claude-sonnet-4-5", Event: "usage", Usage: &Usage{PromptTokens: 42, CompletionTokens: 5}},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("events = %+v, want %+v", events, want)
+	}
+}
+
+func TestAnthropicStreamError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "event: error\ndata: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n")
+	}))
+	defer srv.Close()
+
+	req := StreamRequest{
+		Prompt: "hi",
+		Target: Target{Provider: "anthropic", Model: "m"},
+		Config: ProviderConfig{Anthropic: AnthropicConfig{APIKey: "key", BaseURL: srv.URL}},
+	}
+	err := NewAnthropicAdapter().Stream(context.Background(), req, func(StreamEvent) error { return nil })
+	if err == nil || err.Error() != "anthropic stream error (overloaded_error): Overloaded" {
+		t.Fatalf("err = %v", err)
+	}
+}
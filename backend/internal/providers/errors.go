@@ -0,0 +1,25 @@
+package providers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// HTTPError is returned when a provider answers with a non-2xx status, so
+// callers can keep the status code next to the message.
+type HTTPError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s error (%d): %s", e.Provider, e.StatusCode, e.Body)
+}
+
+func newHTTPError(provider string, resp *http.Response) *HTTPError {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &HTTPError{Provider: provider, StatusCode: resp.StatusCode, Body: strings.TrimSpace(string(b))}
+}
@@ -0,0 +1,205 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type GeminiAdapter struct {
+	http *http.Client
+}
+
+func NewGeminiAdapter() *GeminiAdapter {
+	return &GeminiAdapter{
+		http: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+func (a *GeminiAdapter) Name() string { return "gemini" }
+
+func (a *GeminiAdapter) Stream(ctx context.Context, req StreamRequest, emit func(StreamEvent) error) error {
+	apiKey := strings.TrimSpace(req.Config.Gemini.APIKey)
+	if apiKey == "" {
+		return fmt.Errorf("gemini.apiKey is required")
+	}
+	baseURL := GeminiBaseURL(req.Config.Gemini)
+
+	targetID := req.Target.Provider + ":" + req.Target.Model
+	type part struct {
+		Text string `json:"text"`
+	}
+	type content struct {
+		Role  string `json:"role,omitempty"`
+		Parts []part `json:"parts"`
+	}
+	contents := []content{}
+	push := func(role, text string) {
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, part{Text: text})
+			return
+		}
+		contents = append(contents, content{Role: role, Parts: []part{{Text: text}}})
+	}
+	for _, m := range req.History {
+		if strings.TrimSpace(m.Content) == "" {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(m.Role)) {
+		case "assistant":
+			push("model", m.Content)
+		case "user":
+			push("user", m.Content)
+		}
+	}
+	push("user", req.Prompt)
+
+	body := map[string]any{
+		"contents": contents,
+	}
+	if strings.TrimSpace(req.Target.SystemPrompt) != "" {
+		body["systemInstruction"] = content{Parts: []part{{Text: req.Target.SystemPrompt}}}
+	}
+	generationConfig := map[string]any{}
+	if req.Target.Temperature != nil {
+		generationConfig["temperature"] = *req.Target.Temperature
+	}
+	if req.Target.MaxTokens > 0 {
+		generationConfig["maxOutputTokens"] = req.Target.MaxTokens
+	}
+	if len(generationConfig) > 0 {
+		body["generationConfig"] = generationConfig
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	endpoint := baseURL + "/models/" + url.PathEscape(GeminiModelName(req.Target.Model)) + ":streamGenerateContent?alt=sse"
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("x-goog-api-key", apiKey)
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := a.http.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return newHTTPError("gemini", resp)
+	}
+
+	var usage *Usage
+	reader := bufio.NewScanner(resp.Body)
+	reader.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+
+	for reader.Scan() {
+		line := strings.TrimSpace(reader.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "" {
+			continue
+		}
+
+		var chunk struct {
+			Candidates []struct {
+				Content struct {
+					Parts []struct {
+						Text    string `json:"text"`
+						Thought bool   `json:"thought"`
+					} `json:"parts"`
+				} `json:"content"`
+			} `json:"candidates"`
+			PromptFeedback struct {
+				BlockReason string `json:"blockReason"`
+			} `json:"promptFeedback"`
+			UsageMetadata *struct {
+				PromptTokenCount     int `json:"promptTokenCount"`
+				CandidatesTokenCount int `json:"candidatesTokenCount"`
+				ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+			} `json:"usageMetadata"`
+			Error struct {
+				Code    int    `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		if chunk.Error.Message != "" {
+			return fmt.Errorf("gemini stream error (%d): %s", chunk.Error.Code, chunk.Error.Message)
+		}
+		if chunk.PromptFeedback.BlockReason != "" {
+			return fmt.Errorf("gemini blocked the prompt: %s", chunk.PromptFeedback.BlockReason)
+		}
+		// Every chunk repeats the running totals; keep the latest.
+		if m := chunk.UsageMetadata; m != nil {
+			usage = &Usage{
+				PromptTokens:     m.PromptTokenCount,
+				CompletionTokens: m.CandidatesTokenCount + m.ThoughtsTokenCount,
+			}
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+
+		for _, p := range chunk.Candidates[0].Content.Parts {
+			if p.Thought || p.Text == "" {
+				continue
+			}
+			if err := emit(StreamEvent{
+				TargetID: targetID,
+				Provider: req.Target.Provider,
+				Model:    req.Target.Model,
+				Event:    "chunk",
+				Content:  p.Text,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := reader.Err(); err != nil {
+		return err
+	}
+	if usage == nil {
+		return nil
+	}
+	return emit(StreamEvent{
+		TargetID: targetID,
+		Provider: req.Target.Provider,
+		Model:    req.Target.Model,
+		Event:    "usage",
+		Usage:    usage,
+	})
+}
+
+func GeminiBaseURL(cfg GeminiConfig) string {
+	baseURL := strings.TrimSpace(cfg.BaseURL)
+	if baseURL == "" {
+		baseURL = "https://generativelanguage.googleapis.com/v1beta"
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+// GeminiModelName accepts both "gemini-2.5-flash" and the API's
+// "models/gemini-2.5-flash" resource form.
+func GeminiModelName(model string) string {
+	return strings.TrimPrefix(strings.TrimSpace(model), "models/")
+}
@@ -5,8 +5,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
-	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -73,8 +71,7 @@ func (a *OllamaAdapter) Stream(ctx context.Context, req StreamRequest, emit func
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
-		return fmt.Errorf("ollama error (%d): %s", resp.StatusCode, strings.TrimSpace(string(b)))
+		return newHTTPError("ollama", resp)
 	}
 
 	reader := bufio.NewScanner(resp.Body)
@@ -91,11 +88,25 @@ func (a *OllamaAdapter) Stream(ctx context.Context, req StreamRequest, emit func
 			Message struct {
 				Content string `json:"content"`
 			} `json:"message"`
+			PromptEvalCount int `json:"prompt_eval_count"`
+			EvalCount       int `json:"eval_count"`
 		}
 		if err := json.Unmarshal([]byte(line), &chunk); err != nil {
 			continue
 		}
 		if chunk.Done {
+			if err := emit(StreamEvent{
+				TargetID: targetID,
+				Provider: req.Target.Provider,
+				Model:    req.Target.Model,
+				Event:    "usage",
+				Usage: &Usage{
+					PromptTokens:     chunk.PromptEvalCount,
+					CompletionTokens: chunk.EvalCount,
+				},
+			}); err != nil {
+				return err
+			}
 			break
 		}
 		if chunk.Message.Content == "" {
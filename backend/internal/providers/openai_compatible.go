@@ -0,0 +1,178 @@
+package providers
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type OpenAICompatibleAdapter struct {
+	http *http.Client
+}
+
+func NewOpenAICompatibleAdapter() *OpenAICompatibleAdapter {
+	return &OpenAICompatibleAdapter{
+		http: &http.Client{
+			Timeout: 120 * time.Second,
+		},
+	}
+}
+
+func (a *OpenAICompatibleAdapter) Name() string { return "openai_compatible" }
+
+func (a *OpenAICompatibleAdapter) Stream(ctx context.Context, req StreamRequest, emit func(StreamEvent) error) error {
+	endpoint, ok := req.Config.Endpoint(req.Target.Provider)
+	if !ok {
+		return fmt.Errorf("openai-compatible endpoint %q is not configured", req.Target.Provider)
+	}
+	baseURL := strings.TrimSuffix(strings.TrimSpace(endpoint.BaseURL), "/")
+	if baseURL == "" {
+		return fmt.Errorf("%s.baseUrl is required", endpoint.ID)
+	}
+
+	headers := http.Header{}
+	if key := strings.TrimSpace(endpoint.APIKey); key != "" {
+		header, value := EndpointAuthHeader(endpoint)
+		headers.Set(header, value)
+	}
+	var extra map[string]any
+	if endpoint.StreamUsage {
+		extra = map[string]any{"stream_options": includeUsage}
+	}
+	return streamChatCompletions(ctx, a.http, baseURL+"/chat/completions", headers, endpoint.ID, extra, req, emit)
+}
+
+// includeUsage is the stream_options value that makes the last chunk carry
+// token usage.
+var includeUsage = map[string]any{"include_usage": true}
+
+// EndpointAuthHeader returns the header used to send the endpoint API key.
+// Authorization keeps the usual bearer scheme; any other header carries the raw key.
+func EndpointAuthHeader(endpoint OpenAICompatibleConfig) (string, string) {
+	header := strings.TrimSpace(endpoint.APIKeyHeader)
+	key := strings.TrimSpace(endpoint.APIKey)
+	if header == "" || strings.EqualFold(header, "Authorization") {
+		return "Authorization", "Bearer " + key
+	}
+	return header, key
+}
+
+func streamChatCompletions(ctx context.Context, client *http.Client, url string, headers http.Header, label string, extra map[string]any, req StreamRequest, emit func(StreamEvent) error) error {
+	targetID := req.Target.Provider + ":" + req.Target.Model
+	messages := []map[string]string{}
+	if req.Target.SystemPrompt != "" {
+		messages = append(messages, map[string]string{"role": "system", "content": req.Target.SystemPrompt})
+	}
+	for _, m := range req.History {
+		if strings.TrimSpace(m.Content) == "" || strings.TrimSpace(m.Role) == "" {
+			continue
+		}
+		messages = append(messages, map[string]string{"role": m.Role, "content": m.Content})
+	}
+	messages = append(messages, map[string]string{"role": "user", "content": req.Prompt})
+
+	body := map[string]any{
+		"model":    req.Target.Model,
+		"messages": messages,
+		"stream":   true,
+	}
+	if req.Target.Temperature != nil {
+		body["temperature"] = *req.Target.Temperature
+	}
+	for k, v := range extra {
+		body[k] = v
+	}
+
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		httpReq.Header[k] = v
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return newHTTPError(label, resp)
+	}
+
+	reader := bufio.NewScanner(resp.Body)
+	reader.Buffer(make([]byte, 0, 64*1024), 2*1024*1024)
+
+	for reader.Scan() {
+		line := strings.TrimSpace(reader.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		if data == "" {
+			continue
+		}
+
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+			Usage *struct {
+				PromptTokens     int      `json:"prompt_tokens"`
+				CompletionTokens int      `json:"completion_tokens"`
+				Cost             *float64 `json:"cost"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		if chunk.Usage != nil {
+			if err := emit(StreamEvent{
+				TargetID: targetID,
+				Provider: req.Target.Provider,
+				Model:    req.Target.Model,
+				Event:    "usage",
+				Usage: &Usage{
+					PromptTokens:     chunk.Usage.PromptTokens,
+					CompletionTokens: chunk.Usage.CompletionTokens,
+					Cost:             chunk.Usage.Cost,
+				},
+			}); err != nil {
+				return err
+			}
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		if err := emit(StreamEvent{
+			TargetID: targetID,
+			Provider: req.Target.Provider,
+			Model:    req.Target.Model,
+			Event:    "chunk",
+			Content:  chunk.Choices[0].Delta.Content,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return reader.Err()
+}
@@ -0,0 +1,59 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenAICompatibleStreamUsage(t *testing.T) {
+	tests := []struct {
+		name        string
+		streamUsage bool
+	}{
+		{"off by default", false},
+		{"requested", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body map[string]any
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				raw, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(raw, &body); err != nil {
+					t.Errorf("request body: %v", err)
+				}
+				io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\n")
+				io.WriteString(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":3,\"completion_tokens\":1}}\n\n")
+				io.WriteString(w, "data: [DONE]\n\n")
+			}))
+			defer srv.Close()
+
+			req := StreamRequest{
+				Prompt: "hello",
+				Target: Target{Provider: "vllm", Model: "m"},
+				Config: ProviderConfig{OpenAICompatible: []OpenAICompatibleConfig{
+					{ID: "vllm", BaseURL: srv.URL, StreamUsage: tt.streamUsage},
+				}},
+			}
+			var events []StreamEvent
+			err := NewOpenAICompatibleAdapter().Stream(context.Background(), req, func(ev StreamEvent) error {
+				events = append(events, ev)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, sent := body["stream_options"]
+			if sent != tt.streamUsage {
+				t.Fatalf("stream_options sent = %v, want %v", sent, tt.streamUsage)
+			}
+			if len(events) != 2 || events[0].Content != "hi" || events[1].Usage == nil || events[1].Usage.PromptTokens != 3 {
+				t.Fatalf("events = %+v", events)
+			}
+		})
+	}
+}
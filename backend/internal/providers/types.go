@@ -1,12 +1,17 @@
 package providers
 
-import "context"
+import (
+	"context"
+	"fmt"
+	"strings"
+)
 
 type Target struct {
 	Provider     string   `json:"provider"`
 	Model        string   `json:"model"`
 	SystemPrompt string   `json:"systemPrompt,omitempty"`
 	Temperature  *float64 `json:"temperature,omitempty"`
+	MaxTokens    int      `json:"maxTokens,omitempty"`
 }
 
 type OpenRouterConfig struct {
@@ -20,15 +25,80 @@ type OllamaConfig struct {
 	Models  []string `json:"models,omitempty"`
 }
 
+type AnthropicConfig struct {
+	APIKey    string   `json:"apiKey,omitempty"`
+	BaseURL   string   `json:"baseUrl,omitempty"`
+	MaxTokens int      `json:"maxTokens,omitempty"`
+	Models    []string `json:"models,omitempty"`
+}
+
+type GeminiConfig struct {
+	APIKey  string   `json:"apiKey,omitempty"`
+	BaseURL string   `json:"baseUrl,omitempty"`
+	Models  []string `json:"models,omitempty"`
+}
+
+type OpenAICompatibleConfig struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name,omitempty"`
+	BaseURL      string   `json:"baseUrl"`
+	APIKey       string   `json:"apiKey,omitempty"`
+	APIKeyHeader string   `json:"apiKeyHeader,omitempty"`
+	Models       []string `json:"models,omitempty"`
+	// StreamUsage asks for token usage at the end of the stream. It is off by
+	// default because some gateways reject the stream_options field.
+	StreamUsage bool `json:"streamUsage,omitempty"`
+}
+
+// TitleConfig picks the model that names chats. Enabled turns on naming after
+// the first reply; manual retitling only needs Provider and Model.
+type TitleConfig struct {
+	Enabled  bool   `json:"enabled,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	Model    string `json:"model,omitempty"`
+}
+
+// CompactionConfig decides what happens when a chat's history nears a
+// target's context window: "summarize" folds the oldest turns into a summary
+// message, "window" drops them, and an empty mode sends everything.
+type CompactionConfig struct {
+	Mode string `json:"mode,omitempty"`
+	// ThresholdPercent is the share of the window that triggers compaction
+	// (default 95).
+	ThresholdPercent int `json:"thresholdPercent,omitempty"`
+}
+
 type ProviderConfig struct {
-	OpenRouter OpenRouterConfig `json:"openrouter,omitempty"`
-	Ollama     OllamaConfig     `json:"ollama,omitempty"`
+	OpenRouter       OpenRouterConfig         `json:"openrouter,omitempty"`
+	Ollama           OllamaConfig             `json:"ollama,omitempty"`
+	Anthropic        AnthropicConfig          `json:"anthropic,omitempty"`
+	Gemini           GeminiConfig             `json:"gemini,omitempty"`
+	OpenAICompatible []OpenAICompatibleConfig `json:"openaiCompatible,omitempty"`
+	Titles           TitleConfig              `json:"titles,omitempty"`
+	Compaction       CompactionConfig         `json:"compaction,omitempty"`
+}
+
+func (c ProviderConfig) Endpoint(id string) (OpenAICompatibleConfig, bool) {
+	id = NormalizeEndpointID(id)
+	if id == "" {
+		return OpenAICompatibleConfig{}, false
+	}
+	for _, ep := range c.OpenAICompatible {
+		if NormalizeEndpointID(ep.ID) == id {
+			return ep, true
+		}
+	}
+	return OpenAICompatibleConfig{}, false
+}
+
+func NormalizeEndpointID(id string) string {
+	return strings.ToLower(strings.TrimSpace(id))
 }
 
 type StreamRequest struct {
-	Prompt string
-	Target Target
-	Config ProviderConfig
+	Prompt  string
+	Target  Target
+	Config  ProviderConfig
 	History []HistoryMessage
 }
 
@@ -37,16 +107,70 @@ type HistoryMessage struct {
 	Content string
 }
 
+type Usage struct {
+	PromptTokens     int      `json:"promptTokens"`
+	CompletionTokens int      `json:"completionTokens"`
+	Cost             *float64 `json:"cost,omitempty"`
+}
+
+type Metrics struct {
+	TimeToFirstTokenMs int64   `json:"timeToFirstTokenMs"`
+	DurationMs         int64   `json:"durationMs"`
+	TokensPerSecond    float64 `json:"tokensPerSecond"`
+}
+
 type StreamEvent struct {
-	TargetID string `json:"targetId"`
-	Provider string `json:"provider"`
-	Model    string `json:"model"`
-	Event    string `json:"event"`
-	Content  string `json:"content,omitempty"`
-	Error    string `json:"error,omitempty"`
+	TargetID   string   `json:"targetId"`
+	Provider   string   `json:"provider"`
+	Model      string   `json:"model"`
+	Event      string   `json:"event"`
+	Content    string   `json:"content,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	StatusCode int      `json:"statusCode,omitempty"`
+	Usage      *Usage   `json:"usage,omitempty"`
+	Metrics    *Metrics `json:"metrics,omitempty"`
 }
 
 type Adapter interface {
 	Name() string
 	Stream(ctx context.Context, req StreamRequest, emit func(StreamEvent) error) error
 }
+
+var builtinProviderIDs = []string{"openrouter", "ollama", "anthropic", "gemini", "openai_compatible"}
+
+func (c ProviderConfig) Validate() error {
+	seen := map[string]bool{}
+	for _, ep := range c.OpenAICompatible {
+		id := NormalizeEndpointID(ep.ID)
+		if id == "" {
+			return fmt.Errorf("openai-compatible endpoint id is required")
+		}
+		if strings.Contains(id, ":") {
+			return fmt.Errorf("endpoint id %q must not contain ':'", id)
+		}
+		for _, builtin := range builtinProviderIDs {
+			if id == builtin {
+				return fmt.Errorf("endpoint id %q is reserved", id)
+			}
+		}
+		if seen[id] {
+			return fmt.Errorf("duplicate endpoint id %q", id)
+		}
+		seen[id] = true
+		if strings.TrimSpace(ep.BaseURL) == "" {
+			return fmt.Errorf("endpoint %q needs a baseUrl", id)
+		}
+	}
+	switch c.Compaction.Mode {
+	case "", "summarize", "window":
+	default:
+		return fmt.Errorf("compaction mode must be summarize or window")
+	}
+	if c.Compaction.ThresholdPercent < 0 || c.Compaction.ThresholdPercent > 100 {
+		return fmt.Errorf("compaction thresholdPercent must be between 0 and 100")
+	}
+	if c.Titles.Enabled && (strings.TrimSpace(c.Titles.Provider) == "" || strings.TrimSpace(c.Titles.Model) == "") {
+		return fmt.Errorf("title generation needs a provider and model")
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backend persists the store's data. The store keeps everything in memory and
+// reports which records changed, so a backend can write only those.
+type Backend interface {
+	// Load returns the stored data; found is false when nothing was stored yet.
+	Load() (data Data, found bool, err error)
+	Save(data *Data, changes Changes) error
+	Close() error
+}
+
+// Changes lists the records touched since the last save. Folder, chat and
+// template IDs that are no longer present in the data have been removed.
+// Messages lists messages that were changed in place or appended to a chat
+// that is otherwise unchanged apart from its own fields.
+type Changes struct {
+	All       bool
+	Config    bool
+	Folders   []string
+	Chats     []string
+	Messages  []MessageRef
+	Templates []string
+}
+
+type MessageRef struct {
+	ChatID    string
+	MessageID string
+}
+
+func (c Changes) empty() bool {
+	return !c.All && !c.Config && len(c.Folders) == 0 && len(c.Chats) == 0 && len(c.Messages) == 0 && len(c.Templates) == 0
+}
+
+const (
+	jsonBackupCount    = 10
+	jsonBackupInterval = 10 * time.Minute
+)
+
+// JSONBackend stores everything in a single JSON file, rewritten on every save.
+// Writes go through a temp file and a rename, and a timestamped copy is kept in
+// backups/ at most every jsonBackupInterval.
+type JSONBackend struct {
+	path       string
+	lastBackup time.Time
+	readOnly   bool
+}
+
+func NewJSONBackend(path string) *JSONBackend {
+	return &JSONBackend{path: path}
+}
+
+// NewReadOnlyJSONBackend reads the file at path but never writes: an
+// unreadable file is an error instead of being replaced by a backup.
+func NewReadOnlyJSONBackend(path string) *JSONBackend {
+	return &JSONBackend{path: path, readOnly: true}
+}
+
+var errReadOnly = errors.New("state is opened read-only")
+
+func (b *JSONBackend) Load() (Data, bool, error) {
+	if !b.readOnly {
+		if err := os.MkdirAll(filepath.Dir(b.path), 0o755); err != nil {
+			return Data{}, false, err
+		}
+	}
+	raw, err := os.ReadFile(b.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Data{}, false, nil
+	}
+	data, err := decodeStateFile(raw, err)
+	if err == nil {
+		return data, true, nil
+	}
+
+	backups := b.backupFiles()
+	if errors.Is(err, errEmptyStateFile) && len(backups) == 0 {
+		return Data{}, true, nil
+	}
+	if b.readOnly {
+		return Data{}, false, fmt.Errorf("invalid state file: %w", err)
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup, backupErr := os.ReadFile(backups[i])
+		data, backupErr := decodeStateFile(backup, backupErr)
+		if backupErr != nil {
+			log.Printf("warning: skipping unreadable backup %s: %v", backups[i], backupErr)
+			continue
+		}
+		// Keep the broken file around for inspection and put the backup in its place.
+		corrupt := fmt.Sprintf("%s.corrupt-%s", b.path, time.Now().UTC().Format("20060102T150405Z"))
+		if renameErr := os.Rename(b.path, corrupt); renameErr != nil {
+			log.Printf("warning: could not move aside %s: %v", b.path, renameErr)
+		}
+		if writeErr := WriteFileAtomic(b.path, backup); writeErr != nil {
+			return Data{}, false, writeErr
+		}
+		log.Printf("warning: %s is unreadable (%v); restored from backup %s", b.path, err, backups[i])
+		return data, true, nil
+	}
+	return Data{}, false, fmt.Errorf("invalid state file: %w", err)
+}
+
+var errEmptyStateFile = errors.New("state file is empty")
+
+func decodeStateFile(raw []byte, err error) (Data, error) {
+	if err != nil {
+		return Data{}, err
+	}
+	if len(raw) == 0 {
+		return Data{}, errEmptyStateFile
+	}
+	var data Data
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return Data{}, err
+	}
+	return data, nil
+}
+
+func (b *JSONBackend) Save(data *Data, changes Changes) error {
+	if changes.empty() {
+		return nil
+	}
+	if b.readOnly {
+		return errReadOnly
+	}
+	payload, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := WriteFileAtomic(b.path, payload); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if now.Sub(b.lastBackup) < jsonBackupInterval {
+		return nil
+	}
+	b.lastBackup = now
+	// A failed backup must not fail the save that already succeeded.
+	if err := b.writeBackup(payload, now); err != nil {
+		log.Printf("warning: state backup failed: %v", err)
+	}
+	return nil
+}
+
+func (b *JSONBackend) Close() error { return nil }
+
+func (b *JSONBackend) backupDir() string {
+	return filepath.Join(filepath.Dir(b.path), "backups")
+}
+
+// backupFiles returns the backups of this file, oldest first.
+func (b *JSONBackend) backupFiles() []string {
+	base := filepath.Base(b.path)
+	ext := filepath.Ext(base)
+	matches, _ := filepath.Glob(filepath.Join(b.backupDir(), strings.TrimSuffix(base, ext)+"-*"+ext))
+	// Timestamps sort lexically.
+	sort.Strings(matches)
+	return matches
+}
+
+func (b *JSONBackend) writeBackup(payload []byte, now time.Time) error {
+	if err := os.MkdirAll(b.backupDir(), 0o755); err != nil {
+		return err
+	}
+	base := filepath.Base(b.path)
+	ext := filepath.Ext(base)
+	name := strings.TrimSuffix(base, ext) + "-" + now.Format("20060102T150405Z") + ext
+	if err := WriteFileAtomic(filepath.Join(b.backupDir(), name), payload); err != nil {
+		return err
+	}
+	backups := b.backupFiles()
+	for len(backups) > jsonBackupCount {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// WriteFileAtomic replaces path with payload so that readers see either the old
+// or the new content, never a partial write.
+func WriteFileAtomic(path string, payload []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	// Persist the rename itself.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// ImportJSON copies the JSON state file at jsonPath into dst when dst is still
+// empty. It reports whether anything was imported.
+func ImportJSON(jsonPath string, dst Backend) (bool, error) {
+	_, found, err := dst.Load()
+	if err != nil || found {
+		return false, err
+	}
+	if _, err := os.Stat(jsonPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	data, found, err := NewJSONBackend(jsonPath).Load()
+	if err != nil || !found {
+		return false, err
+	}
+	if err := dst.Save(&data, Changes{All: true}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
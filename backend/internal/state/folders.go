@@ -0,0 +1,127 @@
+package state
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrFolderNotFound = errors.New("folder not found")
+
+// FolderSettings are the generation defaults a folder hands down to its chats.
+type FolderSettings struct {
+	SystemPrompt string   `json:"systemPrompt"`
+	Temperature  *float64 `json:"temperature,omitempty"`
+}
+
+// EffectiveFolderSettings resolves the settings that apply inside a folder:
+// each value comes from the nearest folder up the tree that sets it, so an
+// empty system prompt or unset temperature inherits from the parent.
+func (s *Store) EffectiveFolderSettings(id string) (FolderSettings, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.folderExistsLocked(id) {
+		return FolderSettings{}, ErrFolderNotFound
+	}
+	var settings FolderSettings
+	for _, idx := range s.folderAncestryLocked(id) {
+		f := s.data.Folders[idx]
+		if settings.SystemPrompt == "" {
+			settings.SystemPrompt = strings.TrimSpace(f.SystemPrompt)
+		}
+		if settings.Temperature == nil && f.Temperature != nil {
+			t := *f.Temperature
+			settings.Temperature = &t
+		}
+	}
+	return settings, nil
+}
+
+// ChatSettings resolves the settings for a chat: its own system prompt and
+// temperature when set, the folder's effective settings otherwise. The system
+// prompt has the chat's variables filled in.
+func (s *Store) ChatSettings(chat Chat) FolderSettings {
+	settings, _ := s.EffectiveFolderSettings(chat.FolderID)
+	if prompt := strings.TrimSpace(chat.SystemPrompt); prompt != "" {
+		settings.SystemPrompt = prompt
+	}
+	settings.SystemPrompt, _ = ExpandVariables(settings.SystemPrompt, chat.Variables)
+	if chat.Temperature != nil {
+		t := *chat.Temperature
+		settings.Temperature = &t
+	}
+	return settings
+}
+
+// MoveFolder reparents a folder; an empty parentID moves it to the top level.
+func (s *Store) MoveFolder(id, parentID string) (Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parentID = strings.TrimSpace(parentID)
+	for i := range s.data.Folders {
+		if s.data.Folders[i].ID != id || s.data.Folders[i].DeletedAt != nil {
+			continue
+		}
+		if parentID != "" {
+			if !s.folderExistsLocked(parentID) {
+				return Folder{}, errors.New("parent folder not found")
+			}
+			for _, idx := range s.folderAncestryLocked(parentID) {
+				if s.data.Folders[idx].ID == id {
+					return Folder{}, errors.New("cannot move a folder into itself or one of its subfolders")
+				}
+			}
+		}
+		s.data.Folders[i].ParentID = parentID
+		s.data.Folders[i].UpdatedAt = time.Now().UTC()
+		s.markFolder(id)
+		if err := s.persistLocked(); err != nil {
+			return Folder{}, err
+		}
+		return s.data.Folders[i], nil
+	}
+	return Folder{}, ErrFolderNotFound
+}
+
+// folderAncestryLocked returns the indexes of id and its ancestors, nearest
+// first. The walk stops at a missing parent or a cycle.
+func (s *Store) folderAncestryLocked(id string) []int {
+	var out []int
+	seen := map[string]bool{}
+	for id != "" && !seen[id] {
+		seen[id] = true
+		idx := s.folderIndexLocked(id)
+		if idx < 0 {
+			break
+		}
+		out = append(out, idx)
+		id = s.data.Folders[idx].ParentID
+	}
+	return out
+}
+
+// folderSubtreeLocked returns the IDs of id and all folders below it.
+func (s *Store) folderSubtreeLocked(id string) map[string]bool {
+	subtree := map[string]bool{id: true}
+	for grew := true; grew; {
+		grew = false
+		for _, f := range s.data.Folders {
+			if !subtree[f.ID] && subtree[f.ParentID] {
+				subtree[f.ID] = true
+				grew = true
+			}
+		}
+	}
+	return subtree
+}
+
+func (s *Store) folderIndexLocked(id string) int {
+	for i := range s.data.Folders {
+		if s.data.Folders[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+)
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+var idGen struct {
+	sync.Mutex
+	lastMs int64
+	last   [16]byte
+}
+
+// NewID returns prefix + "_" + a ULID: 48 bits of millisecond time followed by
+// 80 random bits, in Crockford base32. IDs from one process sort in creation
+// order; within a millisecond the random part is incremented instead of redrawn.
+func NewID(prefix string) string {
+	idGen.Lock()
+	defer idGen.Unlock()
+
+	ms := time.Now().UnixMilli()
+	if ms <= idGen.lastMs && incrementRandom(&idGen.last) {
+		ms = idGen.lastMs
+	} else {
+		if ms <= idGen.lastMs {
+			// The random part overflowed or the clock went backwards.
+			ms = idGen.lastMs + 1
+		}
+		if _, err := rand.Read(idGen.last[6:]); err != nil {
+			panic("state: reading random bytes: " + err.Error())
+		}
+	}
+	idGen.lastMs = ms
+	for i := 5; i >= 0; i-- {
+		idGen.last[i] = byte(ms)
+		ms >>= 8
+	}
+	return prefix + "_" + encodeULID(idGen.last)
+}
+
+// incrementRandom adds one to the random part and reports false on overflow.
+func incrementRandom(id *[16]byte) bool {
+	for i := 15; i >= 6; i-- {
+		id[i]++
+		if id[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeULID(id [16]byte) string {
+	// 26 characters of 5 bits cover 130 bits; the first two are always zero.
+	out := make([]byte, 26)
+	for i := range out {
+		var v byte
+		for k := i * 5; k < i*5+5; k++ {
+			v <<= 1
+			if bit := k - 2; bit >= 0 {
+				v |= id[bit/8] >> (7 - bit%8) & 1
+			}
+		}
+		out[i] = crockford[v]
+	}
+	return string(out)
+}
+
+// repairDuplicateMessageIDs gives a fresh ID to every message that repeats an
+// ID seen earlier in the same chat and returns the IDs of the chats it changed.
+// Older builds derived IDs from the clock, so rapid appends could collide.
+func repairDuplicateMessageIDs(d *Data) []string {
+	changed := []string{}
+	for i := range d.Chats {
+		seen := make(map[string]bool, len(d.Chats[i].Messages))
+		repaired := false
+		for j := range d.Chats[i].Messages {
+			msg := &d.Chats[i].Messages[j]
+			if seen[msg.ID] || msg.ID == "" {
+				msg.ID = NewID("msg")
+				repaired = true
+			}
+			seen[msg.ID] = true
+		}
+		if repaired {
+			changed = append(changed, d.Chats[i].ID)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,187 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+
+	"llm-mux/backend/internal/providers"
+)
+
+// migration upgrades data from version-1 to version and returns how many
+// records it changed.
+type migration struct {
+	version int
+	name    string
+	apply   func(d *Data) int
+}
+
+// migrations run in order on load. Append new steps at the end; never edit
+// or reorder steps that have shipped.
+var migrations = []migration{
+	{1, "provider defaults", migrateProviderDefaults},
+	{2, "message inclusion defaults", migrateInclusionDefaults},
+	{3, "message version history", migrateMessageHistory},
+	{4, "message tree", migrateMessageTree},
+}
+
+// CurrentSchemaVersion is the schema version written by this build.
+var CurrentSchemaVersion = migrations[len(migrations)-1].version
+
+type MigrationStep struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Changes int    `json:"changes"`
+}
+
+type MigrationReport struct {
+	From  int             `json:"from"`
+	To    int             `json:"to"`
+	Steps []MigrationStep `json:"steps"`
+}
+
+func (r MigrationReport) String() string {
+	if len(r.Steps) == 0 {
+		return fmt.Sprintf("schema version %d is up to date", r.From)
+	}
+	lines := []string{fmt.Sprintf("schema version %d -> %d", r.From, r.To)}
+	for _, step := range r.Steps {
+		lines = append(lines, fmt.Sprintf("  %d %s: %d change(s)", step.Version, step.Name, step.Changes))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// migrate applies every pending migration to d in place.
+func migrate(d *Data) (MigrationReport, error) {
+	report := MigrationReport{From: d.SchemaVersion, To: d.SchemaVersion, Steps: []MigrationStep{}}
+	if d.SchemaVersion > CurrentSchemaVersion {
+		return report, fmt.Errorf("state schema version %d is newer than this build supports (%d)", d.SchemaVersion, CurrentSchemaVersion)
+	}
+	for _, m := range migrations {
+		if m.version <= d.SchemaVersion {
+			continue
+		}
+		changes := m.apply(d)
+		d.SchemaVersion = m.version
+		report.To = m.version
+		report.Steps = append(report.Steps, MigrationStep{Version: m.version, Name: m.name, Changes: changes})
+	}
+	return report, nil
+}
+
+// DryRunMigrations reports what loading the backend's data would migrate. It
+// does not save; open the backend read-only so loading does not write either.
+func DryRunMigrations(backend Backend) (MigrationReport, error) {
+	data, found, err := backend.Load()
+	if err != nil {
+		return MigrationReport{}, err
+	}
+	if !found {
+		return MigrationReport{From: CurrentSchemaVersion, To: CurrentSchemaVersion, Steps: []MigrationStep{}}, nil
+	}
+	return migrate(&data)
+}
+
+func migrateProviderDefaults(d *Data) int {
+	changes := 0
+	setString := func(v *string, def string) {
+		if strings.TrimSpace(*v) == "" {
+			*v = def
+			changes++
+		}
+	}
+	setModels := func(v *[]string, def ...string) {
+		if len(*v) == 0 {
+			*v = def
+			changes++
+		}
+	}
+	defaults := defaultProviderConfig()
+	cfg := &d.Config
+	setString(&cfg.OpenRouter.BaseURL, defaults.OpenRouter.BaseURL)
+	setModels(&cfg.OpenRouter.Models, defaults.OpenRouter.Models...)
+	setString(&cfg.Ollama.BaseURL, defaults.Ollama.BaseURL)
+	setModels(&cfg.Ollama.Models, defaults.Ollama.Models...)
+	setString(&cfg.Anthropic.BaseURL, defaults.Anthropic.BaseURL)
+	setModels(&cfg.Anthropic.Models, defaults.Anthropic.Models...)
+	setString(&cfg.Gemini.BaseURL, defaults.Gemini.BaseURL)
+	setModels(&cfg.Gemini.Models, defaults.Gemini.Models...)
+	return changes
+}
+
+func migrateInclusionDefaults(d *Data) int {
+	changes := 0
+	for i := range d.Chats {
+		for j := range d.Chats[i].Messages {
+			if applyInclusionDefaults(&d.Chats[i].Messages[j]) {
+				changes++
+			}
+		}
+	}
+	return changes
+}
+
+func applyInclusionDefaults(msg *Message) bool {
+	changed := false
+	if strings.TrimSpace(msg.Inclusion) == "" {
+		if msg.Role == "assistant" && !msg.IsSummary {
+			msg.Inclusion = "model_only"
+		} else {
+			msg.Inclusion = "always"
+		}
+		changed = true
+	}
+	if msg.Inclusion == "model_only" && strings.TrimSpace(msg.ScopeID) == "" && msg.TargetID != "" {
+		msg.ScopeID = msg.TargetID
+		changed = true
+	}
+	return changed
+}
+
+func migrateMessageHistory(d *Data) int {
+	changes := 0
+	for i := range d.Chats {
+		for j := range d.Chats[i].Messages {
+			msg := &d.Chats[i].Messages[j]
+			if len(msg.History) == 0 || msg.HistoryIndex < 0 || msg.HistoryIndex >= len(msg.History) {
+				changes++
+			}
+			ensureMessageHistory(msg)
+		}
+	}
+	return changes
+}
+
+// migrateMessageTree links the flat message lists of older chats into a single
+// branch.
+func migrateMessageTree(d *Data) int {
+	changes := 0
+	for i := range d.Chats {
+		if len(d.Chats[i].Messages) == 0 {
+			continue
+		}
+		d.Chats[i].ActiveLeafID = linkLinear(d.Chats[i].Messages)
+		changes++
+	}
+	return changes
+}
+
+func defaultProviderConfig() providers.ProviderConfig {
+	return providers.ProviderConfig{
+		OpenRouter: providers.OpenRouterConfig{
+			BaseURL: "https://openrouter.ai/api/v1",
+			Models:  []string{"openai/gpt-4o-mini", "anthropic/claude-3.5-sonnet"},
+		},
+		Ollama: providers.OllamaConfig{
+			BaseURL: "http://localhost:11434",
+			Models:  []string{"llama3.2:latest", "qwen2.5"},
+		},
+		Anthropic: providers.AnthropicConfig{
+			BaseURL: "https://api.anthropic.com/v1",
+			Models:  []string{"claude-sonnet-4-5", "claude-haiku-4-5"},
+		},
+		Gemini: providers.GeminiConfig{
+			BaseURL: "https://generativelanguage.googleapis.com/v1beta",
+			Models:  []string{"gemini-2.5-flash", "gemini-2.5-pro"},
+		},
+	}
+}
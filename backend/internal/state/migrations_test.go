@@ -0,0 +1,227 @@
+package state
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func oldChat() Chat {
+	return Chat{ID: "cht_1", Messages: []Message{
+		{ID: "u1", Role: "user", Content: "q1"},
+		{ID: "a1", Role: "assistant", Content: "r1", Provider: "p", Model: "m", TargetID: "p:m"},
+		{ID: "s1", Role: "assistant", Content: "sum", IsSummary: true},
+		{ID: "u2", Role: "user", Content: "q2"},
+	}}
+}
+
+func TestMigrations(t *testing.T) {
+	tests := []struct {
+		version int
+		data    func() Data
+		changes int
+		check   func(t *testing.T, d *Data)
+	}{
+		{1, func() Data { return Data{} }, 8, func(t *testing.T, d *Data) {
+			if d.Config.OpenRouter.BaseURL == "" || len(d.Config.Gemini.Models) == 0 {
+				t.Fatalf("defaults not applied: %+v", d.Config)
+			}
+		}},
+		{1, func() Data { return Data{Config: defaultProviderConfig()} }, 0, nil},
+		{2, func() Data { return Data{Chats: []Chat{oldChat()}} }, 4, func(t *testing.T, d *Data) {
+			got := []string{}
+			for _, m := range d.Chats[0].Messages {
+				got = append(got, m.Inclusion+"/"+m.ScopeID)
+			}
+			want := []string{"always/", "model_only/p:m", "always/", "always/"}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("inclusion/scope = %v, want %v", got, want)
+			}
+		}},
+		{3, func() Data {
+			c := oldChat()
+			c.Messages[1].History = []MessageVersion{{Content: "old"}, {Content: "r1"}}
+			c.Messages[1].HistoryIndex = 7
+			c.Messages[2].History = []MessageVersion{{Content: "sum"}}
+			return Data{Chats: []Chat{c}}
+		}, 3, func(t *testing.T, d *Data) {
+			msgs := d.Chats[0].Messages
+			if len(msgs[0].History) != 1 || msgs[0].History[0].Content != "q1" {
+				t.Fatalf("history not built from content: %+v", msgs[0].History)
+			}
+			if msgs[1].HistoryIndex != 1 || msgs[1].Content != "r1" {
+				t.Fatalf("out-of-range index not clamped: %d %q", msgs[1].HistoryIndex, msgs[1].Content)
+			}
+		}},
+		{4, func() Data { return Data{Chats: []Chat{oldChat(), {ID: "cht_empty"}}} }, 1, func(t *testing.T, d *Data) {
+			got := []string{}
+			for _, m := range d.Chats[0].Messages {
+				got = append(got, m.ParentID)
+			}
+			if want := []string{"", "u1", "u1", "u1"}; !reflect.DeepEqual(got, want) {
+				t.Fatalf("parents = %v, want %v", got, want)
+			}
+			if d.Chats[0].ActiveLeafID != "u2" {
+				t.Fatalf("active leaf = %q, want u2", d.Chats[0].ActiveLeafID)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		m := migrations[tt.version-1]
+		t.Run(m.name, func(t *testing.T) {
+			d := tt.data()
+			if got := m.apply(&d); got != tt.changes {
+				t.Fatalf("changes = %d, want %d", got, tt.changes)
+			}
+			if tt.check != nil {
+				tt.check(t, &d)
+			}
+		})
+	}
+}
+
+func TestMigrateVersions(t *testing.T) {
+	d := Data{Chats: []Chat{oldChat()}}
+	report, err := migrate(&d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.From != 0 || report.To != CurrentSchemaVersion || len(report.Steps) != len(migrations) {
+		t.Fatalf("report = %+v", report)
+	}
+	if report, err := migrate(&d); err != nil || len(report.Steps) != 0 {
+		t.Fatalf("second run: %+v, %v", report, err)
+	}
+	d.SchemaVersion = CurrentSchemaVersion + 1
+	if _, err := migrate(&d); err == nil {
+		t.Fatal("newer schema version accepted")
+	}
+}
+
+// snapshotDir returns the names and contents of the files below dir.
+func snapshotDir(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		raw, err := os.ReadFile(path)
+		files[path] = raw
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func assertUnchanged(t *testing.T, before, after map[string][]byte) {
+	t.Helper()
+	var names []string
+	for name := range after {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(before) != len(after) {
+		t.Fatalf("files changed: %v", names)
+	}
+	for name, raw := range before {
+		if !bytes.Equal(after[name], raw) {
+			t.Fatalf("%s was written", name)
+		}
+	}
+}
+
+func TestDryRunJSONReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	if report, err := DryRunMigrations(NewReadOnlyJSONBackend(filepath.Join(dir, "missing", "state.json"))); err != nil || len(report.Steps) != 0 {
+		t.Fatalf("missing file: %+v, %v", report, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Fatal("dry run created the data directory")
+	}
+
+	if err := os.WriteFile(path, []byte(`{"schemaVersion":0,"chats":[]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	report, err := DryRunMigrations(NewReadOnlyJSONBackend(path))
+	if err != nil || report.To != CurrentSchemaVersion || len(report.Steps) == 0 {
+		t.Fatalf("old file: %+v, %v", report, err)
+	}
+
+	// A corrupt file with a usable backup is reported, not restored.
+	backups := filepath.Join(dir, "backups")
+	if err := os.MkdirAll(backups, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(backups, "state-20260101T000000Z.json"), []byte(`{"schemaVersion":0}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"schemaVer`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before := snapshotDir(t, dir)
+	if _, err := DryRunMigrations(NewReadOnlyJSONBackend(path)); err == nil {
+		t.Fatal("corrupt file: no error")
+	}
+	assertUnchanged(t, before, snapshotDir(t, dir))
+}
+
+func TestDryRunSQLiteReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.db")
+	if _, err := OpenSQLiteReadOnly(path); !os.IsNotExist(err) {
+		t.Fatalf("missing database: err = %v", err)
+	}
+
+	backend, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := Data{Folders: []Folder{{ID: "fld_1", Name: "General"}}, Chats: []Chat{oldChat()}}
+	old.Chats[0].FolderID = "fld_1"
+	if err := backend.Save(&old, Changes{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	backend.Close()
+	// Make it look like a database from before the tree columns.
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`ALTER TABLE chats DROP COLUMN active_leaf_id`,
+		`ALTER TABLE messages DROP COLUMN parent_id`,
+		`ALTER TABLE messages DROP COLUMN compaction`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	db.Close()
+
+	before := snapshotDir(t, dir)
+	ro, err := OpenSQLiteReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := DryRunMigrations(ro)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.From != 0 || report.To != CurrentSchemaVersion || len(report.Steps) != len(migrations) {
+		t.Fatalf("report = %+v", report)
+	}
+	if err := ro.Save(&old, Changes{All: true}); err == nil {
+		t.Fatal("read-only backend saved")
+	}
+	ro.Close()
+	assertUnchanged(t, before, snapshotDir(t, dir))
+}
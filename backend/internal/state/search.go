@@ -0,0 +1,432 @@
+package state
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	searchDefaultLimit = 20
+	searchMaxLimit     = 100
+	titleBoost         = 3
+	snippetRunes       = 160
+)
+
+type SearchQuery struct {
+	Text     string
+	FolderID string
+	Model    string
+	From     time.Time
+	To       time.Time
+	Limit    int
+}
+
+// SearchResult points at a chat, or at a message inside it. Snippet is HTML
+// escaped with matches wrapped in <mark>.
+type SearchResult struct {
+	ChatID    string    `json:"chatId"`
+	ChatTitle string    `json:"chatTitle"`
+	FolderID  string    `json:"folderId"`
+	MessageID string    `json:"messageId,omitempty"`
+	Field     string    `json:"field"`
+	Snippet   string    `json:"snippet"`
+	Score     float64   `json:"score"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// searchIndex is an inverted index over chat titles and messages (current
+// content, older versions and attachments). Chats changed by the store are
+// only marked dirty and re-indexed on the next search.
+type searchIndex struct {
+	mu       sync.Mutex
+	postings map[string]map[searchKey]int
+	docLen   map[searchKey]int
+	docTerms map[searchKey][]string
+	chatDocs map[string][]searchKey
+	dirty    map[string]bool
+	rebuild  bool
+}
+
+// searchKey identifies one document; an empty messageID is the chat title.
+type searchKey struct {
+	chatID    string
+	messageID string
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: map[string]map[searchKey]int{},
+		docLen:   map[searchKey]int{},
+		docTerms: map[searchKey][]string{},
+		chatDocs: map[string][]searchKey{},
+		dirty:    map[string]bool{},
+		rebuild:  true,
+	}
+}
+
+func (ix *searchIndex) invalidate(changes Changes) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if changes.All {
+		ix.rebuild = true
+		return
+	}
+	for _, id := range changes.Chats {
+		ix.dirty[id] = true
+	}
+	for _, ref := range changes.Messages {
+		ix.dirty[ref.ChatID] = true
+	}
+}
+
+// refreshLocked brings the index in line with data. ix.mu must be held and
+// data must not change meanwhile.
+func (ix *searchIndex) refreshLocked(data *Data) {
+	if ix.rebuild {
+		ix.postings = map[string]map[searchKey]int{}
+		ix.docLen = map[searchKey]int{}
+		ix.docTerms = map[searchKey][]string{}
+		ix.chatDocs = map[string][]searchKey{}
+		for i := range data.Chats {
+			ix.addChatLocked(&data.Chats[i])
+		}
+		ix.rebuild = false
+		ix.dirty = map[string]bool{}
+		return
+	}
+	if len(ix.dirty) == 0 {
+		return
+	}
+	for id := range ix.dirty {
+		ix.removeChatLocked(id)
+	}
+	for i := range data.Chats {
+		if ix.dirty[data.Chats[i].ID] {
+			ix.addChatLocked(&data.Chats[i])
+		}
+	}
+	ix.dirty = map[string]bool{}
+}
+
+func (ix *searchIndex) removeChatLocked(chatID string) {
+	for _, key := range ix.chatDocs[chatID] {
+		for _, term := range ix.docTerms[key] {
+			docs := ix.postings[term]
+			delete(docs, key)
+			if len(docs) == 0 {
+				delete(ix.postings, term)
+			}
+		}
+		delete(ix.docLen, key)
+		delete(ix.docTerms, key)
+	}
+	delete(ix.chatDocs, chatID)
+}
+
+func (ix *searchIndex) addChatLocked(c *Chat) {
+	if c.DeletedAt != nil {
+		return
+	}
+	ix.addDocLocked(searchKey{chatID: c.ID}, []string{c.Title})
+	for i := range c.Messages {
+		m := &c.Messages[i]
+		if m.DeletedAt != nil {
+			continue
+		}
+		ix.addDocLocked(searchKey{chatID: c.ID, messageID: m.ID}, messageTexts(m))
+	}
+}
+
+func (ix *searchIndex) addDocLocked(key searchKey, texts []string) {
+	n := 0
+	for _, text := range texts {
+		for _, term := range searchTerms(text) {
+			docs := ix.postings[term]
+			if docs == nil {
+				docs = map[searchKey]int{}
+				ix.postings[term] = docs
+			}
+			if docs[key] == 0 {
+				ix.docTerms[key] = append(ix.docTerms[key], term)
+			}
+			docs[key]++
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+	ix.docLen[key] = n
+	ix.chatDocs[key.chatID] = append(ix.chatDocs[key.chatID], key)
+}
+
+// messageTexts returns the searchable text of a message: the current content,
+// the content of every other version and all attachment contents.
+func messageTexts(m *Message) []string {
+	texts := []string{m.Content}
+	for _, a := range m.Attachments {
+		texts = append(texts, a.Name, a.Content)
+	}
+	for i, v := range m.History {
+		if i == m.HistoryIndex {
+			continue
+		}
+		texts = append(texts, v.Content)
+		for _, a := range v.Attachments {
+			texts = append(texts, a.Name, a.Content)
+		}
+	}
+	return texts
+}
+
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Search finds chats and messages containing every query term. The last term
+// also matches as a prefix so results show up while typing.
+func (s *Store) Search(q SearchQuery) []SearchResult {
+	terms := searchTerms(q.Text)
+	if len(terms) == 0 {
+		return []SearchResult{}
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = searchDefaultLimit
+	}
+	if limit > searchMaxLimit {
+		limit = searchMaxLimit
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ix := s.index
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	ix.refreshLocked(&s.data)
+
+	// For every query term, collect the matching index terms.
+	matched := make([][]string, len(terms))
+	for i, term := range terms {
+		if _, ok := ix.postings[term]; ok {
+			matched[i] = append(matched[i], term)
+		}
+		if i == len(terms)-1 {
+			for indexed := range ix.postings {
+				if indexed != term && strings.HasPrefix(indexed, term) {
+					matched[i] = append(matched[i], indexed)
+				}
+			}
+		}
+		if len(matched[i]) == 0 {
+			return []SearchResult{}
+		}
+	}
+
+	total := float64(len(ix.docLen))
+	scores := map[searchKey]float64{}
+	for i, group := range matched {
+		groupScores := map[searchKey]float64{}
+		for _, term := range group {
+			docs := ix.postings[term]
+			idf := math.Log(1 + total/float64(len(docs)))
+			for key, tf := range docs {
+				groupScores[key] += float64(tf) / float64(ix.docLen[key]) * idf
+			}
+		}
+		if i == 0 {
+			scores = groupScores
+			continue
+		}
+		for key := range scores {
+			if extra, ok := groupScores[key]; ok {
+				scores[key] += extra
+			} else {
+				delete(scores, key)
+			}
+		}
+	}
+
+	var highlight []string
+	for _, group := range matched {
+		highlight = append(highlight, group...)
+	}
+
+	results := make([]SearchResult, 0, len(scores))
+	for key, score := range scores {
+		ci := s.chatIndexLocked(key.chatID)
+		if ci < 0 {
+			continue
+		}
+		chat := &s.data.Chats[ci]
+		if q.FolderID != "" && chat.FolderID != q.FolderID {
+			continue
+		}
+		result := SearchResult{ChatID: chat.ID, ChatTitle: chat.Title, FolderID: chat.FolderID, Score: score}
+		if key.messageID == "" {
+			if q.Model != "" && !chatUsesModel(chat, q.Model) {
+				continue
+			}
+			result.Field = "title"
+			result.Score *= titleBoost
+			result.CreatedAt = chat.UpdatedAt
+			result.Snippet = snippet(chat.Title, highlight)
+		} else {
+			idx := indexOfMessage(chat.Messages, key.messageID)
+			if idx < 0 {
+				continue
+			}
+			msg := &chat.Messages[idx]
+			if q.Model != "" && !messageUsesModel(msg, q.Model) {
+				continue
+			}
+			result.MessageID = msg.ID
+			result.CreatedAt = msg.CreatedAt
+			result.Field, result.Snippet = messageSnippet(msg, highlight)
+		}
+		if !q.From.IsZero() && result.CreatedAt.Before(q.From) {
+			continue
+		}
+		if !q.To.IsZero() && result.CreatedAt.After(q.To) {
+			continue
+		}
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].CreatedAt.After(results[j].CreatedAt)
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+func chatUsesModel(c *Chat, model string) bool {
+	for i := range c.Messages {
+		if c.Messages[i].DeletedAt == nil && messageUsesModel(&c.Messages[i], model) {
+			return true
+		}
+	}
+	return false
+}
+
+func messageUsesModel(m *Message, model string) bool {
+	if strings.EqualFold(m.Model, model) {
+		return true
+	}
+	for _, v := range m.History {
+		if strings.EqualFold(v.Model, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// messageSnippet picks the field of the message that matches best.
+func messageSnippet(m *Message, terms []string) (string, string) {
+	type field struct {
+		name string
+		text string
+	}
+	fields := []field{{"content", m.Content}}
+	for _, a := range m.Attachments {
+		fields = append(fields, field{"attachment", a.Name + ": " + a.Content})
+	}
+	for i, v := range m.History {
+		if i == m.HistoryIndex {
+			continue
+		}
+		fields = append(fields, field{"history", v.Content})
+		for _, a := range v.Attachments {
+			fields = append(fields, field{"attachment", a.Name + ": " + a.Content})
+		}
+	}
+	best, bestHits := fields[0], -1
+	for _, f := range fields {
+		if hits := countMatches(f.text, terms); hits > bestHits {
+			best, bestHits = f, hits
+		}
+	}
+	return best.name, snippet(best.text, terms)
+}
+
+func countMatches(text string, terms []string) int {
+	n := 0
+	for _, word := range searchTerms(text) {
+		if matchesAny(word, terms) {
+			n++
+		}
+	}
+	return n
+}
+
+func matchesAny(word string, terms []string) bool {
+	for _, t := range terms {
+		if word == t {
+			return true
+		}
+	}
+	return false
+}
+
+// snippet cuts a window around the first match and marks every matched word.
+func snippet(text string, terms []string) string {
+	runes := []rune(text)
+	type span struct{ start, end int }
+	var spans []span
+	for i := 0; i < len(runes); {
+		if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && (unicode.IsLetter(runes[j]) || unicode.IsDigit(runes[j])) {
+			j++
+		}
+		if matchesAny(strings.ToLower(string(runes[i:j])), terms) {
+			spans = append(spans, span{i, j})
+		}
+		i = j
+	}
+
+	start := 0
+	if len(spans) > 0 && spans[0].start > snippetRunes/4 {
+		start = spans[0].start - snippetRunes/4
+	}
+	end := start + snippetRunes
+	if end > len(runes) {
+		end = len(runes)
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	pos := start
+	for _, sp := range spans {
+		if sp.start < start || sp.end > end {
+			continue
+		}
+		b.WriteString(html.EscapeString(string(runes[pos:sp.start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[sp.start:sp.end])))
+		b.WriteString("</mark>")
+		pos = sp.end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:end])))
+	if end < len(runes) {
+		b.WriteString("…")
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
@@ -0,0 +1,777 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"llm-mux/backend/internal/providers"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS config (
+	id   INTEGER PRIMARY KEY CHECK (id = 1),
+	data TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS folders (
+	id            TEXT PRIMARY KEY,
+	name          TEXT NOT NULL,
+	system_prompt TEXT NOT NULL,
+	temperature   REAL,
+	created_at    TEXT NOT NULL,
+	updated_at    TEXT NOT NULL,
+	deleted_at    TEXT
+);
+CREATE TABLE IF NOT EXISTS chats (
+	id                  TEXT PRIMARY KEY,
+	folder_id           TEXT NOT NULL,
+	title               TEXT NOT NULL,
+	created_at          TEXT NOT NULL,
+	updated_at          TEXT NOT NULL,
+	deleted_at          TEXT,
+	trashed_with_folder INTEGER NOT NULL DEFAULT 0,
+	active_leaf_id      TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS chats_folder_id ON chats (folder_id);
+CREATE TABLE IF NOT EXISTS messages (
+	chat_id       TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+	position      INTEGER NOT NULL,
+	id            TEXT NOT NULL,
+	parent_id     TEXT NOT NULL DEFAULT '',
+	role          TEXT NOT NULL,
+	content       TEXT NOT NULL,
+	attachments   TEXT,
+	provider      TEXT NOT NULL,
+	model         TEXT NOT NULL,
+	target_id     TEXT NOT NULL,
+	is_summary    INTEGER NOT NULL,
+	inclusion     TEXT NOT NULL,
+	scope_id      TEXT NOT NULL,
+	usage         TEXT,
+	metrics       TEXT,
+	status        TEXT NOT NULL,
+	error         TEXT NOT NULL,
+	error_status  INTEGER NOT NULL,
+	history_index INTEGER NOT NULL,
+	created_at    TEXT NOT NULL,
+	deleted_at    TEXT,
+	PRIMARY KEY (chat_id, position)
+);
+CREATE INDEX IF NOT EXISTS messages_chat_message ON messages (chat_id, id);
+CREATE TABLE IF NOT EXISTS message_versions (
+	chat_id      TEXT NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+	position     INTEGER NOT NULL,
+	version      INTEGER NOT NULL,
+	content      TEXT NOT NULL,
+	attachments  TEXT,
+	provider     TEXT NOT NULL,
+	model        TEXT NOT NULL,
+	target_id    TEXT NOT NULL,
+	usage        TEXT,
+	metrics      TEXT,
+	status       TEXT NOT NULL,
+	error        TEXT NOT NULL,
+	error_status INTEGER NOT NULL,
+	created_at   TEXT NOT NULL,
+	PRIMARY KEY (chat_id, position, version)
+);
+CREATE TABLE IF NOT EXISTS prompt_templates (
+	id         TEXT PRIMARY KEY,
+	folder_id  TEXT NOT NULL,
+	name       TEXT NOT NULL,
+	body       TEXT NOT NULL,
+	defaults   TEXT,
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL
+);
+`
+
+// SQLiteBackend stores folders, chats, messages, message versions and prompt
+// templates as rows and only rewrites the records a change touched.
+type SQLiteBackend struct {
+	db       *sql.DB
+	readOnly bool
+}
+
+func OpenSQLite(path string) (*SQLiteBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_journal_mode=WAL&_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	// The store serializes writes itself; one connection keeps SQLite happy.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("init sqlite schema: %w", err)
+	}
+	for _, col := range sqliteAddedColumns {
+		if err := ensureColumn(db, col.table, col.column, col.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("upgrade sqlite schema: %w", err)
+		}
+	}
+	return &SQLiteBackend{db: db}, nil
+}
+
+// OpenSQLiteReadOnly opens an existing database without creating or upgrading
+// anything. Columns a normal start would add read as their default.
+func OpenSQLiteReadOnly(path string) (*SQLiteBackend, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	dsn := "file:" + path + "?mode=ro&_busy_timeout=5000"
+	// Reading a WAL database creates -wal and -shm files next to it unless it
+	// is opened immutable, which is safe as long as no WAL holds newer pages.
+	if _, err := os.Stat(path + "-wal"); errors.Is(err, os.ErrNotExist) {
+		dsn += "&immutable=1"
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// The temp views below live on this one connection.
+	db.SetMaxOpenConns(1)
+	if err := shadowMissingColumns(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("read sqlite schema: %w", err)
+	}
+	return &SQLiteBackend{db: db, readOnly: true}, nil
+}
+
+// shadowMissingColumns puts a temp view in front of every table that lacks
+// some of sqliteAddedColumns, adding them with their default value. Temp
+// objects take precedence over main tables of the same name, and a read-only
+// connection can still create them.
+func shadowMissingColumns(db *sql.DB) error {
+	missing := map[string][]string{}
+	var tables []string
+	for _, col := range sqliteAddedColumns {
+		ok, err := hasColumn(db, col.table, col.column)
+		if err != nil {
+			return err
+		}
+		if ok {
+			continue
+		}
+		if _, seen := missing[col.table]; !seen {
+			tables = append(tables, col.table)
+		}
+		value := "NULL"
+		if _, def, found := strings.Cut(col.definition, "DEFAULT "); found {
+			value = def
+		}
+		missing[col.table] = append(missing[col.table], value+" AS "+col.column)
+	}
+	for _, table := range tables {
+		if _, err := db.Exec(fmt.Sprintf(`CREATE TEMP VIEW %s AS SELECT rowid AS rowid, *, %s FROM main.%s`, table, strings.Join(missing[table], ", "), table)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteAddedColumns lists columns added after the first schema, so databases
+// created by older builds get them too.
+var sqliteAddedColumns = []struct {
+	table, column, definition string
+}{
+	{"chats", "active_leaf_id", "TEXT NOT NULL DEFAULT ''"},
+	{"messages", "parent_id", "TEXT NOT NULL DEFAULT ''"},
+	{"folders", "parent_id", "TEXT NOT NULL DEFAULT ''"},
+	{"chats", "system_prompt", "TEXT NOT NULL DEFAULT ''"},
+	{"chats", "temperature", "REAL"},
+	{"chats", "targets", "TEXT"},
+	{"chats", "variables", "TEXT"},
+	{"messages", "compaction", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	ok, err := hasColumn(db, table, column)
+	if err != nil || ok {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
+	return err
+}
+
+func hasColumn(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+func (b *SQLiteBackend) Close() error { return b.db.Close() }
+
+func (b *SQLiteBackend) Load() (Data, bool, error) {
+	var data Data
+	var rawConfig string
+	err := b.db.QueryRow(`SELECT data FROM config WHERE id = 1`).Scan(&rawConfig)
+	if err == sql.ErrNoRows {
+		return Data{}, false, nil
+	}
+	if err != nil {
+		return Data{}, false, err
+	}
+	if err := json.Unmarshal([]byte(rawConfig), &data.Config); err != nil {
+		return Data{}, false, fmt.Errorf("invalid stored config: %w", err)
+	}
+	// The data schema version lives in the database header.
+	if err := b.db.QueryRow(`PRAGMA user_version`).Scan(&data.SchemaVersion); err != nil {
+		return Data{}, false, err
+	}
+
+	folders, err := b.loadFolders()
+	if err != nil {
+		return Data{}, false, err
+	}
+	chats, err := b.loadChats()
+	if err != nil {
+		return Data{}, false, err
+	}
+	templates, err := b.loadTemplates()
+	if err != nil {
+		return Data{}, false, err
+	}
+	data.Folders = folders
+	data.Chats = chats
+	data.Templates = templates
+	return data, true, nil
+}
+
+func (b *SQLiteBackend) loadFolders() ([]Folder, error) {
+	rows, err := b.db.Query(`SELECT id, parent_id, name, system_prompt, temperature, created_at, updated_at, deleted_at FROM folders ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	folders := []Folder{}
+	for rows.Next() {
+		var f Folder
+		var temperature sql.NullFloat64
+		var createdAt, updatedAt string
+		var deletedAt sql.NullString
+		if err := rows.Scan(&f.ID, &f.ParentID, &f.Name, &f.SystemPrompt, &temperature, &createdAt, &updatedAt, &deletedAt); err != nil {
+			return nil, err
+		}
+		if temperature.Valid {
+			f.Temperature = &temperature.Float64
+		}
+		f.CreatedAt = parseTime(createdAt)
+		f.UpdatedAt = parseTime(updatedAt)
+		f.DeletedAt = parseNullTime(deletedAt)
+		folders = append(folders, f)
+	}
+	return folders, rows.Err()
+}
+
+func (b *SQLiteBackend) loadTemplates() ([]PromptTemplate, error) {
+	rows, err := b.db.Query(`SELECT id, folder_id, name, body, defaults, created_at, updated_at FROM prompt_templates ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var templates []PromptTemplate
+	for rows.Next() {
+		var t PromptTemplate
+		var defaults sql.NullString
+		var createdAt, updatedAt string
+		if err := rows.Scan(&t.ID, &t.FolderID, &t.Name, &t.Body, &defaults, &createdAt, &updatedAt); err != nil {
+			return nil, err
+		}
+		if defaults.Valid && defaults.String != "" {
+			if err := json.Unmarshal([]byte(defaults.String), &t.Defaults); err != nil {
+				return nil, fmt.Errorf("invalid stored template defaults: %w", err)
+			}
+		}
+		t.CreatedAt = parseTime(createdAt)
+		t.UpdatedAt = parseTime(updatedAt)
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+func (b *SQLiteBackend) loadChats() ([]Chat, error) {
+	rows, err := b.db.Query(`SELECT id, folder_id, title, system_prompt, temperature, targets, variables, created_at, updated_at, deleted_at, trashed_with_folder, active_leaf_id FROM chats ORDER BY rowid`)
+	if err != nil {
+		return nil, err
+	}
+	chats := []Chat{}
+	index := map[string]int{}
+	for rows.Next() {
+		var c Chat
+		var temperature sql.NullFloat64
+		var createdAt, updatedAt string
+		var targets, variables, deletedAt sql.NullString
+		if err := rows.Scan(&c.ID, &c.FolderID, &c.Title, &c.SystemPrompt, &temperature, &targets, &variables, &createdAt, &updatedAt, &deletedAt, &c.TrashedWithFolder, &c.ActiveLeafID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if temperature.Valid {
+			c.Temperature = &temperature.Float64
+		}
+		if targets.Valid && targets.String != "" {
+			if err := json.Unmarshal([]byte(targets.String), &c.Targets); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("invalid stored chat targets: %w", err)
+			}
+		}
+		if variables.Valid && variables.String != "" {
+			if err := json.Unmarshal([]byte(variables.String), &c.Variables); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("invalid stored chat variables: %w", err)
+			}
+		}
+		c.CreatedAt = parseTime(createdAt)
+		c.UpdatedAt = parseTime(updatedAt)
+		c.DeletedAt = parseNullTime(deletedAt)
+		c.Messages = []Message{}
+		index[c.ID] = len(chats)
+		chats = append(chats, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = b.db.Query(`SELECT chat_id, id, parent_id, role, content, attachments, provider, model, target_id, is_summary, compaction, inclusion, scope_id, usage, metrics, status, error, error_status, history_index, created_at, deleted_at FROM messages ORDER BY chat_id, position`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var chatID string
+		var m Message
+		var attachments, usage, metrics, deletedAt sql.NullString
+		var createdAt string
+		if err := rows.Scan(&chatID, &m.ID, &m.ParentID, &m.Role, &m.Content, &attachments, &m.Provider, &m.Model, &m.TargetID, &m.IsSummary, &m.Compaction, &m.Inclusion, &m.ScopeID, &usage, &metrics, &m.Status, &m.Error, &m.ErrorStatus, &m.HistoryIndex, &createdAt, &deletedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if err := decodeJSONColumns(&m.Attachments, attachments, &m.Usage, usage, &m.Metrics, metrics); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		m.CreatedAt = parseTime(createdAt)
+		m.DeletedAt = parseNullTime(deletedAt)
+		if i, ok := index[chatID]; ok {
+			chats[i].Messages = append(chats[i].Messages, m)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = b.db.Query(`SELECT chat_id, position, content, attachments, provider, model, target_id, usage, metrics, status, error, error_status, created_at FROM message_versions ORDER BY chat_id, position, version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var chatID string
+		var position int
+		var v MessageVersion
+		var attachments, usage, metrics sql.NullString
+		var createdAt string
+		if err := rows.Scan(&chatID, &position, &v.Content, &attachments, &v.Provider, &v.Model, &v.TargetID, &usage, &metrics, &v.Status, &v.Error, &v.ErrorStatus, &createdAt); err != nil {
+			return nil, err
+		}
+		if err := decodeJSONColumns(&v.Attachments, attachments, &v.Usage, usage, &v.Metrics, metrics); err != nil {
+			return nil, err
+		}
+		v.CreatedAt = parseTime(createdAt)
+		i, ok := index[chatID]
+		if !ok || position >= len(chats[i].Messages) {
+			continue
+		}
+		chats[i].Messages[position].History = append(chats[i].Messages[position].History, v)
+	}
+	return chats, rows.Err()
+}
+
+func (b *SQLiteBackend) Save(data *Data, changes Changes) error {
+	if changes.empty() {
+		return nil
+	}
+	if b.readOnly {
+		return errReadOnly
+	}
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if changes.All {
+		for _, table := range []string{"message_versions", "messages", "chats", "folders", "prompt_templates", "config"} {
+			if _, err := tx.Exec(`DELETE FROM ` + table); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, data.SchemaVersion)); err != nil {
+			return err
+		}
+	}
+	if changes.All || changes.Config {
+		raw, err := json.Marshal(data.Config)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO config (id, data) VALUES (1, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, string(raw)); err != nil {
+			return err
+		}
+	}
+
+	folders := map[string]*Folder{}
+	for i := range data.Folders {
+		folders[data.Folders[i].ID] = &data.Folders[i]
+	}
+	folderIDs := changes.Folders
+	if changes.All {
+		folderIDs = make([]string, 0, len(data.Folders))
+		for _, f := range data.Folders {
+			folderIDs = append(folderIDs, f.ID)
+		}
+	}
+	for _, id := range uniqueIDs(folderIDs) {
+		f, ok := folders[id]
+		if !ok {
+			if _, err := tx.Exec(`DELETE FROM folders WHERE id = ?`, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := saveFolder(tx, f); err != nil {
+			return err
+		}
+	}
+
+	chats := map[string]*Chat{}
+	for i := range data.Chats {
+		chats[data.Chats[i].ID] = &data.Chats[i]
+	}
+	chatIDs := changes.Chats
+	if changes.All {
+		chatIDs = make([]string, 0, len(data.Chats))
+		for _, c := range data.Chats {
+			chatIDs = append(chatIDs, c.ID)
+		}
+	}
+	saved := make(map[string]bool, len(chatIDs))
+	for _, id := range uniqueIDs(chatIDs) {
+		saved[id] = true
+		c, ok := chats[id]
+		if !ok {
+			if _, err := tx.Exec(`DELETE FROM chats WHERE id = ?`, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := saveChat(tx, c); err != nil {
+			return err
+		}
+	}
+	// Chats saved above already include their changed messages.
+	messageIDs := map[string][]string{}
+	var messageChats []string
+	for _, ref := range changes.Messages {
+		if saved[ref.ChatID] {
+			continue
+		}
+		if _, ok := messageIDs[ref.ChatID]; !ok {
+			messageChats = append(messageChats, ref.ChatID)
+		}
+		messageIDs[ref.ChatID] = append(messageIDs[ref.ChatID], ref.MessageID)
+	}
+	for _, id := range messageChats {
+		c, ok := chats[id]
+		if !ok {
+			continue
+		}
+		if err := saveChatMessages(tx, c, uniqueIDs(messageIDs[id])); err != nil {
+			return err
+		}
+	}
+
+	templates := map[string]*PromptTemplate{}
+	for i := range data.Templates {
+		templates[data.Templates[i].ID] = &data.Templates[i]
+	}
+	templateIDs := changes.Templates
+	if changes.All {
+		templateIDs = make([]string, 0, len(data.Templates))
+		for _, t := range data.Templates {
+			templateIDs = append(templateIDs, t.ID)
+		}
+	}
+	for _, id := range uniqueIDs(templateIDs) {
+		t, ok := templates[id]
+		if !ok {
+			if _, err := tx.Exec(`DELETE FROM prompt_templates WHERE id = ?`, id); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := saveTemplate(tx, t); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func saveFolder(tx *sql.Tx, f *Folder) error {
+	var temperature sql.NullFloat64
+	if f.Temperature != nil {
+		temperature = sql.NullFloat64{Float64: *f.Temperature, Valid: true}
+	}
+	_, err := tx.Exec(`INSERT INTO folders (id, parent_id, name, system_prompt, temperature, created_at, updated_at, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET parent_id = excluded.parent_id, name = excluded.name, system_prompt = excluded.system_prompt,
+			temperature = excluded.temperature, created_at = excluded.created_at,
+			updated_at = excluded.updated_at, deleted_at = excluded.deleted_at`,
+		f.ID, f.ParentID, f.Name, f.SystemPrompt, temperature, formatTime(f.CreatedAt), formatTime(f.UpdatedAt), formatNullTime(f.DeletedAt))
+	return err
+}
+
+func saveTemplate(tx *sql.Tx, t *PromptTemplate) error {
+	defaults, err := jsonColumn(t.Defaults, len(t.Defaults) == 0)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO prompt_templates (id, folder_id, name, body, defaults, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET folder_id = excluded.folder_id, name = excluded.name, body = excluded.body,
+			defaults = excluded.defaults, created_at = excluded.created_at, updated_at = excluded.updated_at`,
+		t.ID, t.FolderID, t.Name, t.Body, defaults, formatTime(t.CreatedAt), formatTime(t.UpdatedAt))
+	return err
+}
+
+// saveChat upserts the chat row and all of its messages and versions, and drops
+// the rows of messages that are gone.
+func saveChat(tx *sql.Tx, c *Chat) error {
+	if err := saveChatRow(tx, c); err != nil {
+		return err
+	}
+	w, err := newMessageWriter(tx)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	for pos := range c.Messages {
+		if err := w.write(c.ID, pos, &c.Messages[pos]); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM message_versions WHERE chat_id = ? AND position >= ?`, c.ID, len(c.Messages)); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM messages WHERE chat_id = ? AND position >= ?`, c.ID, len(c.Messages))
+	return err
+}
+
+// saveChatMessages upserts the chat row and the given messages only. The
+// messages must keep their position, which holds for messages changed in place
+// or appended at the end.
+func saveChatMessages(tx *sql.Tx, c *Chat, messageIDs []string) error {
+	if err := saveChatRow(tx, c); err != nil {
+		return err
+	}
+	w, err := newMessageWriter(tx)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	for _, id := range messageIDs {
+		pos := indexOfMessage(c.Messages, id)
+		if pos < 0 {
+			continue
+		}
+		if err := w.write(c.ID, pos, &c.Messages[pos]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func saveChatRow(tx *sql.Tx, c *Chat) error {
+	var temperature sql.NullFloat64
+	if c.Temperature != nil {
+		temperature = sql.NullFloat64{Float64: *c.Temperature, Valid: true}
+	}
+	targets, err := jsonColumn(c.Targets, len(c.Targets) == 0)
+	if err != nil {
+		return err
+	}
+	variables, err := jsonColumn(c.Variables, len(c.Variables) == 0)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO chats (id, folder_id, title, system_prompt, temperature, targets, variables, created_at, updated_at, deleted_at, trashed_with_folder, active_leaf_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET folder_id = excluded.folder_id, title = excluded.title,
+			system_prompt = excluded.system_prompt, temperature = excluded.temperature, targets = excluded.targets,
+			variables = excluded.variables,
+			created_at = excluded.created_at, updated_at = excluded.updated_at,
+			deleted_at = excluded.deleted_at, trashed_with_folder = excluded.trashed_with_folder,
+			active_leaf_id = excluded.active_leaf_id`,
+		c.ID, c.FolderID, c.Title, c.SystemPrompt, temperature, targets, variables, formatTime(c.CreatedAt), formatTime(c.UpdatedAt), formatNullTime(c.DeletedAt), c.TrashedWithFolder, c.ActiveLeafID)
+	return err
+}
+
+// messageWriter upserts message rows, and their versions, by position.
+type messageWriter struct {
+	message, version, trim *sql.Stmt
+}
+
+func newMessageWriter(tx *sql.Tx) (*messageWriter, error) {
+	w := &messageWriter{}
+	var err error
+	if w.message, err = tx.Prepare(`INSERT INTO messages (chat_id, position, id, parent_id, role, content, attachments, provider, model, target_id, is_summary, compaction, inclusion, scope_id, usage, metrics, status, error, error_status, history_index, created_at, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id, position) DO UPDATE SET id = excluded.id, parent_id = excluded.parent_id, role = excluded.role,
+			content = excluded.content, attachments = excluded.attachments, provider = excluded.provider, model = excluded.model,
+			target_id = excluded.target_id, is_summary = excluded.is_summary, compaction = excluded.compaction,
+			inclusion = excluded.inclusion, scope_id = excluded.scope_id, usage = excluded.usage, metrics = excluded.metrics,
+			status = excluded.status, error = excluded.error, error_status = excluded.error_status,
+			history_index = excluded.history_index, created_at = excluded.created_at, deleted_at = excluded.deleted_at`); err != nil {
+		return nil, err
+	}
+	if w.version, err = tx.Prepare(`INSERT INTO message_versions (chat_id, position, version, content, attachments, provider, model, target_id, usage, metrics, status, error, error_status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (chat_id, position, version) DO UPDATE SET content = excluded.content, attachments = excluded.attachments,
+			provider = excluded.provider, model = excluded.model, target_id = excluded.target_id, usage = excluded.usage,
+			metrics = excluded.metrics, status = excluded.status, error = excluded.error,
+			error_status = excluded.error_status, created_at = excluded.created_at`); err != nil {
+		w.close()
+		return nil, err
+	}
+	if w.trim, err = tx.Prepare(`DELETE FROM message_versions WHERE chat_id = ? AND position = ? AND version >= ?`); err != nil {
+		w.close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *messageWriter) close() {
+	for _, stmt := range []*sql.Stmt{w.message, w.version, w.trim} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func (w *messageWriter) write(chatID string, pos int, m *Message) error {
+	attachments, usage, metrics, err := encodeJSONColumns(m.Attachments, m.Usage, m.Metrics)
+	if err != nil {
+		return err
+	}
+	if _, err := w.message.Exec(chatID, pos, m.ID, m.ParentID, m.Role, m.Content, attachments, m.Provider, m.Model, m.TargetID, m.IsSummary, m.Compaction, m.Inclusion, m.ScopeID, usage, metrics, m.Status, m.Error, m.ErrorStatus, m.HistoryIndex, formatTime(m.CreatedAt), formatNullTime(m.DeletedAt)); err != nil {
+		return err
+	}
+	for version, v := range m.History {
+		attachments, usage, metrics, err := encodeJSONColumns(v.Attachments, v.Usage, v.Metrics)
+		if err != nil {
+			return err
+		}
+		if _, err := w.version.Exec(chatID, pos, version, v.Content, attachments, v.Provider, v.Model, v.TargetID, usage, metrics, v.Status, v.Error, v.ErrorStatus, formatTime(v.CreatedAt)); err != nil {
+			return err
+		}
+	}
+	_, err = w.trim.Exec(chatID, pos, len(m.History))
+	return err
+}
+
+func encodeJSONColumns(attachments []TextAttachment, usage *providers.Usage, metrics *providers.Metrics) (a, u, m sql.NullString, err error) {
+	if a, err = jsonColumn(attachments, len(attachments) == 0); err != nil {
+		return
+	}
+	if u, err = jsonColumn(usage, usage == nil); err != nil {
+		return
+	}
+	m, err = jsonColumn(metrics, metrics == nil)
+	return
+}
+
+func jsonColumn(v any, empty bool) (sql.NullString, error) {
+	if empty {
+		return sql.NullString{}, nil
+	}
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(raw), Valid: true}, nil
+}
+
+func decodeJSONColumns(attachments *[]TextAttachment, rawAttachments sql.NullString, usage any, rawUsage sql.NullString, metrics any, rawMetrics sql.NullString) error {
+	targets := []any{attachments, usage, metrics}
+	for i, raw := range []sql.NullString{rawAttachments, rawUsage, rawMetrics} {
+		if !raw.Valid || raw.String == "" {
+			continue
+		}
+		if err := json.Unmarshal([]byte(raw.String), targets[i]); err != nil {
+			return fmt.Errorf("invalid stored message data: %w", err)
+		}
+	}
+	return nil
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func formatNullTime(t *time.Time) sql.NullString {
+	if t == nil {
+		return sql.NullString{}
+	}
+	return sql.NullString{String: formatTime(*t), Valid: true}
+}
+
+func parseTime(v string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, v)
+	return t
+}
+
+func parseNullTime(v sql.NullString) *time.Time {
+	if !v.Valid {
+		return nil
+	}
+	t := parseTime(v.String)
+	return &t
+}
@@ -0,0 +1,150 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordingBackend remembers the changes of every save and fails saves with
+// fail while it is set.
+type recordingBackend struct {
+	Backend
+	saves []Changes
+	fail  error
+}
+
+func (b *recordingBackend) Save(data *Data, changes Changes) error {
+	b.saves = append(b.saves, changes)
+	if b.fail != nil {
+		return b.fail
+	}
+	return b.Backend.Save(data, changes)
+}
+
+func openSQLiteStore(t *testing.T, path string) (*Store, *recordingBackend) {
+	t.Helper()
+	backend, err := OpenSQLite(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordingBackend{Backend: backend}
+	s, err := Open(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, rec
+}
+
+func chatJSON(t *testing.T, s *Store, id string) string {
+	t.Helper()
+	chat, ok := s.GetChatTree(id)
+	if !ok {
+		t.Fatalf("chat %s not found", id)
+	}
+	raw, err := json.Marshal(chat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestSQLiteMessageSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, rec := openSQLiteStore(t, path)
+
+	chat, err := s.CreateChat(s.ListFolders()[0].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := s.AppendUserPrompt(chat.ID, "hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := s.BeginAssistantMessage(chat.ID, "", Message{Provider: "p", Model: "m", TargetID: "p:m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckpointAssistantMessage(chat.ID, reply, Message{Content: "hi", Status: MessageStatusStreaming}); err != nil {
+		t.Fatal(err)
+	}
+	last := rec.saves[len(rec.saves)-1]
+	if len(last.Chats) != 0 || len(last.Messages) != 1 || last.Messages[0] != (MessageRef{ChatID: chat.ID, MessageID: reply}) {
+		t.Fatalf("checkpoint saved %+v, want only the streaming message", last)
+	}
+	if err := s.CheckpointAssistantMessage(chat.ID, reply, Message{Content: "hi there"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second version that is then discarded must not leave a stale row.
+	if _, err := s.BeginAssistantMessage(chat.ID, reply, Message{Provider: "p", Model: "m2", TargetID: "p:m2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DiscardAssistantMessage(chat.ID, reply); err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.AppendUserPrompt(chat.ID, "again", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer, err := s.BeginAssistantMessage(chat.ID, "", Message{Provider: "p", Model: "m", TargetID: "p:m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckpointAssistantMessage(chat.ID, answer, Message{Content: "ok"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.DeleteMessage(chat.ID, prompt.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RestoreMessage(chat.ID, prompt.ID); err != nil {
+		t.Fatal(err)
+	}
+	// Purging moves the later messages up, which rewrites the chat.
+	if _, err := s.DeleteMessage(chat.ID, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PurgeTrash(time.Now().Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := chatJSON(t, s, chat.ID)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ := openSQLiteStore(t, path)
+	defer reopened.Close()
+	if got := chatJSON(t, reopened, chat.ID); got != want {
+		t.Fatalf("reloaded chat differs:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestSQLiteFailedSaveRetried(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s, rec := openSQLiteStore(t, path)
+	chat, err := s.CreateChat(s.ListFolders()[0].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec.fail = errors.New("database is locked")
+	if _, err := s.AppendUserPrompt(chat.ID, "lost?", nil); err == nil {
+		t.Fatal("failed save not reported")
+	}
+	rec.fail = nil
+	if _, err := s.AppendUserPrompt(chat.ID, "kept", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	want := chatJSON(t, s, chat.ID)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, _ := openSQLiteStore(t, path)
+	defer reopened.Close()
+	if got := chatJSON(t, reopened, chat.ID); got != want {
+		t.Fatalf("reloaded chat differs:\n got %s\nwant %s", got, want)
+	}
+}
@@ -1,11 +1,9 @@
 package state
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"log"
 	"sort"
 	"strings"
 	"sync"
@@ -15,37 +13,62 @@ import (
 )
 
 type Folder struct {
-	ID           string    `json:"id"`
-	Name         string    `json:"name"`
-	SystemPrompt string    `json:"systemPrompt"`
-	Temperature  *float64  `json:"temperature,omitempty"`
-	CreatedAt    time.Time `json:"createdAt"`
-	UpdatedAt    time.Time `json:"updatedAt"`
+	ID string `json:"id"`
+	// ParentID nests the folder under another one; empty for top-level folders.
+	ParentID     string     `json:"parentId,omitempty"`
+	Name         string     `json:"name"`
+	SystemPrompt string     `json:"systemPrompt"`
+	Temperature  *float64   `json:"temperature,omitempty"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+	DeletedAt    *time.Time `json:"deletedAt,omitempty"`
 }
 
-type Message struct {
-	ID           string           `json:"id"`
-	Role         string           `json:"role"`
-	Content      string           `json:"content"`
-	Attachments  []TextAttachment `json:"attachments,omitempty"`
-	Provider     string           `json:"provider,omitempty"`
-	Model        string           `json:"model,omitempty"`
-	TargetID     string           `json:"targetId,omitempty"`
-	IsSummary    bool             `json:"isSummary,omitempty"`
-	Inclusion    string           `json:"inclusion,omitempty"`
-	ScopeID      string           `json:"scopeId,omitempty"`
-	History      []MessageVersion `json:"history,omitempty"`
-	HistoryIndex int              `json:"historyIndex,omitempty"`
-	CreatedAt    time.Time        `json:"createdAt"`
-}
+const (
+	MessageStatusStreaming   = "streaming"
+	MessageStatusInterrupted = "interrupted"
+	MessageStatusCancelled   = "cancelled"
+	MessageStatusError       = "error"
+)
 
-type MessageVersion struct {
+type Message struct {
+	ID          string           `json:"id"`
+	ParentID    string           `json:"parentId,omitempty"`
+	Role        string           `json:"role"`
 	Content     string           `json:"content"`
 	Attachments []TextAttachment `json:"attachments,omitempty"`
 	Provider    string           `json:"provider,omitempty"`
 	Model       string           `json:"model,omitempty"`
 	TargetID    string           `json:"targetId,omitempty"`
-	CreatedAt   time.Time        `json:"createdAt"`
+	IsSummary   bool             `json:"isSummary,omitempty"`
+	// Compaction marks a summary that stands in for everything before it on
+	// the path when building provider history.
+	Compaction   bool               `json:"compaction,omitempty"`
+	Inclusion    string             `json:"inclusion,omitempty"`
+	ScopeID      string             `json:"scopeId,omitempty"`
+	Usage        *providers.Usage   `json:"usage,omitempty"`
+	Metrics      *providers.Metrics `json:"metrics,omitempty"`
+	Status       string             `json:"status,omitempty"`
+	Error        string             `json:"error,omitempty"`
+	ErrorStatus  int                `json:"errorStatus,omitempty"`
+	History      []MessageVersion   `json:"history,omitempty"`
+	HistoryIndex int                `json:"historyIndex,omitempty"`
+	CreatedAt    time.Time          `json:"createdAt"`
+	DeletedAt    *time.Time         `json:"deletedAt,omitempty"`
+}
+
+type MessageVersion struct {
+	Content     string             `json:"content"`
+	Attachments []TextAttachment   `json:"attachments,omitempty"`
+	Provider    string             `json:"provider,omitempty"`
+	Model       string             `json:"model,omitempty"`
+	TargetID    string             `json:"targetId,omitempty"`
+	Usage       *providers.Usage   `json:"usage,omitempty"`
+	Metrics     *providers.Metrics `json:"metrics,omitempty"`
+	Status      string             `json:"status,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	ErrorStatus int                `json:"errorStatus,omitempty"`
+	CreatedAt   time.Time          `json:"createdAt"`
 }
 
 type TextAttachment struct {
@@ -54,122 +77,190 @@ type TextAttachment struct {
 }
 
 type Chat struct {
-	ID        string    `json:"id"`
-	FolderID  string    `json:"folderId"`
-	Title     string    `json:"title"`
-	Messages  []Message `json:"messages"`
-	CreatedAt time.Time `json:"createdAt"`
-	UpdatedAt time.Time `json:"updatedAt"`
+	ID        string     `json:"id"`
+	FolderID  string     `json:"folderId"`
+	Title     string     `json:"title"`
+	Messages  []Message  `json:"messages"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// SystemPrompt, Temperature and Targets override the folder defaults for
+	// this chat when set.
+	SystemPrompt string             `json:"systemPrompt,omitempty"`
+	Temperature  *float64           `json:"temperature,omitempty"`
+	Targets      []providers.Target `json:"targets,omitempty"`
+	// Variables fill {{name}} placeholders in the system prompt and templates.
+	Variables map[string]string `json:"variables,omitempty"`
+	// ActiveLeafID is the user message the active branch ends at.
+	ActiveLeafID string `json:"activeLeafId,omitempty"`
+	// TrashedWithFolder marks chats that went to the trash because their
+	// folder was deleted; restoring the folder brings them back.
+	TrashedWithFolder bool `json:"trashedWithFolder,omitempty"`
 }
 
 type Data struct {
-	Config  providers.ProviderConfig `json:"config"`
-	Folders []Folder                 `json:"folders"`
-	Chats   []Chat                   `json:"chats"`
+	SchemaVersion int                      `json:"schemaVersion"`
+	Config        providers.ProviderConfig `json:"config"`
+	Folders       []Folder                 `json:"folders"`
+	Chats         []Chat                   `json:"chats"`
+	Templates     []PromptTemplate         `json:"templates,omitempty"`
 }
 
+// Store keeps the whole state in memory and writes changed records through
+// its Backend.
 type Store struct {
-	mu   sync.RWMutex
-	path string
-	data Data
+	mu      sync.RWMutex
+	backend Backend
+	data    Data
+	changes Changes
+	index   *searchIndex
+	// chatPos maps chat IDs to their position in data.Chats.
+	chatPos map[string]int
 }
 
+// New opens the JSON file store at path.
 func New(path string) (*Store, error) {
-	s := &Store{path: path}
+	return Open(NewJSONBackend(path))
+}
+
+func Open(backend Backend) (*Store, error) {
+	s := &Store{backend: backend, index: newSearchIndex()}
 	if err := s.load(); err != nil {
 		return nil, err
 	}
 	return s, nil
 }
 
+func (s *Store) Close() error {
+	return s.backend.Close()
+}
+
 func (s *Store) load() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+	data, found, err := s.backend.Load()
+	if err != nil {
 		return err
 	}
-
-	b, err := os.ReadFile(s.path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			now := time.Now().UTC()
-			s.data = Data{
-				Config: providers.ProviderConfig{
-					OpenRouter: providers.OpenRouterConfig{
-						BaseURL: "https://openrouter.ai/api/v1",
-						Models:  []string{"openai/gpt-4o-mini", "anthropic/claude-3.5-sonnet"},
-					},
-					Ollama: providers.OllamaConfig{
-						BaseURL: "http://localhost:11434",
-						Models:  []string{"llama3.2:latest", "qwen2.5"},
-					},
-				},
-				Folders: []Folder{{
-					ID:           newID("fld"),
-					Name:         "General",
-					SystemPrompt: "",
-					CreatedAt:    now,
-					UpdatedAt:    now,
-				}},
-				Chats: []Chat{},
-			}
-			return s.persistLocked()
+	if !found {
+		now := time.Now().UTC()
+		s.data = Data{
+			SchemaVersion: CurrentSchemaVersion,
+			Config:        defaultProviderConfig(),
+			Folders: []Folder{{
+				ID:           NewID("fld"),
+				Name:         "General",
+				SystemPrompt: "",
+				CreatedAt:    now,
+				UpdatedAt:    now,
+			}},
+			Chats: []Chat{},
 		}
-		return err
+		s.changes.All = true
+		return s.persistLocked()
 	}
 
-	if len(b) == 0 {
-		s.data = Data{}
-		return nil
+	s.data = data
+	s.reindexChatsLocked()
+	// Repair IDs first; the message tree migration links messages by ID.
+	if repaired := repairDuplicateMessageIDs(&s.data); len(repaired) > 0 {
+		log.Printf("repaired duplicate message IDs in %d chat(s)", len(repaired))
+		for _, id := range repaired {
+			s.markChat(id)
+		}
 	}
-
-	if err := json.Unmarshal(b, &s.data); err != nil {
-		return fmt.Errorf("invalid state file: %w", err)
+	report, err := migrate(&s.data)
+	if err != nil {
+		return err
+	}
+	if len(report.Steps) > 0 {
+		log.Printf("migrated state: %s", report)
+		s.changes.All = true
 	}
 	if len(s.data.Folders) == 0 {
 		now := time.Now().UTC()
-		s.data.Folders = []Folder{{ID: newID("fld"), Name: "General", CreatedAt: now, UpdatedAt: now}}
-	}
-	if strings.TrimSpace(s.data.Config.OpenRouter.BaseURL) == "" {
-		s.data.Config.OpenRouter.BaseURL = "https://openrouter.ai/api/v1"
-	}
-	if strings.TrimSpace(s.data.Config.Ollama.BaseURL) == "" {
-		s.data.Config.Ollama.BaseURL = "http://localhost:11434"
-	}
-	if len(s.data.Config.OpenRouter.Models) == 0 {
-		s.data.Config.OpenRouter.Models = []string{"openai/gpt-4o-mini", "anthropic/claude-3.5-sonnet"}
-	}
-	if len(s.data.Config.Ollama.Models) == 0 {
-		s.data.Config.Ollama.Models = []string{"llama3.2:latest", "qwen2.5"}
+		s.data.Folders = []Folder{{ID: NewID("fld"), Name: "General", CreatedAt: now, UpdatedAt: now}}
+		s.markFolder(s.data.Folders[0].ID)
 	}
+
+	interrupted := 0
 	for i := range s.data.Chats {
 		for j := range s.data.Chats[i].Messages {
 			msg := &s.data.Chats[i].Messages[j]
-			if strings.TrimSpace(msg.Inclusion) == "" {
-				if msg.Role == "assistant" && msg.IsSummary {
-					msg.Inclusion = "always"
-				} else if msg.Role == "assistant" {
-					msg.Inclusion = "model_only"
-				} else {
-					msg.Inclusion = "always"
+			// Anything still streaming was cut off by a crash or restart.
+			wasStreaming := msg.Status == MessageStatusStreaming
+			for k := range msg.History {
+				if msg.History[k].Status == MessageStatusStreaming {
+					msg.History[k].Status = MessageStatusInterrupted
+					wasStreaming = true
 				}
 			}
-			if msg.Inclusion == "model_only" && strings.TrimSpace(msg.ScopeID) == "" {
-				msg.ScopeID = msg.TargetID
+			if wasStreaming {
+				msg.Status = MessageStatusInterrupted
+				interrupted++
+				s.markChat(s.data.Chats[i].ID)
 			}
-			ensureMessageHistory(msg)
 		}
 	}
-	return nil
+	if interrupted > 0 {
+		log.Printf("marked %d interrupted streaming message(s)", interrupted)
+	}
+	return s.persistLocked()
 }
 
+// persistLocked writes the records marked since the last write. Marks stay
+// until a write succeeds, so the next save retries what a failed one missed.
 func (s *Store) persistLocked() error {
-	payload, err := json.MarshalIndent(s.data, "", "  ")
-	if err != nil {
+	s.index.invalidate(s.changes)
+	if err := s.backend.Save(&s.data, s.changes); err != nil {
 		return err
 	}
-	return os.WriteFile(s.path, payload, 0o644)
+	s.changes = Changes{}
+	return nil
+}
+
+// chatIndexLocked returns the position of a chat in s.data.Chats, or -1.
+func (s *Store) chatIndexLocked(id string) int {
+	if i, ok := s.chatPos[id]; ok {
+		return i
+	}
+	return -1
+}
+
+// appendChatLocked adds a chat at the end of s.data.Chats.
+func (s *Store) appendChatLocked(chat Chat) {
+	if s.chatPos == nil {
+		s.chatPos = map[string]int{}
+	}
+	s.chatPos[chat.ID] = len(s.data.Chats)
+	s.data.Chats = append(s.data.Chats, chat)
+}
+
+// reindexChatsLocked rebuilds chatPos after chats were removed or reordered.
+func (s *Store) reindexChatsLocked() {
+	s.chatPos = make(map[string]int, len(s.data.Chats))
+	for i := range s.data.Chats {
+		s.chatPos[s.data.Chats[i].ID] = i
+	}
+}
+
+func (s *Store) markChat(id string) {
+	s.changes.Chats = append(s.changes.Chats, id)
+}
+
+// markMessage records a message changed in place or appended at the end of
+// its chat; anything that moves or removes messages needs markChat.
+func (s *Store) markMessage(chatID, messageID string) {
+	s.changes.Messages = append(s.changes.Messages, MessageRef{ChatID: chatID, MessageID: messageID})
+}
+
+func (s *Store) markFolder(id string) {
+	s.changes.Folders = append(s.changes.Folders, id)
+}
+
+func (s *Store) markTemplate(id string) {
+	s.changes.Templates = append(s.changes.Templates, id)
 }
 
 func (s *Store) GetConfig() providers.ProviderConfig {
@@ -182,28 +273,39 @@ func (s *Store) SetConfig(cfg providers.ProviderConfig) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.data.Config = cfg
+	s.changes.Config = true
 	return s.persistLocked()
 }
 
 func (s *Store) ListFolders() []Folder {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	folders := append([]Folder(nil), s.data.Folders...)
+	folders := make([]Folder, 0, len(s.data.Folders))
+	for _, f := range s.data.Folders {
+		if f.DeletedAt == nil {
+			folders = append(folders, f)
+		}
+	}
 	sort.Slice(folders, func(i, j int) bool { return folders[i].UpdatedAt.After(folders[j].UpdatedAt) })
 	return folders
 }
 
-func (s *Store) CreateFolder(name, systemPrompt string, temperature *float64) (Folder, error) {
+func (s *Store) CreateFolder(parentID, name, systemPrompt string, temperature *float64) (Folder, error) {
 	name = strings.TrimSpace(name)
 	if name == "" {
 		return Folder{}, errors.New("name is required")
 	}
+	parentID = strings.TrimSpace(parentID)
 	now := time.Now().UTC()
-	folder := Folder{ID: newID("fld"), Name: name, SystemPrompt: systemPrompt, Temperature: temperature, CreatedAt: now, UpdatedAt: now}
+	folder := Folder{ID: NewID("fld"), ParentID: parentID, Name: name, SystemPrompt: systemPrompt, Temperature: temperature, CreatedAt: now, UpdatedAt: now}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if parentID != "" && !s.folderExistsLocked(parentID) {
+		return Folder{}, errors.New("parent folder not found")
+	}
 	s.data.Folders = append(s.data.Folders, folder)
+	s.markFolder(folder.ID)
 	if err := s.persistLocked(); err != nil {
 		return Folder{}, err
 	}
@@ -215,7 +317,7 @@ func (s *Store) UpdateFolder(id, name, systemPrompt string, temperature *float64
 	defer s.mu.Unlock()
 
 	for i := range s.data.Folders {
-		if s.data.Folders[i].ID != id {
+		if s.data.Folders[i].ID != id || s.data.Folders[i].DeletedAt != nil {
 			continue
 		}
 		if strings.TrimSpace(name) != "" {
@@ -224,19 +326,20 @@ func (s *Store) UpdateFolder(id, name, systemPrompt string, temperature *float64
 		s.data.Folders[i].SystemPrompt = systemPrompt
 		s.data.Folders[i].Temperature = temperature
 		s.data.Folders[i].UpdatedAt = time.Now().UTC()
+		s.markFolder(id)
 		if err := s.persistLocked(); err != nil {
 			return Folder{}, err
 		}
 		return s.data.Folders[i], nil
 	}
-	return Folder{}, errors.New("folder not found")
+	return Folder{}, ErrFolderNotFound
 }
 
 func (s *Store) FindFolder(id string) (Folder, bool) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	for _, f := range s.data.Folders {
-		if f.ID == id {
+		if f.ID == id && f.DeletedAt == nil {
 			return f, true
 		}
 	}
@@ -248,6 +351,9 @@ func (s *Store) ListChats(folderID string) []Chat {
 	defer s.mu.RUnlock()
 	chats := make([]Chat, 0)
 	for _, c := range s.data.Chats {
+		if c.DeletedAt != nil {
+			continue
+		}
 		if folderID != "" && c.FolderID != folderID {
 			continue
 		}
@@ -265,192 +371,309 @@ func (s *Store) CreateChat(folderID, title string) (Chat, error) {
 		title = "New Chat"
 	}
 	if _, ok := s.FindFolder(folderID); !ok {
-		return Chat{}, errors.New("folder not found")
+		return Chat{}, ErrFolderNotFound
 	}
 	now := time.Now().UTC()
-	chat := Chat{ID: newID("cht"), FolderID: folderID, Title: title, Messages: []Message{}, CreatedAt: now, UpdatedAt: now}
+	chat := Chat{ID: NewID("cht"), FolderID: folderID, Title: title, Messages: []Message{}, CreatedAt: now, UpdatedAt: now}
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.data.Chats = append(s.data.Chats, chat)
+	s.appendChatLocked(chat)
+	s.markChat(chat.ID)
 	if err := s.persistLocked(); err != nil {
 		return Chat{}, err
 	}
 	return chat, nil
 }
 
-func (s *Store) GetChat(id string) (Chat, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	for _, c := range s.data.Chats {
-		if c.ID == id {
-			return c, true
-		}
+// ImportChats adds already converted chats to a folder and returns them without
+// messages. Each chat is a single thread, linked in slice order. Chats get
+// fresh IDs; message IDs are kept so imported forks share their common prefix.
+func (s *Store) ImportChats(folderID string, chats []Chat) ([]Chat, error) {
+	if len(chats) == 0 {
+		return nil, errors.New("nothing to import")
 	}
-	return Chat{}, false
-}
 
-func (s *Store) UpdateChat(id, title, folderID string) (Chat, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if !s.folderExistsLocked(folderID) {
+		return nil, ErrFolderNotFound
+	}
 
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != id {
-			continue
-		}
-
-		oldFolderID := s.data.Chats[i].FolderID
-		if strings.TrimSpace(folderID) != "" && folderID != s.data.Chats[i].FolderID {
-			if !s.folderExistsLocked(folderID) {
-				return Chat{}, errors.New("folder not found")
-			}
-			s.data.Chats[i].FolderID = folderID
+	now := time.Now().UTC()
+	imported := make([]Chat, 0, len(chats))
+	for _, chat := range chats {
+		chat.ID = NewID("cht")
+		chat.FolderID = folderID
+		chat.DeletedAt = nil
+		chat.TrashedWithFolder = false
+		if strings.TrimSpace(chat.Title) == "" {
+			chat.Title = "Imported Chat"
 		}
-
-		if strings.TrimSpace(title) != "" {
-			s.data.Chats[i].Title = strings.TrimSpace(title)
+		if chat.CreatedAt.IsZero() {
+			chat.CreatedAt = now
 		}
-
-		s.data.Chats[i].UpdatedAt = time.Now().UTC()
-		if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
-			return Chat{}, err
+		if chat.UpdatedAt.IsZero() {
+			chat.UpdatedAt = chat.CreatedAt
 		}
-		if oldFolderID != s.data.Chats[i].FolderID {
-			if err := s.touchFolderLocked(oldFolderID); err != nil {
-				return Chat{}, err
+		chat.Messages = cloneMessages(liveMessages(chat.Messages))
+		for i := range chat.Messages {
+			msg := &chat.Messages[i]
+			if msg.ID == "" {
+				msg.ID = NewID("msg")
 			}
+			if msg.CreatedAt.IsZero() {
+				msg.CreatedAt = chat.CreatedAt
+			}
+			// Nothing can still be streaming in an imported chat.
+			if msg.Status == MessageStatusStreaming {
+				msg.Status = MessageStatusInterrupted
+			}
+			for k := range msg.History {
+				if msg.History[k].Status == MessageStatusStreaming {
+					msg.History[k].Status = MessageStatusInterrupted
+				}
+			}
+			applyInclusionDefaults(msg)
+			ensureMessageHistory(msg)
 		}
-		if err := s.persistLocked(); err != nil {
-			return Chat{}, err
-		}
-		return s.data.Chats[i], nil
+		chat.ActiveLeafID = linkLinear(chat.Messages)
+		s.appendChatLocked(chat)
+		s.markChat(chat.ID)
+		summary := chat
+		summary.Messages = nil
+		imported = append(imported, summary)
+	}
+	if err := s.touchFolderLocked(folderID); err != nil {
+		return nil, err
+	}
+	if err := s.persistLocked(); err != nil {
+		return nil, err
 	}
-	return Chat{}, errors.New("chat not found")
+	return imported, nil
 }
 
-func (s *Store) ForkChatFromMessage(chatID, messageID, title string) (Chat, error) {
+func (s *Store) GetChat(id string) (Chat, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.chatIndexLocked(id)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return Chat{}, false
+	}
+	return cloneChat(s.data.Chats[i]), true
+}
+
+// GetChatTree returns a chat with every message of every branch, trashed ones
+// included, for walking paths with ActivePath. ActiveLeafID is resolved.
+func (s *Store) GetChatTree(id string) (Chat, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.chatIndexLocked(id)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return Chat{}, false
+	}
+	return cloneChatTree(s.data.Chats[i]), true
+}
+
+// ChatUpdate holds the fields a PATCH changes. Empty Title and FolderID, and
+// nil SystemPrompt, Temperature, Targets and Variables, leave the chat as it is.
+type ChatUpdate struct {
+	Title            string
+	FolderID         string
+	SystemPrompt     *string
+	Temperature      *float64
+	ClearTemperature bool
+	Targets          []providers.Target
+	Variables        map[string]string
+}
+
+func (s *Store) UpdateChat(id string, update ChatUpdate) (Chat, error) {
+	title, folderID := update.Title, update.FolderID
+	targets, err := NormalizeTargets(update.Targets)
+	if err != nil {
+		return Chat{}, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	sourceIdx := -1
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID == chatID {
-			sourceIdx = i
-			break
-		}
-	}
-	if sourceIdx < 0 {
+	i := s.chatIndexLocked(id)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
 		return Chat{}, errors.New("chat not found")
 	}
 
-	msgIdx := indexOfMessage(s.data.Chats[sourceIdx].Messages, messageID)
-	if msgIdx < 0 {
-		return Chat{}, errors.New("message not found")
+	oldFolderID := s.data.Chats[i].FolderID
+	if strings.TrimSpace(folderID) != "" && folderID != s.data.Chats[i].FolderID {
+		if !s.folderExistsLocked(folderID) {
+			return Chat{}, ErrFolderNotFound
+		}
+		s.data.Chats[i].FolderID = folderID
 	}
 
-	now := time.Now().UTC()
-	if strings.TrimSpace(title) == "" {
-		title = s.data.Chats[sourceIdx].Title + " (Fork)"
+	if strings.TrimSpace(title) != "" {
+		s.data.Chats[i].Title = strings.TrimSpace(title)
 	}
-
-	cloned := cloneMessages(s.data.Chats[sourceIdx].Messages[:msgIdx+1])
-	chat := Chat{
-		ID:        newID("cht"),
-		FolderID:  s.data.Chats[sourceIdx].FolderID,
-		Title:     strings.TrimSpace(title),
-		Messages:  cloned,
-		CreatedAt: now,
-		UpdatedAt: now,
+	if update.SystemPrompt != nil {
+		s.data.Chats[i].SystemPrompt = *update.SystemPrompt
 	}
-	s.data.Chats = append(s.data.Chats, chat)
-	if err := s.touchFolderLocked(chat.FolderID); err != nil {
+	if update.ClearTemperature {
+		s.data.Chats[i].Temperature = nil
+	} else if update.Temperature != nil {
+		t := *update.Temperature
+		s.data.Chats[i].Temperature = &t
+	}
+	if update.Targets != nil {
+		s.data.Chats[i].Targets = targets
+	}
+	if update.Variables != nil {
+		s.data.Chats[i].Variables = normalizeVariables(update.Variables)
+	}
+
+	s.data.Chats[i].UpdatedAt = time.Now().UTC()
+	if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
 		return Chat{}, err
 	}
+	if oldFolderID != s.data.Chats[i].FolderID {
+		if err := s.touchFolderLocked(oldFolderID); err != nil {
+			return Chat{}, err
+		}
+	}
+	s.markChat(id)
 	if err := s.persistLocked(); err != nil {
 		return Chat{}, err
 	}
-	return chat, nil
+	return cloneChat(s.data.Chats[i]), nil
+}
+
+// HasAutomaticTitle reports whether a chat still has the title taken from its
+// first prompt, i.e. nobody renamed it.
+func (s *Store) HasAutomaticTitle(chatID string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := s.chatIndexLocked(chatID)
+	return i >= 0 && s.data.Chats[i].DeletedAt == nil && hasAutomaticTitle(&s.data.Chats[i])
 }
 
-func (s *Store) PrepareRegenerate(chatID, messageID string) (chat Chat, prompt string, history []Message, err error) {
+// SetGeneratedTitle stores a model-generated title. Unless force is set, a
+// chat renamed in the meantime keeps its title.
+func (s *Store) SetGeneratedTitle(chatID, title string, force bool) (Chat, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return Chat{}, errors.New("title is required")
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	chatIdx := -1
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID == chatID {
-			chatIdx = i
-			break
-		}
+	i := s.chatIndexLocked(chatID)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return Chat{}, errors.New("chat not found")
 	}
-	if chatIdx < 0 {
-		return Chat{}, "", nil, errors.New("chat not found")
+	c := &s.data.Chats[i]
+	if !force && !hasAutomaticTitle(c) {
+		return cloneChat(*c), nil
+	}
+	c.Title = title
+	c.UpdatedAt = time.Now().UTC()
+	s.markChat(chatID)
+	if err := s.persistLocked(); err != nil {
+		return Chat{}, err
 	}
+	return cloneChat(*c), nil
+}
 
-	msgIdx := indexOfMessage(s.data.Chats[chatIdx].Messages, messageID)
-	if msgIdx < 0 {
-		return Chat{}, "", nil, errors.New("message not found")
+func hasAutomaticTitle(c *Chat) bool {
+	title := strings.TrimSpace(c.Title)
+	if title == "New Chat" {
+		return true
+	}
+	if len(c.Messages) == 0 || c.Messages[0].Role != "user" {
+		return false
 	}
+	first := c.Messages[0]
+	content, attachments := first.Content, first.Attachments
+	if len(first.History) > 0 {
+		content, attachments = first.History[0].Content, first.History[0].Attachments
+	}
+	return title == trimTitle(renderPrompt(content, attachments))
+}
 
-	userIdx := -1
-	if s.data.Chats[chatIdx].Messages[msgIdx].Role == "user" {
-		userIdx = msgIdx
-	} else {
-		for i := msgIdx; i >= 0; i-- {
-			if s.data.Chats[chatIdx].Messages[i].Role == "user" {
-				userIdx = i
-				break
-			}
-		}
+func (s *Store) ForkChatFromMessage(chatID, messageID, title string) (Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sourceIdx := s.chatIndexLocked(chatID)
+	if sourceIdx < 0 {
+		return Chat{}, errors.New("chat not found")
 	}
-	if userIdx < 0 {
-		return Chat{}, "", nil, errors.New("no user prompt found before message")
+
+	msgIdx := indexOfMessage(s.data.Chats[sourceIdx].Messages, messageID)
+	if msgIdx < 0 || s.data.Chats[sourceIdx].Messages[msgIdx].DeletedAt != nil {
+		return Chat{}, errors.New("message not found")
 	}
 
-	prompt = renderPrompt(s.data.Chats[chatIdx].Messages[userIdx].Content, s.data.Chats[chatIdx].Messages[userIdx].Attachments)
-	history = cloneMessages(s.data.Chats[chatIdx].Messages[:userIdx])
-	s.data.Chats[chatIdx].Messages = cloneMessages(s.data.Chats[chatIdx].Messages[:userIdx+1])
-	s.data.Chats[chatIdx].UpdatedAt = time.Now().UTC()
-	if err := s.touchFolderLocked(s.data.Chats[chatIdx].FolderID); err != nil {
-		return Chat{}, "", nil, err
+	now := time.Now().UTC()
+	if strings.TrimSpace(title) == "" {
+		title = s.data.Chats[sourceIdx].Title + " (Fork)"
+	}
+
+	// The fork gets the path up to the message, cut right after it.
+	source := s.data.Chats[sourceIdx].Messages
+	path := ActivePath(source, turnOf(source, msgIdx))
+	if cut := indexOfMessage(path, messageID); cut >= 0 {
+		path = path[:cut+1]
+	}
+	cloned := cloneMessages(path)
+	chat := Chat{
+		ID:           NewID("cht"),
+		FolderID:     s.data.Chats[sourceIdx].FolderID,
+		Title:        strings.TrimSpace(title),
+		SystemPrompt: s.data.Chats[sourceIdx].SystemPrompt,
+		Temperature:  s.data.Chats[sourceIdx].Temperature,
+		Targets:      cloneTargets(s.data.Chats[sourceIdx].Targets),
+		Variables:    cloneVariables(s.data.Chats[sourceIdx].Variables),
+		Messages:     cloned,
+		ActiveLeafID: linkLinear(cloned),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	s.appendChatLocked(chat)
+	if err := s.touchFolderLocked(chat.FolderID); err != nil {
+		return Chat{}, err
 	}
+	s.markChat(chat.ID)
 	if err := s.persistLocked(); err != nil {
-		return Chat{}, "", nil, err
+		return Chat{}, err
 	}
-	return s.data.Chats[chatIdx], prompt, history, nil
+	return chat, nil
 }
 
-func (s *Store) PrepareUserRegenerate(chatID, messageID string) (chat Chat, prompt string, history []Message, replaceByTarget map[string]string, err error) {
+// PrepareUserRegenerate returns the chat tree, the prompt of a user message, the
+// leaf its history ends at and its current response per target.
+func (s *Store) PrepareUserRegenerate(chatID, messageID string) (chat Chat, prompt string, historyLeafID string, replaceByTarget map[string]string, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	chatIdx := -1
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID == chatID {
-			chatIdx = i
-			break
-		}
-	}
+	chatIdx := s.chatIndexLocked(chatID)
 	if chatIdx < 0 {
-		return Chat{}, "", nil, nil, errors.New("chat not found")
+		return Chat{}, "", "", nil, errors.New("chat not found")
 	}
 
 	msgIdx := indexOfMessage(s.data.Chats[chatIdx].Messages, messageID)
-	if msgIdx < 0 {
-		return Chat{}, "", nil, nil, errors.New("message not found")
+	if msgIdx < 0 || s.data.Chats[chatIdx].Messages[msgIdx].DeletedAt != nil {
+		return Chat{}, "", "", nil, errors.New("message not found")
 	}
 	if s.data.Chats[chatIdx].Messages[msgIdx].Role != "user" {
-		return Chat{}, "", nil, nil, errors.New("message is not user")
+		return Chat{}, "", "", nil, errors.New("message is not user")
 	}
 
 	prompt = renderPrompt(s.data.Chats[chatIdx].Messages[msgIdx].Content, s.data.Chats[chatIdx].Messages[msgIdx].Attachments)
-	history = cloneMessages(s.data.Chats[chatIdx].Messages[:msgIdx])
+	historyLeafID = s.data.Chats[chatIdx].Messages[msgIdx].ParentID
 	replaceByTarget = map[string]string{}
 
-	for i := msgIdx + 1; i < len(s.data.Chats[chatIdx].Messages); i++ {
+	for _, i := range responsesOf(s.data.Chats[chatIdx].Messages, messageID) {
 		msg := s.data.Chats[chatIdx].Messages[i]
-		if msg.Role == "user" {
-			break
+		if msg.DeletedAt != nil {
+			continue
 		}
 		if msg.Role != "assistant" {
 			continue
@@ -468,26 +691,20 @@ func (s *Store) PrepareUserRegenerate(chatID, messageID string) (chat Chat, prom
 		replaceByTarget[targetID] = msg.ID
 	}
 
-	return s.data.Chats[chatIdx], prompt, history, replaceByTarget, nil
+	return cloneChatTree(s.data.Chats[chatIdx]), prompt, historyLeafID, replaceByTarget, nil
 }
 
 func (s *Store) BuildSummaryPrompt(chatID, userMessageID string) (string, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	chatIdx := -1
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID == chatID {
-			chatIdx = i
-			break
-		}
-	}
+	chatIdx := s.chatIndexLocked(chatID)
 	if chatIdx < 0 {
 		return "", errors.New("chat not found")
 	}
 
 	userIdx := indexOfMessage(s.data.Chats[chatIdx].Messages, userMessageID)
-	if userIdx < 0 {
+	if userIdx < 0 || s.data.Chats[chatIdx].Messages[userIdx].DeletedAt != nil {
 		return "", errors.New("message not found")
 	}
 	userMsg := s.data.Chats[chatIdx].Messages[userIdx]
@@ -495,152 +712,308 @@ func (s *Store) BuildSummaryPrompt(chatID, userMessageID string) (string, error)
 		return "", errors.New("summary source must be a user message")
 	}
 
-	type response struct {
-		header  string
-		content string
+	responses := summaryResponses(s.data.Chats[chatIdx].Messages, userMsg.ID)
+	if len(responses) == 0 {
+		return "", errors.New("no assistant responses available to summarize yet")
 	}
-	responses := make([]response, 0)
-	for i := userIdx + 1; i < len(s.data.Chats[chatIdx].Messages); i++ {
-		msg := s.data.Chats[chatIdx].Messages[i]
-		if msg.Role == "user" {
-			break
+
+	var b strings.Builder
+	b.WriteString("Create a concise, high-quality synthesis of multiple model responses.\n")
+	b.WriteString("Return: 1) key consensus, 2) key differences, 3) recommended final answer.\n\n")
+	writeSummaryTurn(&b, userMsg, responses)
+	return b.String(), nil
+}
+
+// BuildCompactionPrompt asks for a summary of the path to leafID, from fromID
+// on, that can replace it as context. fromID is a user message or an earlier
+// compaction summary, which is carried over; empty starts at the beginning.
+// Every model's answers are included since all of them share the summary.
+func (s *Store) BuildCompactionPrompt(chatID, fromID, leafID string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	chatIdx := s.chatIndexLocked(chatID)
+	if chatIdx < 0 {
+		return "", errors.New("chat not found")
+	}
+	messages := s.data.Chats[chatIdx].Messages
+	path := ActivePath(messages, leafID)
+
+	var b strings.Builder
+	b.WriteString("Summarize the conversation below so the summary can replace it as context for continuing the conversation.\n")
+	b.WriteString("Keep facts, decisions, names, code identifiers, open questions and the user's preferences. Reply with the summary only.\n\n")
+	start := 0
+	for i, msg := range path {
+		if msg.ID != fromID {
+			continue
 		}
-		if msg.Role != "assistant" || strings.TrimSpace(msg.Content) == "" {
+		start = i
+		if msg.Compaction {
+			b.WriteString("Summary of the earlier conversation:\n")
+			b.WriteString(msg.Content)
+			b.WriteString("\n\n")
+		}
+		break
+	}
+	turns := 0
+	for _, msg := range path[start:] {
+		if msg.Role != "user" {
 			continue
 		}
-		header := strings.TrimSpace(msg.Provider)
-		if strings.TrimSpace(msg.Model) != "" {
-			if header != "" {
-				header += " · "
-			}
-			header += strings.TrimSpace(msg.Model)
+		writeSummaryTurn(&b, msg, summaryResponses(messages, msg.ID))
+		turns++
+	}
+	if turns == 0 {
+		return "", errors.New("no turns to compact")
+	}
+	return b.String(), nil
+}
+
+type summaryResponse struct {
+	header  string
+	content string
+}
+
+// summaryResponses returns the finished answers to a user message. Earlier
+// compaction summaries are not answers and are left out.
+func summaryResponses(messages []Message, userID string) []summaryResponse {
+	responses := make([]summaryResponse, 0)
+	for _, i := range responsesOf(messages, userID) {
+		msg := messages[i]
+		if msg.DeletedAt != nil || msg.Compaction {
+			continue
 		}
-		if header == "" {
-			header = "assistant"
+		if msg.Role != "assistant" || msg.Status == MessageStatusError || strings.TrimSpace(msg.Content) == "" {
+			continue
 		}
-		responses = append(responses, response{
-			header:  header,
+		responses = append(responses, summaryResponse{
+			header:  ResponseLabel(msg.Provider, msg.Model),
 			content: msg.Content,
 		})
 	}
-	if len(responses) == 0 {
-		return "", errors.New("no assistant responses available to summarize yet")
-	}
+	return responses
+}
 
-	var b strings.Builder
-	b.WriteString("Create a concise, high-quality synthesis of multiple model responses.\n")
-	b.WriteString("Return: 1) key consensus, 2) key differences, 3) recommended final answer.\n\n")
+func writeSummaryTurn(b *strings.Builder, user Message, responses []summaryResponse) {
 	b.WriteString("User question:\n")
-	b.WriteString(renderPrompt(userMsg.Content, userMsg.Attachments))
+	b.WriteString(renderPrompt(user.Content, user.Attachments))
 	b.WriteString("\n\nResponses:\n")
 	for i, r := range responses {
 		b.WriteString(fmt.Sprintf("[%d] %s\n%s\n\n", i+1, r.header, r.content))
 	}
-	return b.String(), nil
 }
 
-func (s *Store) PrepareAssistantRegenerate(chatID, messageID string) (chat Chat, prompt string, history []Message, target Message, err error) {
+// ErrImportedMessage is returned for assistant messages imported from another
+// app, which record the original model but no provider to run it on.
+var ErrImportedMessage = errors.New("imported messages cannot be regenerated")
+
+func (s *Store) PrepareAssistantRegenerate(chatID, messageID string) (chat Chat, prompt string, historyLeafID string, target Message, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	chatIdx := -1
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID == chatID {
-			chatIdx = i
-			break
-		}
-	}
+	chatIdx := s.chatIndexLocked(chatID)
 	if chatIdx < 0 {
-		return Chat{}, "", nil, Message{}, errors.New("chat not found")
+		return Chat{}, "", "", Message{}, errors.New("chat not found")
 	}
 
 	msgIdx := indexOfMessage(s.data.Chats[chatIdx].Messages, messageID)
 	if msgIdx < 0 {
-		return Chat{}, "", nil, Message{}, errors.New("message not found")
+		return Chat{}, "", "", Message{}, errors.New("message not found")
 	}
 
 	target = s.data.Chats[chatIdx].Messages[msgIdx]
+	if target.DeletedAt != nil {
+		return Chat{}, "", "", Message{}, errors.New("message not found")
+	}
 	if target.Role != "assistant" {
-		return Chat{}, "", nil, Message{}, errors.New("message is not assistant")
+		return Chat{}, "", "", Message{}, errors.New("message is not assistant")
+	}
+	if strings.TrimSpace(target.Provider) == "" && strings.TrimSpace(target.Model) != "" {
+		return Chat{}, "", "", Message{}, ErrImportedMessage
 	}
 	if strings.TrimSpace(target.Provider) == "" || strings.TrimSpace(target.Model) == "" {
-		return Chat{}, "", nil, Message{}, errors.New("assistant message is missing provider/model")
+		return Chat{}, "", "", Message{}, errors.New("assistant message is missing provider/model")
 	}
 
-	userIdx := -1
-	for i := msgIdx; i >= 0; i-- {
-		if s.data.Chats[chatIdx].Messages[i].Role == "user" {
-			userIdx = i
-			break
-		}
-	}
+	userIdx := indexOfMessage(s.data.Chats[chatIdx].Messages, target.ParentID)
 	if userIdx < 0 {
-		return Chat{}, "", nil, Message{}, errors.New("no user prompt found before message")
+		return Chat{}, "", "", Message{}, errors.New("no user prompt found before message")
 	}
 
 	prompt = renderPrompt(s.data.Chats[chatIdx].Messages[userIdx].Content, s.data.Chats[chatIdx].Messages[userIdx].Attachments)
-	history = cloneMessages(s.data.Chats[chatIdx].Messages[:userIdx])
-	chat = s.data.Chats[chatIdx]
-	return chat, prompt, history, target, nil
+	historyLeafID = s.data.Chats[chatIdx].Messages[userIdx].ParentID
+	chat = cloneChatTree(s.data.Chats[chatIdx])
+	return chat, prompt, historyLeafID, target, nil
 }
 
-func (s *Store) ReplaceAssistantMessage(chatID, messageID string, replacement Message) error {
+// BeginAssistantMessage stores an empty streaming placeholder for a target and
+// returns its message ID. With replaceID set, the placeholder is a new version
+// of that assistant message instead of a new message. New messages answer
+// out.ParentID, or the end of the active branch when it is empty.
+func (s *Store) BeginAssistantMessage(chatID, replaceID string, out Message) (string, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != chatID {
-			continue
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return "", errors.New("chat not found")
+	}
+	now := time.Now().UTC()
+	version := MessageVersion{
+		Provider:  out.Provider,
+		Model:     out.Model,
+		TargetID:  out.TargetID,
+		Status:    MessageStatusStreaming,
+		CreatedAt: now,
+	}
+
+	var messageID string
+	if strings.TrimSpace(replaceID) != "" {
+		msgIdx := indexOfMessage(s.data.Chats[i].Messages, replaceID)
+		if msgIdx < 0 {
+			return "", errors.New("message not found")
 		}
-		for j := range s.data.Chats[i].Messages {
-			if s.data.Chats[i].Messages[j].ID != messageID {
-				continue
-			}
-			orig := s.data.Chats[i].Messages[j]
-			if orig.Role != "assistant" {
-				return errors.New("target message is not assistant")
-			}
-			ensureMessageHistory(&orig)
-			s.data.Chats[i].Messages[j].Role = "assistant"
-			s.data.Chats[i].Messages[j].Content = replacement.Content
-			s.data.Chats[i].Messages[j].Provider = replacement.Provider
-			s.data.Chats[i].Messages[j].Model = replacement.Model
-			s.data.Chats[i].Messages[j].TargetID = replacement.TargetID
-			s.data.Chats[i].Messages[j].IsSummary = orig.IsSummary
-			if s.data.Chats[i].Messages[j].IsSummary {
-				s.data.Chats[i].Messages[j].Inclusion = "always"
-				s.data.Chats[i].Messages[j].ScopeID = ""
+		msg := &s.data.Chats[i].Messages[msgIdx]
+		if msg.Role != "assistant" {
+			return "", errors.New("target message is not assistant")
+		}
+		ensureMessageHistory(msg)
+		msg.History = append(msg.History, version)
+		msg.HistoryIndex = len(msg.History) - 1
+		msg.Content = ""
+		msg.Attachments = nil
+		msg.Provider = out.Provider
+		msg.Model = out.Model
+		msg.TargetID = out.TargetID
+		msg.Usage = nil
+		msg.Metrics = nil
+		msg.Status = MessageStatusStreaming
+		msg.Error = ""
+		msg.ErrorStatus = 0
+		if msg.IsSummary {
+			msg.Inclusion = "always"
+			msg.ScopeID = ""
+		} else {
+			msg.Inclusion = out.Inclusion
+			msg.ScopeID = out.ScopeID
+		}
+		if msg.Inclusion == "" {
+			msg.Inclusion = "model_only"
+		}
+		if msg.Inclusion == "model_only" && msg.ScopeID == "" {
+			msg.ScopeID = msg.TargetID
+		}
+		msg.CreatedAt = now
+		messageID = msg.ID
+	} else {
+		out.ID = NewID("msg")
+		if out.ParentID == "" {
+			out.ParentID = activeLeaf(&s.data.Chats[i])
+		}
+		out.Role = "assistant"
+		out.Content = ""
+		out.Status = MessageStatusStreaming
+		if strings.TrimSpace(out.Inclusion) == "" {
+			if out.IsSummary {
+				out.Inclusion = "always"
 			} else {
-				s.data.Chats[i].Messages[j].Inclusion = replacement.Inclusion
-				s.data.Chats[i].Messages[j].ScopeID = replacement.ScopeID
-			}
-			s.data.Chats[i].Messages[j].CreatedAt = time.Now().UTC()
-			if s.data.Chats[i].Messages[j].Inclusion == "" {
-				s.data.Chats[i].Messages[j].Inclusion = "model_only"
-			}
-			if s.data.Chats[i].Messages[j].ScopeID == "" {
-				s.data.Chats[i].Messages[j].ScopeID = s.data.Chats[i].Messages[j].TargetID
+				out.Inclusion = "model_only"
 			}
-			s.data.Chats[i].Messages[j].History = append(orig.History, MessageVersion{
-				Content:   replacement.Content,
-				Provider:  replacement.Provider,
-				Model:     replacement.Model,
-				TargetID:  replacement.TargetID,
-				CreatedAt: time.Now().UTC(),
-			})
-			s.data.Chats[i].Messages[j].HistoryIndex = len(s.data.Chats[i].Messages[j].History) - 1
-			s.data.Chats[i].UpdatedAt = time.Now().UTC()
-			if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
-				return err
-			}
-			return s.persistLocked()
 		}
+		if out.Inclusion == "model_only" && strings.TrimSpace(out.ScopeID) == "" {
+			out.ScopeID = out.TargetID
+		}
+		if out.Inclusion == "always" {
+			out.ScopeID = ""
+		}
+		out.History = []MessageVersion{version}
+		out.HistoryIndex = 0
+		out.CreatedAt = now
+		s.data.Chats[i].Messages = append(s.data.Chats[i].Messages, out)
+		messageID = out.ID
+	}
+
+	s.data.Chats[i].UpdatedAt = now
+	if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
+		return "", err
+	}
+	s.markMessage(chatID, messageID)
+	if err := s.persistLocked(); err != nil {
+		return "", err
+	}
+	return messageID, nil
+}
+
+// CheckpointAssistantMessage writes the output gathered so far into the
+// version opened by BeginAssistantMessage, which is always the newest one.
+func (s *Store) CheckpointAssistantMessage(chatID, messageID string, out Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return errors.New("chat not found")
+	}
+	msgIdx := indexOfMessage(s.data.Chats[i].Messages, messageID)
+	if msgIdx < 0 {
+		return errors.New("message not found")
+	}
+	msg := &s.data.Chats[i].Messages[msgIdx]
+	ensureMessageHistory(msg)
+	last := len(msg.History) - 1
+	msg.History[last].Content = out.Content
+	msg.History[last].Usage = out.Usage
+	msg.History[last].Metrics = out.Metrics
+	msg.History[last].Status = out.Status
+	msg.History[last].Error = out.Error
+	msg.History[last].ErrorStatus = out.ErrorStatus
+	if msg.HistoryIndex == last {
+		msg.Content = out.Content
+		msg.Usage = out.Usage
+		msg.Metrics = out.Metrics
+		msg.Status = out.Status
+		msg.Error = out.Error
+		msg.ErrorStatus = out.ErrorStatus
+	}
+	s.data.Chats[i].UpdatedAt = time.Now().UTC()
+	s.markMessage(chatID, messageID)
+	return s.persistLocked()
+}
+
+// DiscardAssistantMessage drops a placeholder that never received output: the
+// newest version of a regenerated message, or the whole message otherwise.
+func (s *Store) DiscardAssistantMessage(chatID, messageID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return errors.New("chat not found")
+	}
+	msgIdx := indexOfMessage(s.data.Chats[i].Messages, messageID)
+	if msgIdx < 0 {
 		return errors.New("message not found")
 	}
-	return errors.New("chat not found")
+	msg := &s.data.Chats[i].Messages[msgIdx]
+	if len(msg.History) > 1 {
+		msg.History = msg.History[:len(msg.History)-1]
+		if msg.HistoryIndex >= len(msg.History) {
+			msg.HistoryIndex = len(msg.History) - 1
+		}
+		ensureMessageHistory(msg)
+		s.markMessage(chatID, messageID)
+	} else {
+		s.data.Chats[i].Messages = append(s.data.Chats[i].Messages[:msgIdx], s.data.Chats[i].Messages[msgIdx+1:]...)
+		s.markChat(chatID)
+	}
+	s.data.Chats[i].UpdatedAt = time.Now().UTC()
+	return s.persistLocked()
 }
 
-func (s *Store) EditUserMessageInPlace(chatID, messageID, content string, attachments []TextAttachment) (Chat, error) {
+// EditUserMessage adds the edited text as a new branch next to the original
+// user message and makes it active. The original turn and everything after it
+// stay reachable through ListBranches.
+func (s *Store) EditUserMessage(chatID, messageID, content string, attachments []TextAttachment) (Chat, error) {
 	content = strings.TrimSpace(content)
 	if content == "" && len(attachments) == 0 {
 		return Chat{}, errors.New("content is required")
@@ -649,125 +1022,92 @@ func (s *Store) EditUserMessageInPlace(chatID, messageID, content string, attach
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != chatID {
-			continue
-		}
-		msgIdx := indexOfMessage(s.data.Chats[i].Messages, messageID)
-		if msgIdx < 0 {
-			return Chat{}, errors.New("message not found")
-		}
-		if s.data.Chats[i].Messages[msgIdx].Role != "user" {
-			return Chat{}, errors.New("only user messages can be edited")
-		}
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return Chat{}, errors.New("chat not found")
+	}
+	msgIdx := indexOfMessage(s.data.Chats[i].Messages, messageID)
+	if msgIdx < 0 || s.data.Chats[i].Messages[msgIdx].DeletedAt != nil {
+		return Chat{}, errors.New("message not found")
+	}
+	if s.data.Chats[i].Messages[msgIdx].Role != "user" {
+		return Chat{}, errors.New("only user messages can be edited")
+	}
 
-		ensureMessageHistory(&s.data.Chats[i].Messages[msgIdx])
-		s.data.Chats[i].Messages[msgIdx].History = append(s.data.Chats[i].Messages[msgIdx].History, MessageVersion{
+	orig := s.data.Chats[i].Messages[msgIdx]
+	inclusion := orig.Inclusion
+	if inclusion == "" {
+		inclusion = "always"
+	}
+	now := time.Now().UTC()
+	edited := Message{
+		ID:          NewID("msg"),
+		ParentID:    orig.ParentID,
+		Role:        "user",
+		Content:     content,
+		Attachments: cloneAttachments(attachments),
+		Inclusion:   inclusion,
+		ScopeID:     orig.ScopeID,
+		History: []MessageVersion{{
 			Content:     content,
 			Attachments: cloneAttachments(attachments),
-			CreatedAt:   time.Now().UTC(),
-		})
-		s.data.Chats[i].Messages[msgIdx].HistoryIndex = len(s.data.Chats[i].Messages[msgIdx].History) - 1
-		s.data.Chats[i].Messages[msgIdx].Content = content
-		s.data.Chats[i].Messages[msgIdx].Attachments = cloneAttachments(attachments)
-		s.data.Chats[i].Messages[msgIdx].Provider = ""
-		s.data.Chats[i].Messages[msgIdx].Model = ""
-		s.data.Chats[i].Messages[msgIdx].TargetID = ""
-		s.data.Chats[i].Messages[msgIdx].CreatedAt = time.Now().UTC()
-		s.data.Chats[i].Messages = cloneMessages(s.data.Chats[i].Messages[:msgIdx+1])
-		s.data.Chats[i].UpdatedAt = time.Now().UTC()
-		if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
-			return Chat{}, err
-		}
-		if err := s.persistLocked(); err != nil {
-			return Chat{}, err
-		}
-		return s.data.Chats[i], nil
+			CreatedAt:   now,
+		}},
+		CreatedAt: now,
+	}
+	s.data.Chats[i].Messages = append(s.data.Chats[i].Messages, edited)
+	s.data.Chats[i].ActiveLeafID = edited.ID
+	s.data.Chats[i].UpdatedAt = now
+	if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
+		return Chat{}, err
+	}
+	s.markMessage(chatID, edited.ID)
+	if err := s.persistLocked(); err != nil {
+		return Chat{}, err
 	}
-	return Chat{}, errors.New("chat not found")
+	return cloneChat(s.data.Chats[i]), nil
 }
 
-func (s *Store) AppendUserPrompt(chatID, prompt string, attachments []TextAttachment) error {
+// AppendUserPrompt adds a user message at the end of the active branch and
+// returns it.
+func (s *Store) AppendUserPrompt(chatID, prompt string, attachments []TextAttachment) (Message, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != chatID {
-			continue
-		}
-		now := time.Now().UTC()
-		s.data.Chats[i].Messages = append(s.data.Chats[i].Messages, Message{
-			ID:          newID("msg"),
-			Role:        "user",
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return Message{}, errors.New("chat not found")
+	}
+	now := time.Now().UTC()
+	msg := Message{
+		ID:          NewID("msg"),
+		ParentID:    activeLeaf(&s.data.Chats[i]),
+		Role:        "user",
+		Content:     prompt,
+		Attachments: cloneAttachments(attachments),
+		Inclusion:   "always",
+		History: []MessageVersion{{
 			Content:     prompt,
 			Attachments: cloneAttachments(attachments),
-			Inclusion:   "always",
-			History: []MessageVersion{{
-				Content:     prompt,
-				Attachments: cloneAttachments(attachments),
-				CreatedAt:   now,
-			}},
-			HistoryIndex: 0,
-			CreatedAt:    now,
-		})
-		if len(s.data.Chats[i].Messages) == 1 && strings.TrimSpace(s.data.Chats[i].Title) == "New Chat" {
-			s.data.Chats[i].Title = trimTitle(renderPrompt(prompt, attachments))
-		}
-		s.data.Chats[i].UpdatedAt = now
-		if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
-			return err
-		}
-		return s.persistLocked()
+			CreatedAt:   now,
+		}},
+		HistoryIndex: 0,
+		CreatedAt:    now,
 	}
-	return errors.New("chat not found")
-}
-
-func (s *Store) AppendAssistantMessages(chatID string, outputs []Message) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != chatID {
-			continue
-		}
-		now := time.Now().UTC()
-		for _, out := range outputs {
-			if strings.TrimSpace(out.Content) == "" {
-				continue
-			}
-			out.ID = newID("msg")
-			out.Role = "assistant"
-			if strings.TrimSpace(out.Inclusion) == "" {
-				if out.IsSummary {
-					out.Inclusion = "always"
-				} else {
-					out.Inclusion = "model_only"
-				}
-			}
-			if out.Inclusion == "model_only" && strings.TrimSpace(out.ScopeID) == "" {
-				out.ScopeID = out.TargetID
-			}
-			if out.Inclusion == "always" {
-				out.ScopeID = ""
-			}
-			out.History = []MessageVersion{{
-				Content:   out.Content,
-				Provider:  out.Provider,
-				Model:     out.Model,
-				TargetID:  out.TargetID,
-				CreatedAt: now,
-			}}
-			out.HistoryIndex = 0
-			out.CreatedAt = now
-			s.data.Chats[i].Messages = append(s.data.Chats[i].Messages, out)
-		}
-		s.data.Chats[i].UpdatedAt = now
-		if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
-			return err
-		}
-		return s.persistLocked()
+	s.data.Chats[i].Messages = append(s.data.Chats[i].Messages, msg)
+	s.data.Chats[i].ActiveLeafID = msg.ID
+	if len(s.data.Chats[i].Messages) == 1 && strings.TrimSpace(s.data.Chats[i].Title) == "New Chat" {
+		s.data.Chats[i].Title = trimTitle(renderPrompt(prompt, attachments))
+	}
+	s.data.Chats[i].UpdatedAt = now
+	if err := s.touchFolderLocked(s.data.Chats[i].FolderID); err != nil {
+		return Message{}, err
 	}
-	return errors.New("chat not found")
+	s.markMessage(chatID, msg.ID)
+	if err := s.persistLocked(); err != nil {
+		return Message{}, err
+	}
+	return msg, nil
 }
 
 func (s *Store) UpdateMessageInclusion(chatID, messageID, inclusion, scopeID string) (Message, error) {
@@ -779,34 +1119,33 @@ func (s *Store) UpdateMessageInclusion(chatID, messageID, inclusion, scopeID str
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != chatID {
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return Message{}, errors.New("chat not found")
+	}
+	for j := range s.data.Chats[i].Messages {
+		msg := &s.data.Chats[i].Messages[j]
+		if msg.ID != messageID {
 			continue
 		}
-		for j := range s.data.Chats[i].Messages {
-			msg := &s.data.Chats[i].Messages[j]
-			if msg.ID != messageID {
-				continue
-			}
-			msg.Inclusion = inclusion
-			if msg.Inclusion == "model_only" {
-				if strings.TrimSpace(scopeID) != "" {
-					msg.ScopeID = scopeID
-				} else {
-					msg.ScopeID = msg.TargetID
-				}
+		msg.Inclusion = inclusion
+		if msg.Inclusion == "model_only" {
+			if strings.TrimSpace(scopeID) != "" {
+				msg.ScopeID = scopeID
 			} else {
-				msg.ScopeID = ""
-			}
-			s.data.Chats[i].UpdatedAt = time.Now().UTC()
-			if err := s.persistLocked(); err != nil {
-				return Message{}, err
+				msg.ScopeID = msg.TargetID
 			}
-			return *msg, nil
+		} else {
+			msg.ScopeID = ""
+		}
+		s.data.Chats[i].UpdatedAt = time.Now().UTC()
+		s.markMessage(chatID, messageID)
+		if err := s.persistLocked(); err != nil {
+			return Message{}, err
 		}
-		return Message{}, errors.New("message not found")
+		return *msg, nil
 	}
-	return Message{}, errors.New("chat not found")
+	return Message{}, errors.New("message not found")
 }
 
 func (s *Store) SetMessageHistoryIndex(chatID, messageID string, index int) (Message, error) {
@@ -817,38 +1156,57 @@ func (s *Store) SetMessageHistoryIndex(chatID, messageID string, index int) (Mes
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i := range s.data.Chats {
-		if s.data.Chats[i].ID != chatID {
+	i := s.chatIndexLocked(chatID)
+	if i < 0 {
+		return Message{}, errors.New("chat not found")
+	}
+	for j := range s.data.Chats[i].Messages {
+		msg := &s.data.Chats[i].Messages[j]
+		if msg.ID != messageID {
 			continue
 		}
-		for j := range s.data.Chats[i].Messages {
-			msg := &s.data.Chats[i].Messages[j]
-			if msg.ID != messageID {
-				continue
-			}
-			ensureMessageHistory(msg)
-			if index >= len(msg.History) {
-				return Message{}, errors.New("history index out of range")
-			}
-			msg.HistoryIndex = index
-			version := msg.History[index]
-			msg.Content = version.Content
-			msg.Attachments = cloneAttachments(version.Attachments)
-			msg.Provider = version.Provider
-			msg.Model = version.Model
-			msg.TargetID = version.TargetID
-			if msg.Inclusion == "model_only" && msg.Role == "assistant" {
-				msg.ScopeID = msg.TargetID
-			}
-			s.data.Chats[i].UpdatedAt = time.Now().UTC()
-			if err := s.persistLocked(); err != nil {
-				return Message{}, err
-			}
-			return *msg, nil
+		ensureMessageHistory(msg)
+		if index >= len(msg.History) {
+			return Message{}, errors.New("history index out of range")
+		}
+		msg.HistoryIndex = index
+		version := msg.History[index]
+		msg.Content = version.Content
+		msg.Attachments = cloneAttachments(version.Attachments)
+		msg.Provider = version.Provider
+		msg.Model = version.Model
+		msg.TargetID = version.TargetID
+		msg.Usage = version.Usage
+		msg.Metrics = version.Metrics
+		msg.Status = version.Status
+		msg.Error = version.Error
+		msg.ErrorStatus = version.ErrorStatus
+		if msg.Inclusion == "model_only" && msg.Role == "assistant" {
+			msg.ScopeID = msg.TargetID
+		}
+		s.data.Chats[i].UpdatedAt = time.Now().UTC()
+		s.markMessage(chatID, messageID)
+		if err := s.persistLocked(); err != nil {
+			return Message{}, err
+		}
+		return *msg, nil
+	}
+	return Message{}, errors.New("message not found")
+}
+
+// ResponseLabel is the "provider · model" header shown above a response.
+func ResponseLabel(provider, model string) string {
+	label := strings.TrimSpace(provider)
+	if strings.TrimSpace(model) != "" {
+		if label != "" {
+			label += " · "
 		}
-		return Message{}, errors.New("message not found")
+		label += strings.TrimSpace(model)
 	}
-	return Message{}, errors.New("chat not found")
+	if label == "" {
+		label = "assistant"
+	}
+	return label
 }
 
 func normalizeInclusion(v string) string {
@@ -869,14 +1227,86 @@ func indexOfMessage(messages []Message, messageID string) int {
 	return -1
 }
 
+// cloneMessages also copies the per-message slices, since runs keep updating
+// the stored messages in place while callers read their copies.
 func cloneMessages(messages []Message) []Message {
 	out := make([]Message, 0, len(messages))
 	for _, m := range messages {
+		m.Attachments = cloneAttachments(m.Attachments)
+		if m.History != nil {
+			m.History = append([]MessageVersion(nil), m.History...)
+		}
 		out = append(out, m)
 	}
 	return out
 }
 
+// cloneChat returns the active branch only. Other branches are reachable
+// through ListBranches, trashed messages through the trash.
+func cloneChat(c Chat) Chat {
+	c.ActiveLeafID = activeLeaf(&c)
+	c.Messages = cloneMessages(ActivePath(c.Messages, c.ActiveLeafID))
+	c.Targets = cloneTargets(c.Targets)
+	c.Variables = cloneVariables(c.Variables)
+	return c
+}
+
+func cloneChatTree(c Chat) Chat {
+	c.ActiveLeafID = activeLeaf(&c)
+	c.Messages = cloneMessages(c.Messages)
+	c.Targets = cloneTargets(c.Targets)
+	c.Variables = cloneVariables(c.Variables)
+	return c
+}
+
+func cloneTargets(targets []providers.Target) []providers.Target {
+	if targets == nil {
+		return nil
+	}
+	out := make([]providers.Target, len(targets))
+	for i, t := range targets {
+		if t.Temperature != nil {
+			v := *t.Temperature
+			t.Temperature = &v
+		}
+		out[i] = t
+	}
+	return out
+}
+
+// NormalizeTargets validates targets and drops repeats of a provider:model,
+// which would share one message, one stream and one cancel; an empty list
+// stays empty.
+func NormalizeTargets(targets []providers.Target) ([]providers.Target, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	out := make([]providers.Target, 0, len(targets))
+	seen := map[string]bool{}
+	for _, t := range cloneTargets(targets) {
+		t.Provider = strings.ToLower(strings.TrimSpace(t.Provider))
+		t.Model = strings.TrimSpace(t.Model)
+		if t.Provider == "" || t.Model == "" {
+			return nil, errors.New("each target needs provider and model")
+		}
+		if id := t.Provider + ":" + t.Model; !seen[id] {
+			seen[id] = true
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+func liveMessages(messages []Message) []Message {
+	out := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		if m.DeletedAt == nil {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
 func ensureMessageHistory(msg *Message) {
 	if msg == nil {
 		return
@@ -888,6 +1318,11 @@ func ensureMessageHistory(msg *Message) {
 			Provider:    msg.Provider,
 			Model:       msg.Model,
 			TargetID:    msg.TargetID,
+			Usage:       msg.Usage,
+			Metrics:     msg.Metrics,
+			Status:      msg.Status,
+			Error:       msg.Error,
+			ErrorStatus: msg.ErrorStatus,
 			CreatedAt:   msg.CreatedAt,
 		}}
 		msg.HistoryIndex = 0
@@ -901,21 +1336,27 @@ func ensureMessageHistory(msg *Message) {
 	msg.Provider = current.Provider
 	msg.Model = current.Model
 	msg.TargetID = current.TargetID
+	msg.Usage = current.Usage
+	msg.Metrics = current.Metrics
+	msg.Status = current.Status
+	msg.Error = current.Error
+	msg.ErrorStatus = current.ErrorStatus
 }
 
 func (s *Store) touchFolderLocked(folderID string) error {
 	for i := range s.data.Folders {
 		if s.data.Folders[i].ID == folderID {
 			s.data.Folders[i].UpdatedAt = time.Now().UTC()
+			s.markFolder(folderID)
 			return nil
 		}
 	}
-	return errors.New("folder not found")
+	return ErrFolderNotFound
 }
 
 func (s *Store) folderExistsLocked(folderID string) bool {
 	for i := range s.data.Folders {
-		if s.data.Folders[i].ID == folderID {
+		if s.data.Folders[i].ID == folderID && s.data.Folders[i].DeletedAt == nil {
 			return true
 		}
 	}
@@ -969,7 +1410,3 @@ func cloneAttachments(src []TextAttachment) []TextAttachment {
 	out = append(out, src...)
 	return out
 }
-
-func newID(prefix string) string {
-	return fmt.Sprintf("%s_%d", prefix, time.Now().UnixNano())
-}
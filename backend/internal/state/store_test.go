@@ -0,0 +1,98 @@
+package state
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"llm-mux/backend/internal/providers"
+)
+
+func TestNormalizeTargets(t *testing.T) {
+	got, err := NormalizeTargets([]providers.Target{
+		{Provider: " OpenRouter ", Model: " a/b "},
+		{Provider: "ollama", Model: "llama3"},
+		{Provider: "openrouter", Model: "a/b", SystemPrompt: "repeat"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Provider != "openrouter" || got[0].Model != "a/b" || got[0].SystemPrompt != "" || got[1].Model != "llama3" {
+		t.Fatalf("targets = %+v", got)
+	}
+	if _, err := NormalizeTargets([]providers.Target{{Provider: "ollama"}}); err == nil {
+		t.Fatal("target without model accepted")
+	}
+}
+
+func TestPrepareAssistantRegenerateImported(t *testing.T) {
+	s := newTestStore(t)
+	chats, err := s.ImportChats(s.ListFolders()[0].ID, []Chat{{
+		Title: "Imported",
+		Messages: []Message{
+			{ID: "u1", Role: "user", Content: "q"},
+			{ID: "a1", ParentID: "u1", Role: "assistant", Content: "a", Model: "gpt-4o"},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := s.PrepareAssistantRegenerate(chats[0].ID, "a1"); !errors.Is(err, ErrImportedMessage) {
+		t.Fatalf("err = %v, want ErrImportedMessage", err)
+	}
+}
+
+func TestBuildCompactionPrompt(t *testing.T) {
+	s := newTestStore(t)
+	chat, err := s.CreateChat(s.ListFolders()[0].ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	c := &s.data.Chats[s.chatIndexLocked(chat.ID)]
+	c.Messages = []Message{
+		{ID: "u1", Role: "user", Content: "q1"},
+		{ID: "a1", ParentID: "u1", Role: "assistant", Content: "r1", Provider: "p", Model: "one"},
+		{ID: "b1", ParentID: "u1", Role: "assistant", Content: "r1b", Provider: "p", Model: "two"},
+		{ID: "e1", ParentID: "u1", Role: "assistant", Content: "boom", Status: MessageStatusError},
+		{ID: "u2", ParentID: "u1", Role: "user", Content: "q2"},
+		{ID: "a2", ParentID: "u2", Role: "assistant", Content: "r2"},
+		{ID: "s2", ParentID: "u2", Role: "assistant", Content: "sum2", IsSummary: true, Compaction: true},
+		{ID: "u3", ParentID: "u2", Role: "user", Content: "q3"},
+		{ID: "a3", ParentID: "u3", Role: "assistant", Content: "r3"},
+	}
+	s.mu.Unlock()
+
+	tests := []struct {
+		name    string
+		from    string
+		leaf    string
+		want    []string
+		notWant []string
+	}{
+		{"from the start", "", "u2", []string{"q1", "r1", "r1b", "q2", "r2"}, []string{"boom", "sum2", "q3"}},
+		{"from a user message", "u2", "u2", []string{"q2", "r2"}, []string{"q1", "sum2"}},
+		{"from a compaction summary", "s2", "u3", []string{"earlier conversation:\nsum2", "q3", "r3"}, []string{"q1", "q2", "r2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt, err := s.BuildCompactionPrompt(chat.ID, tt.from, tt.leaf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(prompt, want) {
+					t.Errorf("prompt lacks %q:\n%s", want, prompt)
+				}
+			}
+			for _, not := range tt.notWant {
+				if strings.Contains(prompt, not) {
+					t.Errorf("prompt has %q:\n%s", not, prompt)
+				}
+			}
+		})
+	}
+	if _, err := s.BuildCompactionPrompt(chat.ID, "", "missing"); err == nil {
+		t.Fatal("no turns: no error")
+	}
+}
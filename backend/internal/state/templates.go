@@ -0,0 +1,268 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PromptTemplate is a reusable prompt with {{name}} placeholders.
+type PromptTemplate struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Body string `json:"body"`
+	// Defaults fill placeholders the caller leaves out.
+	Defaults map[string]string `json:"defaults,omitempty"`
+	// FolderID limits the template to a folder and its subfolders; empty
+	// templates are available everywhere.
+	FolderID string `json:"folderId,omitempty"`
+	// Variables lists the placeholders in Body; it is filled on read and not
+	// stored.
+	Variables []string  `json:"variables,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ListTemplates returns the templates usable in a folder: global ones and
+// those scoped to the folder or one of its ancestors. An empty folderID lists
+// every template.
+func (s *Store) ListTemplates(folderID string) []PromptTemplate {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var scope map[string]bool
+	if folderID != "" {
+		scope = map[string]bool{"": true}
+		for _, idx := range s.folderAncestryLocked(folderID) {
+			scope[s.data.Folders[idx].ID] = true
+		}
+	}
+	templates := []PromptTemplate{}
+	for _, t := range s.data.Templates {
+		if scope == nil || scope[t.FolderID] {
+			templates = append(templates, describeTemplate(t))
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool {
+		return strings.ToLower(templates[i].Name) < strings.ToLower(templates[j].Name)
+	})
+	return templates
+}
+
+func (s *Store) FindTemplate(id string) (PromptTemplate, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if idx := s.templateIndexLocked(id); idx >= 0 {
+		return describeTemplate(s.data.Templates[idx]), true
+	}
+	return PromptTemplate{}, false
+}
+
+func (s *Store) CreateTemplate(folderID, name, body string, defaults map[string]string) (PromptTemplate, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return PromptTemplate{}, errors.New("name is required")
+	}
+	if strings.TrimSpace(body) == "" {
+		return PromptTemplate{}, errors.New("body is required")
+	}
+	folderID = strings.TrimSpace(folderID)
+	now := time.Now().UTC()
+	tmpl := PromptTemplate{ID: NewID("tpl"), Name: name, Body: body, Defaults: normalizeVariables(defaults), FolderID: folderID, CreatedAt: now, UpdatedAt: now}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if folderID != "" && !s.folderExistsLocked(folderID) {
+		return PromptTemplate{}, ErrFolderNotFound
+	}
+	s.data.Templates = append(s.data.Templates, tmpl)
+	s.markTemplate(tmpl.ID)
+	if err := s.persistLocked(); err != nil {
+		return PromptTemplate{}, err
+	}
+	return describeTemplate(tmpl), nil
+}
+
+// UpdateTemplate replaces a template's body, defaults and scope; an empty name
+// keeps the current one.
+func (s *Store) UpdateTemplate(id, folderID, name, body string, defaults map[string]string) (PromptTemplate, error) {
+	if strings.TrimSpace(body) == "" {
+		return PromptTemplate{}, errors.New("body is required")
+	}
+	folderID = strings.TrimSpace(folderID)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.templateIndexLocked(id)
+	if idx < 0 {
+		return PromptTemplate{}, errors.New("template not found")
+	}
+	if folderID != "" && !s.folderExistsLocked(folderID) {
+		return PromptTemplate{}, ErrFolderNotFound
+	}
+	t := &s.data.Templates[idx]
+	if strings.TrimSpace(name) != "" {
+		t.Name = strings.TrimSpace(name)
+	}
+	t.Body = body
+	t.Defaults = normalizeVariables(defaults)
+	t.FolderID = folderID
+	t.UpdatedAt = time.Now().UTC()
+	s.markTemplate(id)
+	if err := s.persistLocked(); err != nil {
+		return PromptTemplate{}, err
+	}
+	return describeTemplate(*t), nil
+}
+
+func (s *Store) DeleteTemplate(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	idx := s.templateIndexLocked(id)
+	if idx < 0 {
+		return errors.New("template not found")
+	}
+	s.data.Templates = append(s.data.Templates[:idx], s.data.Templates[idx+1:]...)
+	s.markTemplate(id)
+	return s.persistLocked()
+}
+
+// RenderTemplate fills a template's placeholders. Values come from vars, then
+// the chat's variables when chatID is given, then the template defaults; a
+// placeholder left without a value is an error.
+func (s *Store) RenderTemplate(id, chatID string, vars map[string]string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	idx := s.templateIndexLocked(id)
+	if idx < 0 {
+		return "", errors.New("template not found")
+	}
+	t := s.data.Templates[idx]
+	values := cloneVariables(t.Defaults)
+	if values == nil {
+		values = map[string]string{}
+	}
+	if chatID != "" {
+		i := s.chatIndexLocked(chatID)
+		if i < 0 || s.data.Chats[i].DeletedAt != nil {
+			return "", errors.New("chat not found")
+		}
+		for k, v := range s.data.Chats[i].Variables {
+			values[k] = v
+		}
+	}
+	for k, v := range normalizeVariables(vars) {
+		values[k] = v
+	}
+	rendered, missing := ExpandVariables(t.Body, values)
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing values for: %s", strings.Join(missing, ", "))
+	}
+	return rendered, nil
+}
+
+// ExpandVariables replaces {{name}} placeholders with their values. Unknown
+// placeholders are left in place and returned as missing.
+func ExpandVariables(text string, vars map[string]string) (string, []string) {
+	var out strings.Builder
+	var missing []string
+	seen := map[string]bool{}
+	rest := text
+	for {
+		start := strings.Index(rest, "{{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start+2:], "}}")
+		if end < 0 {
+			break
+		}
+		out.WriteString(rest[:start])
+		raw := rest[start : start+2+end+2]
+		rest = rest[start+2+end+2:]
+
+		name := strings.TrimSpace(raw[2 : len(raw)-2])
+		if !validVariableName(name) {
+			out.WriteString(raw)
+			continue
+		}
+		if v, ok := vars[name]; ok {
+			out.WriteString(v)
+			continue
+		}
+		out.WriteString(raw)
+		if !seen[name] {
+			seen[name] = true
+			missing = append(missing, name)
+		}
+	}
+	out.WriteString(rest)
+	return out.String(), missing
+}
+
+// TemplateVariables lists the placeholder names in text in order of first use.
+func TemplateVariables(text string) []string {
+	_, names := ExpandVariables(text, nil)
+	return names
+}
+
+func validVariableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-', r == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func describeTemplate(t PromptTemplate) PromptTemplate {
+	t.Defaults = cloneVariables(t.Defaults)
+	t.Variables = TemplateVariables(t.Body)
+	return t
+}
+
+func (s *Store) templateIndexLocked(id string) int {
+	for i := range s.data.Templates {
+		if s.data.Templates[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalizeVariables drops entries without a valid name; an empty map clears.
+func normalizeVariables(vars map[string]string) map[string]string {
+	var out map[string]string
+	for k, v := range vars {
+		k = strings.TrimSpace(k)
+		if !validVariableName(k) {
+			continue
+		}
+		if out == nil {
+			out = map[string]string{}
+		}
+		out[k] = v
+	}
+	return out
+}
+
+func cloneVariables(vars map[string]string) map[string]string {
+	if vars == nil {
+		return nil
+	}
+	out := make(map[string]string, len(vars))
+	for k, v := range vars {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,38 @@
+package state
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandVariables(t *testing.T) {
+	vars := map[string]string{"name": "Ada", "lang": "Go", "empty": "", "self": "{{self}}"}
+	tests := []struct {
+		name    string
+		text    string
+		want    string
+		missing []string
+	}{
+		{"plain text", "no placeholders", "no placeholders", nil},
+		{"replaced", "Hi {{name}}, write {{lang}}.", "Hi Ada, write Go.", nil},
+		{"spaces inside braces", "{{ name }}", "Ada", nil},
+		{"empty value", "[{{empty}}]", "[]", nil},
+		{"missing kept and listed once", "{{who}} and {{who}} or {{what}}", "{{who}} and {{who}} or {{what}}", []string{"who", "what"}},
+		{"invalid name left alone", "{{not valid}} {{a/b}} {{}}", "{{not valid}} {{a/b}} {{}}", nil},
+		{"unclosed", "Hi {{name", "Hi {{name", nil},
+		{"value is not expanded again", "{{self}}", "{{self}}", nil},
+		{"adjacent", "{{name}}{{lang}}", "AdaGo", nil},
+		{"dots and dashes", "{{user.first-name}}", "{{user.first-name}}", []string{"user.first-name"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, missing := ExpandVariables(tt.text, vars)
+			if got != tt.want {
+				t.Fatalf("text = %q, want %q", got, tt.want)
+			}
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Fatalf("missing = %v, want %v", missing, tt.missing)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+type TrashedMessage struct {
+	ChatID    string  `json:"chatId"`
+	ChatTitle string  `json:"chatTitle"`
+	Message   Message `json:"message"`
+}
+
+type Trash struct {
+	Folders  []Folder         `json:"folders"`
+	Chats    []Chat           `json:"chats"`
+	Messages []TrashedMessage `json:"messages"`
+}
+
+// DeleteFolder moves a folder, its subfolders and their chats to the trash.
+func (s *Store) DeleteFolder(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.folderExistsLocked(id) {
+		return ErrFolderNotFound
+	}
+	subtree := s.folderSubtreeLocked(id)
+	remaining := 0
+	for _, f := range s.data.Folders {
+		if f.DeletedAt == nil && !subtree[f.ID] {
+			remaining++
+		}
+	}
+	if remaining == 0 {
+		return errors.New("cannot delete the last folder")
+	}
+
+	now := time.Now().UTC()
+	for i := range s.data.Folders {
+		if !subtree[s.data.Folders[i].ID] || s.data.Folders[i].DeletedAt != nil {
+			continue
+		}
+		s.data.Folders[i].DeletedAt = &now
+		s.markFolder(s.data.Folders[i].ID)
+	}
+	for i := range s.data.Chats {
+		if !subtree[s.data.Chats[i].FolderID] || s.data.Chats[i].DeletedAt != nil {
+			continue
+		}
+		s.data.Chats[i].DeletedAt = &now
+		s.data.Chats[i].TrashedWithFolder = true
+		s.markChat(s.data.Chats[i].ID)
+	}
+	return s.persistLocked()
+}
+
+// RestoreFolder brings a folder back together with the subfolders and chats
+// that were trashed along with it. A folder whose parent is still in the trash
+// is restored to the top level.
+func (s *Store) RestoreFolder(id string) (Folder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.data.Folders {
+		if s.data.Folders[i].ID != id || s.data.Folders[i].DeletedAt == nil {
+			continue
+		}
+		deletedAt := *s.data.Folders[i].DeletedAt
+		// Subfolders trashed on their own earlier stay in the trash, and so
+		// does everything below them.
+		restored := map[string]bool{}
+		for sub := range s.folderSubtreeLocked(id) {
+			together := true
+			for _, idx := range s.folderAncestryLocked(sub) {
+				if deleted := s.data.Folders[idx].DeletedAt; deleted == nil || !deleted.Equal(deletedAt) {
+					together = false
+					break
+				}
+				if s.data.Folders[idx].ID == id {
+					break
+				}
+			}
+			restored[sub] = together
+		}
+
+		now := time.Now().UTC()
+		if parent := s.data.Folders[i].ParentID; parent != "" && !s.folderExistsLocked(parent) {
+			s.data.Folders[i].ParentID = ""
+		}
+		for j := range s.data.Folders {
+			if restored[s.data.Folders[j].ID] {
+				s.data.Folders[j].DeletedAt = nil
+				s.data.Folders[j].UpdatedAt = now
+				s.markFolder(s.data.Folders[j].ID)
+			}
+		}
+		for j := range s.data.Chats {
+			if restored[s.data.Chats[j].FolderID] && s.data.Chats[j].TrashedWithFolder {
+				s.data.Chats[j].DeletedAt = nil
+				s.data.Chats[j].TrashedWithFolder = false
+				s.markChat(s.data.Chats[j].ID)
+			}
+		}
+		if err := s.persistLocked(); err != nil {
+			return Folder{}, err
+		}
+		return s.data.Folders[i], nil
+	}
+	return Folder{}, errors.New("folder not found in trash")
+}
+
+func (s *Store) DeleteChat(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(id)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return errors.New("chat not found")
+	}
+	now := time.Now().UTC()
+	s.data.Chats[i].DeletedAt = &now
+	s.data.Chats[i].TrashedWithFolder = false
+	s.markChat(id)
+	return s.persistLocked()
+}
+
+// RestoreChat restores a chat into its original folder, or into folderID when
+// given (needed when the original folder is itself in the trash).
+func (s *Store) RestoreChat(id, folderID string) (Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(id)
+	if i < 0 || s.data.Chats[i].DeletedAt == nil {
+		return Chat{}, errors.New("chat not found in trash")
+	}
+	if strings.TrimSpace(folderID) == "" {
+		folderID = s.data.Chats[i].FolderID
+	}
+	if !s.folderExistsLocked(folderID) {
+		return Chat{}, errors.New("folder not found; restore the folder or pick another one")
+	}
+	s.data.Chats[i].FolderID = folderID
+	s.data.Chats[i].DeletedAt = nil
+	s.data.Chats[i].TrashedWithFolder = false
+	s.data.Chats[i].UpdatedAt = time.Now().UTC()
+	if err := s.touchFolderLocked(folderID); err != nil {
+		return Chat{}, err
+	}
+	s.markChat(id)
+	if err := s.persistLocked(); err != nil {
+		return Chat{}, err
+	}
+	return cloneChat(s.data.Chats[i]), nil
+}
+
+// DeleteMessage trashes a message. Deleting a user message also trashes its
+// responses, so the turn can be restored as a whole. Later turns stay on the
+// branch.
+func (s *Store) DeleteMessage(chatID, messageID string) (Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(chatID)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return Chat{}, errors.New("chat not found")
+	}
+	messages := s.data.Chats[i].Messages
+	msgIdx := indexOfMessage(messages, messageID)
+	if msgIdx < 0 || messages[msgIdx].DeletedAt != nil {
+		return Chat{}, errors.New("message not found")
+	}
+
+	now := time.Now().UTC()
+	messages[msgIdx].DeletedAt = &now
+	s.markMessage(chatID, messageID)
+	if messages[msgIdx].Role == "user" {
+		for _, j := range responsesOf(messages, messageID) {
+			if messages[j].DeletedAt == nil {
+				messages[j].DeletedAt = &now
+				s.markMessage(chatID, messages[j].ID)
+			}
+		}
+	}
+	s.data.Chats[i].UpdatedAt = now
+	if err := s.persistLocked(); err != nil {
+		return Chat{}, err
+	}
+	return cloneChat(s.data.Chats[i]), nil
+}
+
+// RestoreMessage restores a message and everything trashed in the same
+// delete, e.g. the responses that went with a user message.
+func (s *Store) RestoreMessage(chatID, messageID string) (Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(chatID)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return Chat{}, errors.New("chat not found")
+	}
+	messages := s.data.Chats[i].Messages
+	msgIdx := indexOfMessage(messages, messageID)
+	if msgIdx < 0 || messages[msgIdx].DeletedAt == nil {
+		return Chat{}, errors.New("message not found in trash")
+	}
+
+	deletedAt := *messages[msgIdx].DeletedAt
+	userID := turnOf(messages, msgIdx)
+	if userIdx := indexOfMessage(messages, userID); userIdx >= 0 && sameDeletion(messages[userIdx], deletedAt) {
+		messages[userIdx].DeletedAt = nil
+		s.markMessage(chatID, userID)
+		for _, j := range responsesOf(messages, userID) {
+			if sameDeletion(messages[j], deletedAt) {
+				messages[j].DeletedAt = nil
+				s.markMessage(chatID, messages[j].ID)
+			}
+		}
+	} else {
+		messages[msgIdx].DeletedAt = nil
+		s.markMessage(chatID, messageID)
+	}
+	s.data.Chats[i].UpdatedAt = time.Now().UTC()
+	if err := s.persistLocked(); err != nil {
+		return Chat{}, err
+	}
+	return cloneChat(s.data.Chats[i]), nil
+}
+
+func sameDeletion(msg Message, deletedAt time.Time) bool {
+	return msg.DeletedAt != nil && msg.DeletedAt.Equal(deletedAt)
+}
+
+func (s *Store) ListTrash() Trash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trash := Trash{
+		Folders:  []Folder{},
+		Chats:    []Chat{},
+		Messages: []TrashedMessage{},
+	}
+	for _, f := range s.data.Folders {
+		if f.DeletedAt != nil {
+			trash.Folders = append(trash.Folders, f)
+		}
+	}
+	for _, c := range s.data.Chats {
+		if c.DeletedAt != nil {
+			chat := c
+			chat.Messages = cloneMessages(c.Messages)
+			trash.Chats = append(trash.Chats, chat)
+			continue
+		}
+		for _, m := range c.Messages {
+			if m.DeletedAt != nil {
+				trash.Messages = append(trash.Messages, TrashedMessage{ChatID: c.ID, ChatTitle: c.Title, Message: cloneMessages([]Message{m})[0]})
+			}
+		}
+	}
+
+	sort.Slice(trash.Folders, func(i, j int) bool { return trash.Folders[i].DeletedAt.After(*trash.Folders[j].DeletedAt) })
+	sort.Slice(trash.Chats, func(i, j int) bool { return trash.Chats[i].DeletedAt.After(*trash.Chats[j].DeletedAt) })
+	sort.Slice(trash.Messages, func(i, j int) bool {
+		return trash.Messages[i].Message.DeletedAt.After(*trash.Messages[j].Message.DeletedAt)
+	})
+	return trash
+}
+
+// PurgeTrash permanently removes everything trashed before the given time and
+// returns the number of removed items.
+func (s *Store) PurgeTrash(before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := func(t *time.Time) bool { return t != nil && t.Before(before) }
+	removed := 0
+
+	folders := s.data.Folders[:0]
+	purgedFolders := map[string]bool{}
+	for _, f := range s.data.Folders {
+		if expired(f.DeletedAt) {
+			purgedFolders[f.ID] = true
+			s.markFolder(f.ID)
+			removed++
+			continue
+		}
+		folders = append(folders, f)
+	}
+	s.data.Folders = folders
+	for i := range s.data.Folders {
+		if purgedFolders[s.data.Folders[i].ParentID] {
+			s.data.Folders[i].ParentID = ""
+			s.markFolder(s.data.Folders[i].ID)
+		}
+	}
+	// Templates outlive their folder and become available everywhere.
+	for i := range s.data.Templates {
+		if purgedFolders[s.data.Templates[i].FolderID] {
+			s.data.Templates[i].FolderID = ""
+			s.markTemplate(s.data.Templates[i].ID)
+		}
+	}
+
+	chats := s.data.Chats[:0]
+	for _, c := range s.data.Chats {
+		// Chats in a purged folder have nowhere left to be restored to.
+		if expired(c.DeletedAt) || (c.DeletedAt != nil && purgedFolders[c.FolderID]) {
+			s.markChat(c.ID)
+			removed++
+			continue
+		}
+		purgedParents := map[string]string{}
+		messages := c.Messages[:0]
+		for _, m := range c.Messages {
+			if expired(m.DeletedAt) {
+				purgedParents[m.ID] = m.ParentID
+				s.markChat(c.ID)
+				removed++
+				continue
+			}
+			messages = append(messages, m)
+		}
+		// Keep the tree connected: hang children of purged messages onto the
+		// nearest surviving ancestor.
+		for j := range messages {
+			for seen := 0; seen <= len(purgedParents); seen++ {
+				parent, purged := purgedParents[messages[j].ParentID]
+				if !purged {
+					break
+				}
+				messages[j].ParentID = parent
+			}
+		}
+		if _, purged := purgedParents[c.ActiveLeafID]; purged {
+			c.ActiveLeafID = ""
+		}
+		c.Messages = messages
+		chats = append(chats, c)
+	}
+	s.data.Chats = chats
+	s.reindexChatsLocked()
+
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, s.persistLocked()
+}
@@ -0,0 +1,41 @@
+package state
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := New(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestDeleteFolderErrors(t *testing.T) {
+	s := newTestStore(t)
+	general := s.ListFolders()[0]
+
+	if err := s.DeleteFolder("fld_missing"); !errors.Is(err, ErrFolderNotFound) {
+		t.Fatalf("missing folder: err = %v, want ErrFolderNotFound", err)
+	}
+	err := s.DeleteFolder(general.ID)
+	if err == nil || errors.Is(err, ErrFolderNotFound) {
+		t.Fatalf("last folder: err = %v, want the last-folder error", err)
+	}
+
+	other, err := s.CreateFolder("", "Other", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteFolder(other.ID); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := s.DeleteFolder(other.ID); !errors.Is(err, ErrFolderNotFound) {
+		t.Fatalf("deleted folder: err = %v, want ErrFolderNotFound", err)
+	}
+}
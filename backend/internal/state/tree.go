@@ -0,0 +1,221 @@
+package state
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// Chats are message trees. A user message's parent is the user message of the
+// previous turn (empty for the first turn); responses point at the user message
+// they answer. Several user messages with the same parent are branches, and
+// Chat.ActiveLeafID picks the user message that ends the active path.
+
+// Branch is one alternative user message at a branch point.
+type Branch struct {
+	MessageID string    `json:"messageId"`
+	Preview   string    `json:"preview"`
+	CreatedAt time.Time `json:"createdAt"`
+	// LeafID is the user message the path ends at when this branch is activated.
+	LeafID string `json:"leafId"`
+	Active bool   `json:"active"`
+}
+
+// ActivePath returns the live messages on the path from the root to the turn
+// of leafID: each user message followed by its responses. Trashed user
+// messages are walked through but left out. An empty leafID yields only the
+// responses that precede the first user message.
+func ActivePath(messages []Message, leafID string) []Message {
+	byID := make(map[string]int, len(messages))
+	for i := range messages {
+		byID[messages[i].ID] = i
+	}
+
+	var users []int
+	seen := map[string]bool{}
+	for id := leafID; id != "" && !seen[id]; {
+		seen[id] = true
+		idx, ok := byID[id]
+		if !ok || messages[idx].Role != "user" {
+			break
+		}
+		users = append(users, idx)
+		id = messages[idx].ParentID
+	}
+
+	responses := map[string][]int{}
+	for i := range messages {
+		if messages[i].Role != "user" {
+			responses[messages[i].ParentID] = append(responses[messages[i].ParentID], i)
+		}
+	}
+
+	path := make([]Message, 0, len(messages))
+	appendLive := func(idx int) {
+		if messages[idx].DeletedAt == nil {
+			path = append(path, messages[idx])
+		}
+	}
+	for _, idx := range responses[""] {
+		appendLive(idx)
+	}
+	for i := len(users) - 1; i >= 0; i-- {
+		appendLive(users[i])
+		for _, idx := range responses[messages[users[i]].ID] {
+			appendLive(idx)
+		}
+	}
+	return path
+}
+
+// activeLeaf resolves the user message the active path ends at. A stale or
+// missing ActiveLeafID falls back to the newest branch.
+func activeLeaf(c *Chat) string {
+	if idx := indexOfMessage(c.Messages, c.ActiveLeafID); idx >= 0 && c.Messages[idx].Role == "user" {
+		return c.ActiveLeafID
+	}
+	last := ""
+	for i := len(c.Messages) - 1; i >= 0; i-- {
+		if c.Messages[i].Role != "user" {
+			continue
+		}
+		if c.Messages[i].DeletedAt == nil {
+			return descendLeaf(c.Messages, c.Messages[i].ID)
+		}
+		if last == "" {
+			last = c.Messages[i].ID
+		}
+	}
+	if last == "" {
+		return ""
+	}
+	return descendLeaf(c.Messages, last)
+}
+
+// descendLeaf follows the newest child turn from id until it reaches a leaf,
+// preferring children that are not in the trash.
+func descendLeaf(messages []Message, id string) string {
+	seen := map[string]bool{}
+	for !seen[id] {
+		seen[id] = true
+		next := ""
+		for i := len(messages) - 1; i >= 0; i-- {
+			m := messages[i]
+			if m.Role != "user" || m.ParentID != id {
+				continue
+			}
+			if m.DeletedAt == nil {
+				next = m.ID
+				break
+			}
+			if next == "" {
+				next = m.ID
+			}
+		}
+		if next == "" {
+			return id
+		}
+		id = next
+	}
+	return id
+}
+
+// turnOf returns the user message a message belongs to: itself for user
+// messages, the parent for responses.
+func turnOf(messages []Message, idx int) string {
+	if messages[idx].Role == "user" {
+		return messages[idx].ID
+	}
+	return messages[idx].ParentID
+}
+
+// responsesOf returns the indexes of the responses to a user message.
+func responsesOf(messages []Message, userID string) []int {
+	var out []int
+	for i := range messages {
+		if messages[i].Role != "user" && messages[i].ParentID == userID {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// linkLinear sets parent IDs from slice order, for conversations that were
+// stored as a flat list. It returns the last user message.
+func linkLinear(messages []Message) string {
+	prevUser := ""
+	for i := range messages {
+		messages[i].ParentID = prevUser
+		if messages[i].Role == "user" {
+			prevUser = messages[i].ID
+		}
+	}
+	return prevUser
+}
+
+func (s *Store) ListBranches(chatID, messageID string) ([]Branch, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	i := s.chatIndexLocked(chatID)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return nil, errors.New("chat not found")
+	}
+	c := &s.data.Chats[i]
+	msgIdx := indexOfMessage(c.Messages, messageID)
+	if msgIdx < 0 || c.Messages[msgIdx].DeletedAt != nil {
+		return nil, errors.New("message not found")
+	}
+	userIdx := indexOfMessage(c.Messages, turnOf(c.Messages, msgIdx))
+	if userIdx < 0 {
+		return nil, errors.New("message has no user turn")
+	}
+
+	onPath := map[string]bool{}
+	for _, m := range ActivePath(c.Messages, activeLeaf(c)) {
+		onPath[m.ID] = true
+	}
+	parentID := c.Messages[userIdx].ParentID
+	branches := []Branch{}
+	for _, m := range c.Messages {
+		if m.Role != "user" || m.ParentID != parentID || m.DeletedAt != nil {
+			continue
+		}
+		branches = append(branches, Branch{
+			MessageID: m.ID,
+			Preview:   trimTitle(renderPrompt(m.Content, m.Attachments)),
+			CreatedAt: m.CreatedAt,
+			LeafID:    descendLeaf(c.Messages, m.ID),
+			Active:    onPath[m.ID],
+		})
+	}
+	return branches, nil
+}
+
+// SwitchBranch makes the branch containing messageID active, continuing along
+// the newest turns below it.
+func (s *Store) SwitchBranch(chatID, messageID string) (Chat, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.chatIndexLocked(chatID)
+	if i < 0 || s.data.Chats[i].DeletedAt != nil {
+		return Chat{}, errors.New("chat not found")
+	}
+	c := &s.data.Chats[i]
+	msgIdx := indexOfMessage(c.Messages, strings.TrimSpace(messageID))
+	if msgIdx < 0 || c.Messages[msgIdx].DeletedAt != nil {
+		return Chat{}, errors.New("message not found")
+	}
+	userID := turnOf(c.Messages, msgIdx)
+	if userID == "" {
+		return Chat{}, errors.New("message has no user turn")
+	}
+	c.ActiveLeafID = descendLeaf(c.Messages, userID)
+	c.UpdatedAt = time.Now().UTC()
+	s.markChat(chatID)
+	if err := s.persistLocked(); err != nil {
+		return Chat{}, err
+	}
+	return cloneChat(*c), nil
+}
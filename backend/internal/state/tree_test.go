@@ -0,0 +1,147 @@
+package state
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func ids(messages []Message) string {
+	out := make([]string, 0, len(messages))
+	for _, m := range messages {
+		out = append(out, m.ID)
+	}
+	return strings.Join(out, ",")
+}
+
+// treeMessages builds messages from "id:parent" specs; IDs starting with u are
+// user messages, a trailing ! marks a trashed message.
+func treeMessages(specs ...string) []Message {
+	trashed := time.Now().UTC()
+	messages := make([]Message, 0, len(specs))
+	for _, spec := range specs {
+		id, parent, _ := strings.Cut(spec, ":")
+		m := Message{ID: id, Role: "assistant"}
+		if strings.HasSuffix(parent, "!") {
+			parent = strings.TrimSuffix(parent, "!")
+			m.DeletedAt = &trashed
+		}
+		m.ParentID = parent
+		if strings.HasPrefix(id, "u") {
+			m.Role = "user"
+		}
+		messages = append(messages, m)
+	}
+	return messages
+}
+
+// u1 has two branches, u2 and the newer u3. Below u3, the live u6 comes before
+// the trashed u4.
+var branchingTree = treeMessages(
+	"p0:", "u1:", "a1:u1", "u2:u1", "a2:u2", "u5:u2",
+	"u3:u1", "a3:u3", "a3x:u3!", "u6:u3", "u4:u3!",
+)
+
+func TestActivePath(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []Message
+		leaf     string
+		want     string
+	}{
+		{"first branch", branchingTree, "u2", "p0,u1,a1,u2,a2"},
+		{"deeper leaf", branchingTree, "u5", "p0,u1,a1,u2,a2,u5"},
+		{"trashed messages are skipped", branchingTree, "u6", "p0,u1,a1,u3,a3,u6"},
+		{"trashed leaf is walked through", branchingTree, "u4", "p0,u1,a1,u3,a3"},
+		{"empty leaf", branchingTree, "", "p0"},
+		{"unknown leaf", branchingTree, "u9", "p0"},
+		{"response as leaf", branchingTree, "a1", "p0"},
+		{"cycle", treeMessages("u1:u2", "u2:u1", "a1:u1"), "u2", "u1,a1,u2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(ActivePath(tt.messages, tt.leaf)); got != tt.want {
+				t.Fatalf("ActivePath(%q) = %s, want %s", tt.leaf, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescendLeaf(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []Message
+		from     string
+		want     string
+	}{
+		{"newest branch, live child first", branchingTree, "u1", "u6"},
+		{"single child", branchingTree, "u2", "u5"},
+		{"leaf", branchingTree, "u5", "u5"},
+		{"only trashed children", treeMessages("u1:", "u2:u1!"), "u1", "u2"},
+		{"cycle", treeMessages("u1:u2", "u2:u1"), "u1", "u1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := descendLeaf(tt.messages, tt.from); got != tt.want {
+				t.Fatalf("descendLeaf(%q) = %s, want %s", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeTrashReparents(t *testing.T) {
+	tests := []struct {
+		name    string
+		delete  []string
+		removed int
+		parents string
+		leaf    string
+	}{
+		{"middle turn", []string{"u2"}, 2, "u1:,a1:u1,u3:u1,a3:u3,u4:u3", "u4"},
+		{"consecutive turns", []string{"u2", "u3"}, 4, "u1:,a1:u1,u4:u1", "u4"},
+		{"active leaf", []string{"u4"}, 1, "u1:,a1:u1,u2:u1,a2:u2,u3:u2,a3:u3", "u3"},
+		{"response only", []string{"a2"}, 1, "u1:,a1:u1,u2:u1,u3:u2,a3:u3,u4:u3", "u4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			chat, err := s.CreateChat(s.ListFolders()[0].ID, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.mu.Lock()
+			c := &s.data.Chats[s.chatIndexLocked(chat.ID)]
+			c.Messages = treeMessages("u1:", "a1:u1", "u2:u1", "a2:u2", "u3:u2", "a3:u3", "u4:u3")
+			c.ActiveLeafID = "u4"
+			s.mu.Unlock()
+
+			for _, id := range tt.delete {
+				if _, err := s.DeleteMessage(chat.ID, id); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Trashed later than the cutoff: kept.
+			if removed, err := s.PurgeTrash(time.Now().Add(-time.Minute)); err != nil || removed != 0 {
+				t.Fatalf("early purge removed %d, %v", removed, err)
+			}
+			removed, err := s.PurgeTrash(time.Now().Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != tt.removed {
+				t.Fatalf("removed %d, want %d", removed, tt.removed)
+			}
+			tree, _ := s.GetChatTree(chat.ID)
+			var parents []string
+			for _, m := range tree.Messages {
+				parents = append(parents, m.ID+":"+m.ParentID)
+			}
+			if got := strings.Join(parents, ","); got != tt.parents {
+				t.Fatalf("parents = %s, want %s", got, tt.parents)
+			}
+			if tree.ActiveLeafID != tt.leaf {
+				t.Fatalf("active leaf = %s, want %s", tree.ActiveLeafID, tt.leaf)
+			}
+		})
+	}
+}
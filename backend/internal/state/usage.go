@@ -0,0 +1,96 @@
+package state
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+type UsageTotals struct {
+	PromptTokens     int          `json:"promptTokens"`
+	CompletionTokens int          `json:"completionTokens"`
+	TotalTokens      int          `json:"totalTokens"`
+	Cost             float64      `json:"cost"`
+	Responses        int          `json:"responses"`
+	Models           []ModelUsage `json:"models"`
+}
+
+type ModelUsage struct {
+	TargetID         string  `json:"targetId"`
+	Provider         string  `json:"provider"`
+	Model            string  `json:"model"`
+	PromptTokens     int     `json:"promptTokens"`
+	CompletionTokens int     `json:"completionTokens"`
+	Cost             float64 `json:"cost"`
+	Responses        int     `json:"responses"`
+}
+
+func (s *Store) ChatUsage(chatID string) (UsageTotals, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, c := range s.data.Chats {
+		if c.ID == chatID && c.DeletedAt == nil {
+			return sumUsage([]Chat{c}), nil
+		}
+	}
+	return UsageTotals{}, errors.New("chat not found")
+}
+
+func (s *Store) FolderUsage(folderID string) (UsageTotals, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.folderExistsLocked(folderID) {
+		return UsageTotals{}, ErrFolderNotFound
+	}
+	chats := make([]Chat, 0)
+	for _, c := range s.data.Chats {
+		if c.FolderID == folderID && c.DeletedAt == nil {
+			chats = append(chats, c)
+		}
+	}
+	return sumUsage(chats), nil
+}
+
+// sumUsage counts every stored version, not only the selected one: a
+// regenerated answer was still paid for.
+func sumUsage(chats []Chat) UsageTotals {
+	totals := UsageTotals{Models: []ModelUsage{}}
+	byTarget := map[string]*ModelUsage{}
+	for _, c := range chats {
+		for _, msg := range c.Messages {
+			if msg.Role != "assistant" {
+				continue
+			}
+			for _, v := range msg.History {
+				if v.Usage == nil {
+					continue
+				}
+				targetID := strings.TrimSpace(v.TargetID)
+				if targetID == "" {
+					targetID = v.Provider + ":" + v.Model
+				}
+				m, ok := byTarget[targetID]
+				if !ok {
+					m = &ModelUsage{TargetID: targetID, Provider: v.Provider, Model: v.Model}
+					byTarget[targetID] = m
+				}
+				m.PromptTokens += v.Usage.PromptTokens
+				m.CompletionTokens += v.Usage.CompletionTokens
+				m.Responses++
+				totals.PromptTokens += v.Usage.PromptTokens
+				totals.CompletionTokens += v.Usage.CompletionTokens
+				totals.Responses++
+				if v.Usage.Cost != nil {
+					m.Cost += *v.Usage.Cost
+					totals.Cost += *v.Usage.Cost
+				}
+			}
+		}
+	}
+	totals.TotalTokens = totals.PromptTokens + totals.CompletionTokens
+	for _, m := range byTarget {
+		totals.Models = append(totals.Models, *m)
+	}
+	sort.Slice(totals.Models, func(i, j int) bool { return totals.Models[i].TargetID < totals.Models[j].TargetID })
+	return totals
+}
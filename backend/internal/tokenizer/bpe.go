@@ -0,0 +1,132 @@
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// maxPieceBytes bounds the quadratic merge loop; longer pieces (minified code,
+// base64 blobs) are counted in chunks.
+const maxPieceBytes = 512
+
+// bpe is a byte-level byte pair encoding as used by tiktoken: text is split
+// into pieces, and each piece's bytes are merged pairwise in rank order.
+type bpe struct {
+	name  string
+	ranks map[string]int
+	split splitRules
+}
+
+func (b *bpe) Name() string { return b.name }
+
+func (b *bpe) Count(text string) int {
+	n := 0
+	for _, piece := range b.split.split(text) {
+		for len(piece) > maxPieceBytes {
+			n += b.countPiece([]byte(piece[:maxPieceBytes]))
+			piece = piece[maxPieceBytes:]
+		}
+		n += b.countPiece([]byte(piece))
+	}
+	return n
+}
+
+// countPiece merges the lowest-ranked adjacent pair until no pair is in the
+// vocabulary and returns the number of tokens left.
+func (b *bpe) countPiece(piece []byte) int {
+	if len(piece) == 0 {
+		return 0
+	}
+	if _, ok := b.ranks[string(piece)]; ok {
+		return 1
+	}
+	// bounds holds the start of every current token plus the end of the piece.
+	bounds := make([]int, len(piece)+1)
+	for i := range bounds {
+		bounds[i] = i
+	}
+	for len(bounds) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i+2 < len(bounds); i++ {
+			if rank, ok := b.ranks[string(piece[bounds[i]:bounds[i+2]])]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		bounds = append(bounds[:best+1], bounds[best+2:]...)
+	}
+	return len(bounds) - 1
+}
+
+func parseRanks(file string, data []byte) (map[string]int, error) {
+	if strings.HasSuffix(file, ".json") {
+		return parseTekken(data)
+	}
+	return parseTiktoken(data)
+}
+
+// parseTiktoken reads the tiktoken format: one base64 token and its rank per
+// line.
+func parseTiktoken(data []byte) (map[string]int, error) {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected token and rank", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("empty vocabulary")
+	}
+	return ranks, nil
+}
+
+// parseTekken reads Mistral's tekken.json, whose vocab entries carry the
+// token bytes in base64 and their rank.
+func parseTekken(data []byte) (map[string]int, error) {
+	var file struct {
+		Vocab []struct {
+			Rank       int    `json:"rank"`
+			TokenBytes string `json:"token_bytes"`
+		} `json:"vocab"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	ranks := make(map[string]int, len(file.Vocab))
+	for _, v := range file.Vocab {
+		token, err := base64.StdEncoding.DecodeString(v.TokenBytes)
+		if err != nil {
+			return nil, fmt.Errorf("rank %d: %w", v.Rank, err)
+		}
+		ranks[string(token)] = v.Rank
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("empty vocabulary")
+	}
+	return ranks, nil
+}
@@ -0,0 +1,115 @@
+package tokenizer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testVocab is every single byte plus the merges that build "hell" and "aa",
+// in tiktoken's format.
+func testVocab() string {
+	var b strings.Builder
+	rank := 0
+	add := func(token string) {
+		fmt.Fprintf(&b, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(token)), rank)
+		rank++
+	}
+	for i := 0; i < 256; i++ {
+		add(string([]byte{byte(i)}))
+	}
+	for _, merge := range []string{"he", "ll", "hell", "aa"} {
+		add(merge)
+	}
+	return b.String()
+}
+
+// testTekken is testVocab in tekken.json's format.
+func testTekken(t *testing.T) string {
+	t.Helper()
+	type entry struct {
+		Rank       int    `json:"rank"`
+		TokenBytes string `json:"token_bytes"`
+	}
+	var file struct {
+		Vocab []entry `json:"vocab"`
+	}
+	for _, line := range strings.Split(strings.TrimSpace(testVocab()), "\n") {
+		var e entry
+		if _, err := fmt.Sscanf(line, "%s %d", &e.TokenBytes, &e.Rank); err != nil {
+			t.Fatal(err)
+		}
+		file.Vocab = append(file.Vocab, e)
+	}
+	raw, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(raw)
+}
+
+func TestBPECount(t *testing.T) {
+	ranks, err := parseTiktoken([]byte(testVocab()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &bpe{name: "test", ranks: ranks, split: cl100kRules}
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"", 0},
+		{"hell", 1},
+		{"hello", 2},
+		{"hello hello", 5},
+		{"lleh", 3},
+		{"aaaaa", 3},
+		// Pieces are merged in chunks of maxPieceBytes: 256 + 256 + 3.
+		{strings.Repeat("a", 2*maxPieceBytes+5), maxPieceBytes + 3},
+		{"日", 3},
+	}
+	for _, tt := range tests {
+		if got := b.Count(tt.text); got != tt.want {
+			t.Errorf("Count(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParseRanks(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		err  string
+	}{
+		{"tiktoken", "x.tiktoken", testVocab(), ""},
+		{"blank lines", "x.tiktoken", "\n" + testVocab() + "\n\n", ""},
+		{"missing rank", "x.tiktoken", "aGk=\n", "line 1: expected token and rank"},
+		{"bad base64", "x.tiktoken", "aGk= 0\n!!! 1\n", "line 2"},
+		{"bad rank", "x.tiktoken", "aGk= one\n", "line 1"},
+		{"empty", "x.tiktoken", "", "empty vocabulary"},
+		{"tekken", "x.json", testTekken(t), ""},
+		{"tekken bad base64", "x.json", `{"vocab": [{"rank": 3, "token_bytes": "!!!"}]}`, "rank 3"},
+		{"tekken empty", "x.json", `{"vocab": []}`, "empty vocabulary"},
+		{"tekken not JSON", "x.json", `{"vocab"`, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ranks, err := parseRanks(tt.file, []byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("err = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ranks) != 260 || ranks["hell"] != 258 || ranks["\x00"] != 0 {
+				t.Fatalf("got %d ranks, hell = %d", len(ranks), ranks["hell"])
+			}
+		})
+	}
+}
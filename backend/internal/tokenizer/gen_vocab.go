@@ -0,0 +1,91 @@
+//go:build ignore
+
+// gen_vocab downloads the tokenizer vocabularies into vocab/, where they are
+// embedded at build time. The Llama 3 and Mistral files are gated on Hugging
+// Face: accept their licenses and set HF_TOKEN. Files already in vocab/ are
+// kept unless -force is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var sources = []struct {
+	file string
+	url  string
+}{
+	{"cl100k_base.tiktoken", "https://openaipublic.blob.core.windows.net/encodings/cl100k_base.tiktoken"},
+	{"o200k_base.tiktoken", "https://openaipublic.blob.core.windows.net/encodings/o200k_base.tiktoken"},
+	{"llama3.tiktoken", "https://huggingface.co/meta-llama/Meta-Llama-3-8B/resolve/main/original/tokenizer.model"},
+	{"mistral_tekken.json", "https://huggingface.co/mistralai/Mistral-Nemo-Instruct-2407/resolve/main/tekken.json"},
+}
+
+func main() {
+	force := flag.Bool("force", false, "download files that already exist")
+	flag.Parse()
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	failed := false
+	for _, src := range sources {
+		path := filepath.Join("vocab", src.file)
+		if _, err := os.Stat(path); err == nil && !*force {
+			log.Printf("%s: present", src.file)
+			continue
+		}
+		if err := download(client, src.url, path); err != nil {
+			log.Printf("%s: %v", src.file, err)
+			failed = true
+			continue
+		}
+		log.Printf("%s: downloaded", src.file)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func download(client *http.Client, url, path string) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	if token := strings.TrimSpace(os.Getenv("HF_TOKEN")); token != "" && strings.HasPrefix(url, "https://huggingface.co/") {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+			return fmt.Errorf("%s: %s (gated: accept the license and set HF_TOKEN)", url, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".download-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: empty response", url)
+	}
+	return os.Rename(tmp.Name(), path)
+}
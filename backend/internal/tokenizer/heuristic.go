@@ -0,0 +1,66 @@
+package tokenizer
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+// heuristic estimates tokens without a vocabulary: about four characters per
+// token for ASCII words, two for other alphabets, one per character for CJK
+// and emoji, and two symbols per token for the punctuation runs of code.
+type heuristic struct{}
+
+func (heuristic) Name() string { return "heuristic" }
+
+func (heuristic) Count(text string) int {
+	s := []rune(text)
+	n := 0
+	for i := 0; i < len(s); {
+		r := s[i]
+		j := i + 1
+		switch {
+		case isWide(r):
+			n++
+		case unicode.IsSpace(r):
+			for j < len(s) && unicode.IsSpace(s[j]) {
+				j++
+			}
+			// A single space joins the next word; line breaks and indentation
+			// cost tokens of their own.
+			if j-i > 1 || r == '\n' {
+				n += ceilDiv(j-i, 4)
+			}
+		case isASCIIWord(r):
+			for j < len(s) && isASCIIWord(s[j]) {
+				j++
+			}
+			n += ceilDiv(j-i, 4)
+		case unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.Is(unicode.M, r):
+			for j < len(s) && !isWide(s[j]) && !isASCIIWord(s[j]) && (unicode.IsLetter(s[j]) || unicode.IsNumber(s[j]) || unicode.Is(unicode.M, s[j])) {
+				j++
+			}
+			n += ceilDiv(j-i, 2)
+		case r >= utf8.RuneSelf:
+			n++
+		default:
+			for j < len(s) && s[j] < utf8.RuneSelf && isSymbol(s[j]) {
+				j++
+			}
+			n += ceilDiv(j-i, 2)
+		}
+		i = j
+	}
+	return n
+}
+
+func isWide(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func isASCIIWord(r rune) bool {
+	return r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsNumber(r))
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
@@ -0,0 +1,218 @@
+package tokenizer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// splitRules describe the pre-tokenization regexes of the supported encodings,
+// which need lookahead and so cannot run on Go's regexp. cl100k_base and
+// Llama 3 use
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// while o200k_base and tekken split words at case changes instead, and only
+// o200k_base keeps contractions attached to the word before.
+type splitRules struct {
+	caseAware    bool
+	contractions bool
+	maxDigits    int
+	symbolTail   string
+}
+
+var (
+	cl100kRules = splitRules{contractions: true, maxDigits: 3, symbolTail: "\r\n"}
+	o200kRules  = splitRules{caseAware: true, contractions: true, maxDigits: 3, symbolTail: "\r\n/"}
+	tekkenRules = splitRules{caseAware: true, maxDigits: 1, symbolTail: "\r\n/"}
+)
+
+func (r splitRules) split(text string) []string {
+	s := []rune(text)
+	var pieces []string
+	for i := 0; i < len(s); {
+		n := r.match(s, i)
+		pieces = append(pieces, string(s[i:i+n]))
+		i += n
+	}
+	return pieces
+}
+
+// match returns the length of the piece starting at i, trying the
+// alternatives in regex order.
+func (r splitRules) match(s []rune, i int) int {
+	if r.caseAware {
+		if n := r.casedWord(s, i); n > 0 {
+			return n
+		}
+	} else {
+		if n := contraction(s, i); n > 0 && r.contractions {
+			return n
+		}
+		if n := word(s, i); n > 0 {
+			return n
+		}
+	}
+	if n := digits(s, i, r.maxDigits); n > 0 {
+		return n
+	}
+	if n := r.symbols(s, i); n > 0 {
+		return n
+	}
+	return whitespace(s, i)
+}
+
+// contraction matches (?i:'s|'t|'re|'ve|'m|'ll|'d).
+func contraction(s []rune, i int) int {
+	if i+1 >= len(s) || s[i] != '\'' {
+		return 0
+	}
+	switch unicode.ToLower(s[i+1]) {
+	case 's', 't', 'm', 'd':
+		return 2
+	}
+	if i+2 < len(s) {
+		switch strings.ToLower(string(s[i+1 : i+3])) {
+		case "re", "ve", "ll":
+			return 3
+		}
+	}
+	return 0
+}
+
+// word matches [^\r\n\p{L}\p{N}]?\p{L}+.
+func word(s []rune, i int) int {
+	j := i
+	if isPrefix(s[j]) && j+1 < len(s) && unicode.IsLetter(s[j+1]) {
+		j++
+	}
+	k := j
+	for k < len(s) && unicode.IsLetter(s[k]) {
+		k++
+	}
+	if k == j {
+		return 0
+	}
+	return k - i
+}
+
+// casedWord matches the two word alternatives of o200k_base and tekken:
+// an optional prefix, then either upper* lower+ or upper+ lower*, where the
+// classes overlap on modifier and other letters and on marks.
+func (r splitRules) casedWord(s []rune, i int) int {
+	starts := []int{i}
+	if isPrefix(s[i]) {
+		starts = []int{i + 1, i}
+	}
+	for _, alt := range []func([]rune, int) int{upperThenLower, upperRun} {
+		for _, j := range starts {
+			if j >= len(s) {
+				continue
+			}
+			if k := alt(s, j); k > j {
+				if r.contractions {
+					k += contraction(s, k)
+				}
+				return k - i
+			}
+		}
+	}
+	return 0
+}
+
+// upperThenLower matches upper* lower+ starting at j and returns the end, or j.
+func upperThenLower(s []rune, j int) int {
+	u := j
+	for u < len(s) && isUpperish(s[u]) {
+		u++
+	}
+	// Backtrack the upper run until a lower-class rune follows it.
+	for p := u; p >= j; p-- {
+		if p < len(s) && isLowerish(s[p]) {
+			e := p
+			for e < len(s) && isLowerish(s[e]) {
+				e++
+			}
+			return e
+		}
+	}
+	return j
+}
+
+// upperRun matches upper+ lower* starting at j and returns the end, or j.
+func upperRun(s []rune, j int) int {
+	e := j
+	for e < len(s) && isUpperish(s[e]) {
+		e++
+	}
+	if e == j {
+		return j
+	}
+	for e < len(s) && isLowerish(s[e]) {
+		e++
+	}
+	return e
+}
+
+func digits(s []rune, i, max int) int {
+	n := 0
+	for i+n < len(s) && n < max && unicode.IsNumber(s[i+n]) {
+		n++
+	}
+	return n
+}
+
+// symbols matches " ?[^\s\p{L}\p{N}]+" followed by the rule's tail runes.
+func (r splitRules) symbols(s []rune, i int) int {
+	j := i
+	if s[j] == ' ' {
+		j++
+	}
+	k := j
+	for k < len(s) && isSymbol(s[k]) {
+		k++
+	}
+	if k == j {
+		return 0
+	}
+	for k < len(s) && strings.ContainsRune(r.symbolTail, s[k]) {
+		k++
+	}
+	return k - i
+}
+
+// whitespace matches \s*[\r\n]+|\s+(?!\S)|\s+: a run up to its last line
+// break, otherwise the run minus the space that joins the next word.
+func whitespace(s []rune, i int) int {
+	e := i
+	for e < len(s) && unicode.IsSpace(s[e]) {
+		e++
+	}
+	if e == i {
+		return 1
+	}
+	for p := e - 1; p >= i; p-- {
+		if s[p] == '\r' || s[p] == '\n' {
+			return p + 1 - i
+		}
+	}
+	if e == len(s) || e-i == 1 {
+		return e - i
+	}
+	return e - 1 - i
+}
+
+func isPrefix(r rune) bool {
+	return r != '\r' && r != '\n' && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsSpace(r) && !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+func isUpperish(r rune) bool {
+	return unicode.In(r, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+func isLowerish(r rune) bool {
+	return unicode.In(r, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+}
@@ -0,0 +1,67 @@
+package tokenizer
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		text   string
+		cl100k []string
+		o200k  []string
+		tekken []string
+	}{
+		{
+			"I'm 12345 ok!!\n\n",
+			[]string{"I", "'m", " ", "123", "45", " ok", "!!\n\n"},
+			[]string{"I'm", " ", "123", "45", " ok", "!!\n\n"},
+			[]string{"I", "'m", " ", "1", "2", "3", "4", "5", " ok", "!!\n\n"},
+		},
+		{
+			"HelloWorld I'M don't",
+			[]string{"HelloWorld", " I", "'M", " don", "'t"},
+			[]string{"Hello", "World", " I'M", " don't"},
+			[]string{"Hello", "World", " I", "'M", " don", "'t"},
+		},
+		{
+			"x\n\n  y",
+			[]string{"x", "\n\n", " ", " y"},
+			[]string{"x", "\n\n", " ", " y"},
+			[]string{"x", "\n\n", " ", " y"},
+		},
+		{
+			" \tend  ",
+			[]string{" ", "\tend", "  "},
+			[]string{" ", "\tend", "  "},
+			[]string{" ", "\tend", "  "},
+		},
+		{
+			"path/to/file.go",
+			[]string{"path", "/to", "/file", ".go"},
+			[]string{"path", "/to", "/file", ".go"},
+			[]string{"path", "/to", "/file", ".go"},
+		},
+		{
+			"élan ÀB 日本語",
+			[]string{"élan", " ÀB", " 日本語"},
+			[]string{"élan", " ÀB", " 日本語"},
+			[]string{"élan", " ÀB", " 日本語"},
+		},
+	}
+	for _, tt := range tests {
+		for _, c := range []struct {
+			name  string
+			rules splitRules
+			want  []string
+		}{
+			{"cl100k", cl100kRules, tt.cl100k},
+			{"o200k", o200kRules, tt.o200k},
+			{"tekken", tekkenRules, tt.tekken},
+		} {
+			if got := c.rules.split(tt.text); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%s split(%q) = %q, want %q", c.name, tt.text, got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Package tokenizer counts tokens the way model families split text. Byte pair
+// encodings come from the vocabularies embedded from vocab/, which go generate
+// downloads, or from the directory given to LoadDir, which overrides them;
+// models without a known family fall back to a script-aware estimate.
+package tokenizer
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"llm-mux/backend/internal/providers"
+)
+
+// Tokenizer counts the tokens of a piece of text.
+type Tokenizer interface {
+	Name() string
+	Count(text string) int
+}
+
+// Chat templates wrap every message in role markers and separators, and prime
+// the reply with a few more tokens.
+const (
+	messageOverhead = 4
+	replyOverhead   = 3
+)
+
+//go:generate go run gen_vocab.go
+
+//go:embed vocab
+var vocab embed.FS
+
+// vocabDir is searched before the embedded vocabularies.
+var vocabDir string
+
+type encoding struct {
+	file  string
+	split splitRules
+	once  sync.Once
+	bpe   *bpe
+}
+
+var encodings = map[string]*encoding{
+	"cl100k_base":    {file: "cl100k_base.tiktoken", split: cl100kRules},
+	"o200k_base":     {file: "o200k_base.tiktoken", split: o200kRules},
+	"llama3":         {file: "llama3.tiktoken", split: cl100kRules},
+	"mistral_tekken": {file: "mistral_tekken.json", split: tekkenRules},
+}
+
+// LoadDir reads the vocabularies in dir, which take precedence over the
+// embedded ones, and returns the encodings that are available. Call it at
+// startup, before the first count.
+func LoadDir(dir string) []string {
+	vocabDir = dir
+	var names []string
+	for name, enc := range encodings {
+		if enc.load(name) != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// For returns the tokenizer of a model, or the heuristic when its family is
+// unknown or the family's vocabulary is missing.
+func For(provider, model string) Tokenizer {
+	name := familyFor(strings.ToLower(strings.TrimSpace(provider)), model)
+	enc, ok := encodings[name]
+	if !ok {
+		return heuristic{}
+	}
+	if b := enc.load(name); b != nil {
+		return b
+	}
+	return heuristic{}
+}
+
+// CountRequest counts the prompt side of a chat request: the system prompt,
+// the history, the new prompt and the framing around each message.
+func CountRequest(tok Tokenizer, systemPrompt string, history []providers.HistoryMessage, prompt string) int {
+	total := replyOverhead
+	if strings.TrimSpace(systemPrompt) != "" {
+		total += messageOverhead + tok.Count(systemPrompt)
+	}
+	for _, m := range history {
+		total += messageOverhead + tok.Count(m.Content)
+	}
+	if prompt != "" {
+		total += messageOverhead + tok.Count(prompt)
+	}
+	return total
+}
+
+// familyFor maps a model to its encoding. OpenRouter-style vendor prefixes
+// ("openai/", "mistralai/") decide when the model name alone does not.
+func familyFor(provider, model string) string {
+	m := strings.ToLower(strings.TrimSpace(model))
+	vendor := ""
+	if i := strings.LastIndex(m, "/"); i >= 0 {
+		vendor, m = m[:i], m[i+1:]
+	}
+	switch {
+	case provider == "anthropic" || provider == "gemini":
+		return ""
+	case hasAnyPrefix(m, "gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "gpt-oss", "o1", "o3", "o4"):
+		return "o200k_base"
+	case hasAnyPrefix(m, "gpt-4", "gpt-3.5", "text-embedding-3", "text-embedding-ada"):
+		return "cl100k_base"
+	case strings.Contains(m, "llama-3") || strings.Contains(m, "llama3"):
+		return "llama3"
+	case hasAnyPrefix(m, "mistral", "open-mistral", "mixtral", "open-mixtral", "codestral", "ministral", "pixtral", "devstral", "magistral"):
+		return "mistral_tekken"
+	case vendor == "openai":
+		return "o200k_base"
+	case vendor == "mistralai":
+		return "mistral_tekken"
+	}
+	return ""
+}
+
+func hasAnyPrefix(s string, prefixes ...string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *encoding) load(name string) *bpe {
+	e.once.Do(func() {
+		var data []byte
+		err := fs.ErrNotExist
+		if vocabDir != "" {
+			data, err = os.ReadFile(filepath.Join(vocabDir, e.file))
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			data, err = vocab.ReadFile("vocab/" + e.file)
+		}
+		if err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("warning: tokenizer %s: %v; using the heuristic", name, err)
+			}
+			return
+		}
+		ranks, err := parseRanks(e.file, data)
+		if err != nil {
+			log.Printf("warning: tokenizer %s: %v; using the heuristic", name, err)
+			return
+		}
+		e.bpe = &bpe{name: name, ranks: ranks, split: e.split}
+	})
+	return e.bpe
+}
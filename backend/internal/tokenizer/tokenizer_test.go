@@ -0,0 +1,142 @@
+package tokenizer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"llm-mux/backend/internal/providers"
+)
+
+// useVocabDir points the encodings at dir as if the process had just started,
+// and restores the defaults afterwards.
+func useVocabDir(t *testing.T, dir string) []string {
+	t.Helper()
+	reset := func() {
+		vocabDir = ""
+		for _, enc := range encodings {
+			enc.once = sync.Once{}
+			enc.bpe = nil
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+	return LoadDir(dir)
+}
+
+func TestFamilyFor(t *testing.T) {
+	tests := []struct {
+		provider, model, want string
+	}{
+		{"openrouter", "openai/gpt-4o-mini", "o200k_base"},
+		{"openai_compatible", "gpt-5", "o200k_base"},
+		{"openrouter", "openai/o3-mini", "o200k_base"},
+		{"openrouter", "openai/some-new-model", "o200k_base"},
+		{"openai_compatible", "gpt-4-turbo", "cl100k_base"},
+		{"openai_compatible", "gpt-3.5-turbo", "cl100k_base"},
+		{"ollama", "llama3.1:8b", "llama3"},
+		{"openrouter", "meta-llama/llama-3.3-70b-instruct", "llama3"},
+		{"openrouter", "mistralai/mistral-large", "mistral_tekken"},
+		{"ollama", "codestral:22b", "mistral_tekken"},
+		{"openrouter", "mistralai/new-model", "mistral_tekken"},
+		{"anthropic", "claude-sonnet-4", ""},
+		{"gemini", "gemini-2.5-pro", ""},
+		{"openrouter", "qwen/qwen3-32b", ""},
+	}
+	for _, tt := range tests {
+		if got := familyFor(tt.provider, tt.model); got != tt.want {
+			t.Errorf("familyFor(%q, %q) = %q, want %q", tt.provider, tt.model, got, tt.want)
+		}
+	}
+}
+
+func TestLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range map[string]string{
+		"cl100k_base.tiktoken": testVocab(),
+		"mistral_tekken.json":  testTekken(t),
+		"o200k_base.tiktoken":  "not a vocabulary",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, want := useVocabDir(t, dir), []string{"cl100k_base", "mistral_tekken"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("LoadDir = %v, want %v", got, want)
+	}
+	tests := []struct {
+		provider, model, name string
+		count                 int
+	}{
+		{"openai_compatible", "gpt-4", "cl100k_base", 2},
+		{"ollama", "mistral-nemo", "mistral_tekken", 2},
+		// Broken and missing vocabularies fall back to the estimate.
+		{"openrouter", "openai/gpt-4o", "heuristic", 2},
+		{"ollama", "llama3", "heuristic", 2},
+		{"anthropic", "claude-opus-4", "heuristic", 2},
+	}
+	for _, tt := range tests {
+		tok := For(tt.provider, tt.model)
+		if tok.Name() != tt.name || tok.Count("hello") != tt.count {
+			t.Errorf("For(%q, %q) = %s counting %d, want %s counting %d", tt.provider, tt.model, tok.Name(), tok.Count("hello"), tt.name, tt.count)
+		}
+	}
+}
+
+func TestCountRequest(t *testing.T) {
+	tok := heuristic{}
+	history := []providers.HistoryMessage{{Role: "user", Content: "hello"}, {Role: "assistant", Content: "hi there"}}
+	want := replyOverhead + 4*messageOverhead + tok.Count("be brief") + tok.Count("hello") + tok.Count("hi there") + tok.Count("bye")
+	if got := CountRequest(tok, "be brief", history, "bye"); got != want {
+		t.Fatalf("CountRequest = %d, want %d", got, want)
+	}
+	if got := CountRequest(tok, " ", nil, ""); got != replyOverhead {
+		t.Fatalf("empty request = %d, want %d", got, replyOverhead)
+	}
+}
+
+// A build without the vocabularies counts every model with the heuristic.
+func TestEmbeddedVocabularies(t *testing.T) {
+	want := []string{"cl100k_base", "llama3", "mistral_tekken", "o200k_base"}
+	if got := useVocabDir(t, ""); !reflect.DeepEqual(got, want) {
+		t.Fatalf("embedded vocabularies = %v, want %v; run go generate ./internal/tokenizer", got, want)
+	}
+}
+
+// TestKnownCounts compares against the counts of tiktoken and the models'
+// reference tokenizers, using the embedded vocabularies or the ones in
+// TOKENIZER_VOCAB_DIR.
+func TestKnownCounts(t *testing.T) {
+	dir := os.Getenv("TOKENIZER_VOCAB_DIR")
+	useVocabDir(t, dir)
+	tests := []struct {
+		provider, model, text string
+		want                  int
+	}{
+		{"openai_compatible", "gpt-4", "hello world", 2},
+		{"openai_compatible", "gpt-4", "tiktoken is great!", 6},
+		{"openai_compatible", "gpt-4", "antidisestablishmentarianism", 6},
+		{"openai_compatible", "gpt-4", "2 + 2 = 4", 7},
+		{"openai_compatible", "gpt-4", "お誕生日おめでとう", 9},
+		{"openai_compatible", "gpt-4o", "hello world", 2},
+		{"openai_compatible", "gpt-4o", "tiktoken is great!", 6},
+		{"openai_compatible", "gpt-4o", "antidisestablishmentarianism", 5},
+		{"openai_compatible", "gpt-4o", "2 + 2 = 4", 7},
+		{"openai_compatible", "gpt-4o", "お誕生日おめでとう", 8},
+		{"ollama", "llama3.1", "hello world", 2},
+		{"ollama", "mistral-nemo", "hello world", 2},
+	}
+	for _, tt := range tests {
+		tok := For(tt.provider, tt.model)
+		if tok.Name() == "heuristic" {
+			t.Errorf("%s: vocabulary missing", tt.model)
+			continue
+		}
+		if got := tok.Count(tt.text); got != tt.want {
+			t.Errorf("%s Count(%q) = %d, want %d", tok.Name(), tt.text, got, tt.want)
+		}
+	}
+}
@@ -1,24 +1,31 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"llm-mux/backend/internal/providers"
 	"llm-mux/backend/internal/state"
+	"llm-mux/backend/internal/tokenizer"
 )
 
 type chatRequest struct {
-	ChatID      string                   `json:"chatId"`
-	Prompt      string                   `json:"prompt"`
+	ChatID string `json:"chatId"`
+	Prompt string `json:"prompt"`
+	// TemplateID renders a prompt template in place of Prompt, with Variables
+	// taking precedence over the chat's variables and the template defaults.
+	TemplateID  string                   `json:"templateId,omitempty"`
+	Variables   map[string]string        `json:"variables,omitempty"`
 	Attachments []textAttachment         `json:"attachments,omitempty"`
 	Targets     []providers.Target       `json:"targets"`
 	Config      providers.ProviderConfig `json:"config"`
@@ -41,6 +48,7 @@ func toStateAttachments(in []textAttachment) []state.TextAttachment {
 }
 
 type createFolderRequest struct {
+	ParentID     string   `json:"parentId"`
 	Name         string   `json:"name"`
 	SystemPrompt string   `json:"systemPrompt"`
 	Temperature  *float64 `json:"temperature,omitempty"`
@@ -52,14 +60,35 @@ type updateFolderRequest struct {
 	Temperature  *float64 `json:"temperature,omitempty"`
 }
 
+type moveFolderRequest struct {
+	ParentID string `json:"parentId"`
+}
+
 type createChatRequest struct {
 	FolderID string `json:"folderId"`
 	Title    string `json:"title"`
 }
 
 type updateChatRequest struct {
-	FolderID string `json:"folderId"`
-	Title    string `json:"title"`
+	FolderID     string  `json:"folderId"`
+	Title        string  `json:"title"`
+	SystemPrompt *string `json:"systemPrompt"`
+	// Temperature stays raw to tell an explicit null (clear) from absent.
+	Temperature json.RawMessage    `json:"temperature"`
+	Targets     []providers.Target `json:"targets"`
+	Variables   map[string]string  `json:"variables"`
+}
+
+type templateRequest struct {
+	FolderID string            `json:"folderId"`
+	Name     string            `json:"name"`
+	Body     string            `json:"body"`
+	Defaults map[string]string `json:"defaults"`
+}
+
+type renderTemplateRequest struct {
+	ChatID    string            `json:"chatId"`
+	Variables map[string]string `json:"variables"`
 }
 
 type updateMessageRequest struct {
@@ -93,6 +122,17 @@ type summarizeRequest struct {
 	Config        providers.ProviderConfig `json:"config"`
 }
 
+type cancelRunRequest struct {
+	TargetID string `json:"targetId,omitempty"`
+}
+
+type restoreChatRequest struct {
+	FolderID string `json:"folderId,omitempty"`
+}
+
+// trashRetention is how long deleted items stay restorable.
+const trashRetention = 30 * 24 * time.Hour
+
 type providerInfo struct {
 	ID     string   `json:"id"`
 	Name   string   `json:"name"`
@@ -100,23 +140,70 @@ type providerInfo struct {
 }
 
 func main() {
-	store, err := state.New(filepath.Join("data", "state.json"))
+	storage := flag.String("storage", "json", "state storage backend: json or sqlite")
+	migrateDryRun := flag.Bool("migrate-dry-run", false, "report pending state migrations and exit without writing")
+	tokenizers := flag.String("tokenizers", filepath.Join("data", "tokenizers"), "directory with tokenizer vocabularies, read before the bundled ones")
+	flag.Parse()
+
+	if *migrateDryRun {
+		report, err := dryRunMigrations(*storage, "data")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(report)
+		return
+	}
+
+	store, err := openStore(*storage, "data")
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer store.Close()
 
 	mux := http.NewServeMux()
 	registry := map[string]providers.Adapter{
-		"openrouter": providers.NewOpenRouterAdapter(),
-		"ollama":     providers.NewOllamaAdapter(),
+		"openrouter":        providers.NewOpenRouterAdapter(),
+		"ollama":            providers.NewOllamaAdapter(),
+		"anthropic":         providers.NewAnthropicAdapter(),
+		"gemini":            providers.NewGeminiAdapter(),
+		"openai_compatible": providers.NewOpenAICompatibleAdapter(),
 	}
 
+	if names := tokenizer.LoadDir(*tokenizers); len(names) > 0 {
+		log.Printf("tokenizers: %s", strings.Join(names, ", "))
+	} else {
+		log.Printf("no tokenizer vocabularies in %s or bundled; estimating token counts", *tokenizers)
+	}
+
+	catalog := newModelCatalog("data")
+	runs := newRunManager(registry, store, catalog)
+	go purgeTrashLoop(store)
+	go catalog.refreshLoop(store)
+
 	mux.HandleFunc("/health", func(w http.ResponseWriter, _ *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
 	})
 
 	mux.HandleFunc("/api/providers", func(w http.ResponseWriter, _ *http.Request) {
-		writeJSON(w, http.StatusOK, map[string]any{"providers": providerCatalog()})
+		writeJSON(w, http.StatusOK, map[string]any{"providers": providerCatalog(store.GetConfig())})
+	})
+
+	mux.HandleFunc("/api/models", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		cfg := store.GetConfig()
+		ids := configuredProviders(cfg)
+		if provider := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("provider"))); provider != "" {
+			if catalogSource(cfg, provider) == "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported provider"})
+				return
+			}
+			ids = []string{provider}
+		}
+		force := r.URL.Query().Get("refresh") == "true"
+		writeJSON(w, http.StatusOK, map[string]any{"providers": catalog.List(cfg, ids, force)})
 	})
 
 	mux.HandleFunc("/api/context-limits", func(w http.ResponseWriter, r *http.Request) {
@@ -134,16 +221,22 @@ func main() {
 			return
 		}
 		baseHistory := []state.Message{}
+		leafID := ""
 		chatID := strings.TrimSpace(req.ChatID)
 		if chatID != "" {
-			chat, ok := store.GetChat(chatID)
+			chat, ok := store.GetChatTree(chatID)
 			if !ok {
 				writeJSON(w, http.StatusNotFound, map[string]string{"error": "chat not found"})
 				return
 			}
 			baseHistory = chat.Messages
+			leafID = chat.ActiveLeafID
+			settings := store.ChatSettings(chat)
+			for i := range req.Targets {
+				applyFolderSettings(&req.Targets[i], settings)
+			}
 		}
-		limits := resolveContextLimits(req, store.GetConfig(), baseHistory)
+		limits := resolveContextLimits(catalog, req, store.GetConfig(), baseHistory, leafID)
 		writeJSON(w, http.StatusOK, contextLimitsResponse{Limits: limits})
 	})
 
@@ -157,6 +250,10 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
 				return
 			}
+			if err := cfg.Validate(); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
 			if err := store.SetConfig(cfg); err != nil {
 				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 				return
@@ -177,7 +274,7 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
 				return
 			}
-			folder, err := store.CreateFolder(req.Name, req.SystemPrompt, req.Temperature)
+			folder, err := store.CreateFolder(req.ParentID, req.Name, req.SystemPrompt, req.Temperature)
 			if err != nil {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 				return
@@ -189,11 +286,91 @@ func main() {
 	})
 
 	mux.HandleFunc("/api/folders/", func(w http.ResponseWriter, r *http.Request) {
-		id := strings.TrimPrefix(r.URL.Path, "/api/folders/")
-		if id == "" {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/folders/"), "/")
+		if rest == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		parts := strings.Split(rest, "/")
+		if len(parts) == 2 && parts[1] == "usage" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			totals, err := store.FolderUsage(parts[0])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, totals)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "settings" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			settings, err := store.EffectiveFolderSettings(parts[0])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, settings)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "move" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req moveFolderRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+				return
+			}
+			folder, err := store.MoveFolder(parts[0], req.ParentID)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, folder)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "restore" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			folder, err := store.RestoreFolder(parts[0])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, folder)
+			return
+		}
+
+		if len(parts) != 1 {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
+		id := parts[0]
+		if r.Method == http.MethodDelete {
+			if err := store.DeleteFolder(id); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, state.ErrFolderNotFound) {
+					status = http.StatusNotFound
+				}
+				writeJSON(w, status, map[string]string{"error": err.Error()})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 		if r.Method != http.MethodPatch {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
@@ -213,6 +390,95 @@ func main() {
 		writeJSON(w, http.StatusOK, folder)
 	})
 
+	mux.HandleFunc("/api/templates", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			folderID := strings.TrimSpace(r.URL.Query().Get("folderId"))
+			writeJSON(w, http.StatusOK, map[string]any{"templates": store.ListTemplates(folderID)})
+		case http.MethodPost:
+			var req templateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+				return
+			}
+			tmpl, err := store.CreateTemplate(req.FolderID, req.Name, req.Body, req.Defaults)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusCreated, tmpl)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/templates/", func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/templates/"), "/")
+		if rest == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		parts := strings.Split(rest, "/")
+		if len(parts) == 2 && parts[1] == "render" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req renderTemplateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+				return
+			}
+			if _, ok := store.FindTemplate(parts[0]); !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "template not found"})
+				return
+			}
+			prompt, err := store.RenderTemplate(parts[0], strings.TrimSpace(req.ChatID), req.Variables)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]string{"prompt": prompt})
+			return
+		}
+
+		if len(parts) != 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		id := parts[0]
+		switch r.Method {
+		case http.MethodGet:
+			tmpl, ok := store.FindTemplate(id)
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "template not found"})
+				return
+			}
+			writeJSON(w, http.StatusOK, tmpl)
+		case http.MethodPatch:
+			var req templateRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+				return
+			}
+			tmpl, err := store.UpdateTemplate(id, req.FolderID, req.Name, req.Body, req.Defaults)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, tmpl)
+		case http.MethodDelete:
+			if err := store.DeleteTemplate(id); err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
 	mux.HandleFunc("/api/chats", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
@@ -244,6 +510,15 @@ func main() {
 
 		parts := strings.Split(rest, "/")
 		if len(parts) == 3 && parts[1] == "messages" {
+			if r.Method == http.MethodDelete {
+				chat, err := store.DeleteMessage(parts[0], parts[2])
+				if err != nil {
+					writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+					return
+				}
+				writeJSON(w, http.StatusOK, chat)
+				return
+			}
 			if r.Method != http.MethodPatch {
 				w.WriteHeader(http.StatusMethodNotAllowed)
 				return
@@ -262,6 +537,20 @@ func main() {
 			return
 		}
 
+		if len(parts) == 4 && parts[1] == "messages" && parts[3] == "restore" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			chat, err := store.RestoreMessage(parts[0], parts[2])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, chat)
+			return
+		}
+
 		if len(parts) == 4 && parts[1] == "messages" && parts[3] == "history" {
 			if r.Method != http.MethodPatch {
 				w.WriteHeader(http.StatusMethodNotAllowed)
@@ -281,6 +570,34 @@ func main() {
 			return
 		}
 
+		if len(parts) == 4 && parts[1] == "messages" && parts[3] == "branches" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			branches, err := store.ListBranches(parts[0], parts[2])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"branches": branches})
+			return
+		}
+
+		if len(parts) == 4 && parts[1] == "messages" && parts[3] == "activate" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			chat, err := store.SwitchBranch(parts[0], parts[2])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, chat)
+			return
+		}
+
 		if len(parts) == 4 && parts[1] == "messages" && parts[3] == "edit" {
 			if r.Method != http.MethodPost {
 				w.WriteHeader(http.StatusMethodNotAllowed)
@@ -291,7 +608,67 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
 				return
 			}
-			chat, err := store.EditUserMessageInPlace(parts[0], parts[2], req.Content, toStateAttachments(req.Attachments))
+			chat, err := store.EditUserMessage(parts[0], parts[2], req.Content, toStateAttachments(req.Attachments))
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, chat)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "usage" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			totals, err := store.ChatUsage(parts[0])
+			if err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, totals)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "export" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			chat, ok := store.GetChat(parts[0])
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "chat not found"})
+				return
+			}
+			folderName := ""
+			if folder, ok := store.FindFolder(chat.FolderID); ok {
+				folderName = folder.Name
+			}
+			versions, _ := strconv.ParseBool(r.URL.Query().Get("versions"))
+			body, contentType, ext, err := exportChat(chat, folderName, strings.ToLower(strings.TrimSpace(r.URL.Query().Get("format"))), versions)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(chat.Title, ext)))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(body)
+			return
+		}
+
+		if len(parts) == 2 && parts[1] == "restore" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			var req restoreChatRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+				return
+			}
+			chat, err := store.RestoreChat(parts[0], strings.TrimSpace(req.FolderID))
 			if err != nil {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 				return
@@ -319,6 +696,34 @@ func main() {
 			return
 		}
 
+		if len(parts) == 2 && parts[1] == "retitle" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			chat, ok := store.GetChat(parts[0])
+			if !ok {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "chat not found"})
+				return
+			}
+			title, err := generateTitle(r.Context(), registry, store.GetConfig(), chat)
+			if errors.Is(err, errNoTitleModel) || errors.Is(err, errTitleProvider) || errors.Is(err, errNothingToTitle) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			if err != nil {
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+				return
+			}
+			chat, err = store.SetGeneratedTitle(parts[0], title, true)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, chat)
+			return
+		}
+
 		if len(parts) == 2 && parts[1] == "regenerate" {
 			if r.Method != http.MethodPost {
 				w.WriteHeader(http.StatusMethodNotAllowed)
@@ -336,9 +741,13 @@ func main() {
 			}
 			effectiveConfig := mergeConfig(store.GetConfig(), req.Config)
 
-			chat, prompt, history, assistantMsg, assistantErr := store.PrepareAssistantRegenerate(parts[0], req.MessageID)
+			chat, prompt, historyLeafID, assistantMsg, assistantErr := store.PrepareAssistantRegenerate(parts[0], req.MessageID)
+			if errors.Is(assistantErr, state.ErrImportedMessage) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": assistantErr.Error()})
+				return
+			}
 			if assistantErr == nil {
-				folder, _ := store.FindFolder(chat.FolderID)
+				settings := store.ChatSettings(chat)
 				target := providers.Target{
 					Provider: strings.ToLower(strings.TrimSpace(assistantMsg.Provider)),
 					Model:    strings.TrimSpace(assistantMsg.Model),
@@ -347,12 +756,17 @@ func main() {
 					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "assistant message is missing provider/model"})
 					return
 				}
-				target.SystemPrompt = strings.TrimSpace(folder.SystemPrompt)
-				if folder.Temperature != nil {
-					t := *folder.Temperature
-					target.Temperature = &t
-				}
-				runStreaming(w, r, registry, parts[0], prompt, []providers.Target{target}, effectiveConfig, history, store, map[string]string{target.Provider + ":" + target.Model: req.MessageID}, false)
+				applyFolderSettings(&target, settings)
+				runStreaming(w, r, runs, runSpec{
+					ChatID:          parts[0],
+					Prompt:          prompt,
+					Targets:         []providers.Target{target},
+					Config:          effectiveConfig,
+					BaseHistory:     chat.Messages,
+					HistoryLeafID:   historyLeafID,
+					ParentID:        assistantMsg.ParentID,
+					ReplaceByTarget: map[string]string{target.Provider + ":" + target.Model: req.MessageID},
+				})
 				return
 			}
 
@@ -361,29 +775,31 @@ func main() {
 				return
 			}
 
-			chat, prompt, history, replaceByTarget, err := store.PrepareUserRegenerate(parts[0], req.MessageID)
+			chat, prompt, historyLeafID, replaceByTarget, err := store.PrepareUserRegenerate(parts[0], req.MessageID)
 			if err != nil {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 				return
 			}
-			folder, _ := store.FindFolder(chat.FolderID)
+			req.Targets, err = state.NormalizeTargets(req.Targets)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			settings := store.ChatSettings(chat)
 			for i := range req.Targets {
-				req.Targets[i].Provider = strings.ToLower(strings.TrimSpace(req.Targets[i].Provider))
-				req.Targets[i].Model = strings.TrimSpace(req.Targets[i].Model)
-				if req.Targets[i].Provider == "" || req.Targets[i].Model == "" {
-					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "each target needs provider and model"})
-					return
-				}
-				if strings.TrimSpace(req.Targets[i].SystemPrompt) == "" {
-					req.Targets[i].SystemPrompt = strings.TrimSpace(folder.SystemPrompt)
-				}
-				if req.Targets[i].Temperature == nil && folder.Temperature != nil {
-					t := *folder.Temperature
-					req.Targets[i].Temperature = &t
-				}
+				applyFolderSettings(&req.Targets[i], settings)
 			}
 
-			runStreaming(w, r, registry, parts[0], prompt, req.Targets, effectiveConfig, history, store, replaceByTarget, false)
+			runStreaming(w, r, runs, runSpec{
+				ChatID:          parts[0],
+				Prompt:          prompt,
+				Targets:         req.Targets,
+				Config:          effectiveConfig,
+				BaseHistory:     chat.Messages,
+				HistoryLeafID:   historyLeafID,
+				ParentID:        req.MessageID,
+				ReplaceByTarget: replaceByTarget,
+			})
 			return
 		}
 
@@ -409,39 +825,31 @@ func main() {
 				return
 			}
 
-			chat, ok := store.GetChat(parts[0])
+			chat, ok := store.GetChatTree(parts[0])
 			if !ok {
 				writeJSON(w, http.StatusNotFound, map[string]string{"error": "chat not found"})
 				return
 			}
-			folder, _ := store.FindFolder(chat.FolderID)
+			settings := store.ChatSettings(chat)
 			effectiveConfig := mergeConfig(store.GetConfig(), req.Config)
-			if strings.TrimSpace(req.Target.SystemPrompt) == "" {
-				req.Target.SystemPrompt = strings.TrimSpace(folder.SystemPrompt)
-			}
-			if req.Target.Temperature == nil && folder.Temperature != nil {
-				t := *folder.Temperature
-				req.Target.Temperature = &t
-			}
+			applyFolderSettings(&req.Target, settings)
 
 			summaryPrompt, err := store.BuildSummaryPrompt(parts[0], req.UserMessageID)
 			if err != nil {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 				return
 			}
-			runStreaming(
-				w,
-				r,
-				registry,
-				parts[0],
-				summaryPrompt,
-				[]providers.Target{req.Target},
-				effectiveConfig,
-				chat.Messages,
-				store,
-				map[string]string{},
-				true,
-			)
+			runStreaming(w, r, runs, runSpec{
+				ChatID:          parts[0],
+				Prompt:          summaryPrompt,
+				Targets:         []providers.Target{req.Target},
+				Config:          effectiveConfig,
+				BaseHistory:     chat.Messages,
+				HistoryLeafID:   req.UserMessageID,
+				ParentID:        req.UserMessageID,
+				ReplaceByTarget: map[string]string{},
+				MarkSummary:     true,
+			})
 			return
 		}
 
@@ -465,12 +873,100 @@ func main() {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
 				return
 			}
-			chat, err := store.UpdateChat(id, req.Title, req.FolderID)
+			update := state.ChatUpdate{Title: req.Title, FolderID: req.FolderID, SystemPrompt: req.SystemPrompt, Targets: req.Targets, Variables: req.Variables}
+			if len(req.Temperature) > 0 {
+				if string(req.Temperature) == "null" {
+					update.ClearTemperature = true
+				} else if err := json.Unmarshal(req.Temperature, &update.Temperature); err != nil {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": "temperature must be a number or null"})
+					return
+				}
+			}
+			chat, err := store.UpdateChat(id, update)
 			if err != nil {
 				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 				return
 			}
 			writeJSON(w, http.StatusOK, chat)
+		case http.MethodDelete:
+			if err := store.DeleteChat(id); err != nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := r.URL.Query()
+		q := state.SearchQuery{
+			Text:     query.Get("q"),
+			FolderID: strings.TrimSpace(query.Get("folderId")),
+			Model:    strings.TrimSpace(query.Get("model")),
+		}
+		var err error
+		if q.From, err = parseSearchDate(query.Get("from"), false); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid from date"})
+			return
+		}
+		if q.To, err = parseSearchDate(query.Get("to"), true); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid to date"})
+			return
+		}
+		if raw := strings.TrimSpace(query.Get("limit")); raw != "" {
+			if q.Limit, err = strconv.Atoi(raw); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"results": store.Search(q)})
+	})
+
+	mux.HandleFunc("/api/import", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		folderID := strings.TrimSpace(r.URL.Query().Get("folderId"))
+		if _, ok := store.FindFolder(folderID); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "folder not found"})
+			return
+		}
+		raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+		if err != nil {
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]string{"error": "import file too large"})
+			return
+		}
+		format, chats, err := parseImport(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		imported, err := store.ImportChats(folderID, chats)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"format": format, "imported": len(imported), "chats": imported})
+	})
+
+	mux.HandleFunc("/api/trash", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, store.ListTrash())
+		case http.MethodDelete:
+			removed, err := store.PurgeTrash(time.Now().UTC())
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"removed": removed})
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
@@ -494,46 +990,130 @@ func main() {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "chatId is required"})
 			return
 		}
+		if req.TemplateID = strings.TrimSpace(req.TemplateID); req.TemplateID != "" {
+			if req.Prompt != "" {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "send either prompt or templateId"})
+				return
+			}
+			rendered, err := store.RenderTemplate(req.TemplateID, req.ChatID, req.Variables)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			req.Prompt = strings.TrimSpace(rendered)
+		}
 		combinedPrompt := mergePromptAndAttachments(req.Prompt, req.Attachments)
 		if strings.TrimSpace(combinedPrompt) == "" {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "prompt or text attachments are required"})
 			return
 		}
+
+		chat, ok := store.GetChatTree(req.ChatID)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "chat not found"})
+			return
+		}
+		if len(req.Targets) == 0 {
+			req.Targets = chat.Targets
+		}
 		if len(req.Targets) == 0 {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "at least one target is required"})
 			return
 		}
+		settings := store.ChatSettings(chat)
+
+		effectiveConfig := mergeConfig(store.GetConfig(), req.Config)
+
+		targets, err := state.NormalizeTargets(req.Targets)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.Targets = targets
+		for i := range req.Targets {
+			applyFolderSettings(&req.Targets[i], settings)
+		}
+
+		userMsg, err := store.AppendUserPrompt(req.ChatID, req.Prompt, toStateAttachments(req.Attachments))
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		runStreaming(w, r, runs, runSpec{
+			ChatID:          req.ChatID,
+			Prompt:          combinedPrompt,
+			Targets:         req.Targets,
+			Config:          effectiveConfig,
+			BaseHistory:     chat.Messages,
+			HistoryLeafID:   userMsg.ParentID,
+			ParentID:        userMsg.ID,
+			ReplaceByTarget: map[string]string{},
+			AutoTitle:       true,
+		})
+	})
+
+	mux.HandleFunc("/api/runs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		chatID := strings.TrimSpace(r.URL.Query().Get("chatId"))
+		writeJSON(w, http.StatusOK, map[string]any{"runs": runs.list(chatID)})
+	})
 
-		chat, ok := store.GetChat(req.ChatID)
+	mux.HandleFunc("/api/runs/", func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/runs/"), "/")
+		if rest == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		parts := strings.Split(rest, "/")
+		run, ok := runs.get(parts[0])
 		if !ok {
-			writeJSON(w, http.StatusNotFound, map[string]string{"error": "chat not found"})
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
 			return
 		}
-		folder, _ := store.FindFolder(chat.FolderID)
 
-		effectiveConfig := mergeConfig(store.GetConfig(), req.Config)
+		if len(parts) == 2 && parts[1] == "stream" {
+			if r.Method != http.MethodGet {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			serveRunStream(w, r, run, lastEventID(r))
+			return
+		}
 
-		for i := range req.Targets {
-			req.Targets[i].Provider = strings.ToLower(strings.TrimSpace(req.Targets[i].Provider))
-			req.Targets[i].Model = strings.TrimSpace(req.Targets[i].Model)
-			if req.Targets[i].Provider == "" || req.Targets[i].Model == "" {
-				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "each target needs provider and model"})
+		if len(parts) == 2 && parts[1] == "cancel" {
+			if r.Method != http.MethodPost {
+				w.WriteHeader(http.StatusMethodNotAllowed)
 				return
 			}
-			if strings.TrimSpace(req.Targets[i].SystemPrompt) == "" {
-				req.Targets[i].SystemPrompt = strings.TrimSpace(folder.SystemPrompt)
+			var req cancelRunRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+				return
 			}
-			if req.Targets[i].Temperature == nil && folder.Temperature != nil {
-				t := *folder.Temperature
-				req.Targets[i].Temperature = &t
+			if err := run.cancelTargets(strings.TrimSpace(req.TargetID)); err != nil {
+				status := http.StatusBadRequest
+				if errors.Is(err, errRunFinished) || errors.Is(err, errTargetFinished) {
+					status = http.StatusConflict
+				}
+				writeJSON(w, status, map[string]string{"error": err.Error()})
+				return
 			}
+			writeJSON(w, http.StatusOK, run.info())
+			return
 		}
 
-		if err := store.AppendUserPrompt(req.ChatID, req.Prompt, toStateAttachments(req.Attachments)); err != nil {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		if len(parts) != 1 {
+			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		runStreaming(w, r, registry, req.ChatID, combinedPrompt, req.Targets, effectiveConfig, chat.Messages, store, map[string]string{}, false)
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, run.info())
 	})
 
 	server := &http.Server{
@@ -551,10 +1131,49 @@ func main() {
 	}
 }
 
-func providerCatalog() []providerInfo {
-	return []providerInfo{
+func providerCatalog(cfg providers.ProviderConfig) []providerInfo {
+	catalog := []providerInfo{
 		{ID: "openrouter", Name: "OpenRouter", Models: []string{"openai/gpt-4o-mini", "anthropic/claude-3.5-sonnet", "meta-llama/llama-3.1-70b-instruct"}},
 		{ID: "ollama", Name: "Ollama", Models: []string{"llama3.2:latest", "qwen2.5", "mistral"}},
+		{ID: "anthropic", Name: "Anthropic", Models: []string{"claude-sonnet-4-5", "claude-haiku-4-5", "claude-opus-4-1"}},
+		{ID: "gemini", Name: "Google Gemini", Models: []string{"gemini-2.5-flash", "gemini-2.5-pro"}},
+	}
+	for _, ep := range cfg.OpenAICompatible {
+		id := providers.NormalizeEndpointID(ep.ID)
+		if id == "" {
+			continue
+		}
+		name := strings.TrimSpace(ep.Name)
+		if name == "" {
+			name = id
+		}
+		models := append([]string{}, ep.Models...)
+		catalog = append(catalog, providerInfo{ID: id, Name: name, Models: models})
+	}
+	return catalog
+}
+
+func resolveAdapter(registry map[string]providers.Adapter, cfg providers.ProviderConfig, provider string) (providers.Adapter, bool) {
+	if _, ok := cfg.Endpoint(provider); ok {
+		adapter, exists := registry["openai_compatible"]
+		return adapter, exists
+	}
+	if provider == "openai_compatible" {
+		return nil, false
+	}
+	adapter, exists := registry[provider]
+	return adapter, exists
+}
+
+// applyFolderSettings fills in the system prompt and temperature a target
+// leaves unset from the folder's effective settings.
+func applyFolderSettings(target *providers.Target, settings state.FolderSettings) {
+	if strings.TrimSpace(target.SystemPrompt) == "" {
+		target.SystemPrompt = settings.SystemPrompt
+	}
+	if target.Temperature == nil && settings.Temperature != nil {
+		t := *settings.Temperature
+		target.Temperature = &t
 	}
 }
 
@@ -575,12 +1194,90 @@ func mergeConfig(base, override providers.ProviderConfig) providers.ProviderConf
 	if len(override.Ollama.Models) > 0 {
 		merged.Ollama.Models = override.Ollama.Models
 	}
+	if strings.TrimSpace(override.Anthropic.APIKey) != "" {
+		merged.Anthropic.APIKey = strings.TrimSpace(override.Anthropic.APIKey)
+	}
+	if strings.TrimSpace(override.Anthropic.BaseURL) != "" {
+		merged.Anthropic.BaseURL = strings.TrimSpace(override.Anthropic.BaseURL)
+	}
+	if override.Anthropic.MaxTokens > 0 {
+		merged.Anthropic.MaxTokens = override.Anthropic.MaxTokens
+	}
+	if len(override.Anthropic.Models) > 0 {
+		merged.Anthropic.Models = override.Anthropic.Models
+	}
+	if strings.TrimSpace(override.Gemini.APIKey) != "" {
+		merged.Gemini.APIKey = strings.TrimSpace(override.Gemini.APIKey)
+	}
+	if strings.TrimSpace(override.Gemini.BaseURL) != "" {
+		merged.Gemini.BaseURL = strings.TrimSpace(override.Gemini.BaseURL)
+	}
+	if len(override.Gemini.Models) > 0 {
+		merged.Gemini.Models = override.Gemini.Models
+	}
+	merged.OpenAICompatible = mergeEndpoints(base.OpenAICompatible, override.OpenAICompatible)
 	return merged
 }
 
-func buildTargetHistory(messages []state.Message, targetID string) []providers.HistoryMessage {
-	history := make([]providers.HistoryMessage, 0, len(messages))
-	for _, msg := range messages {
+func mergeEndpoints(base, override []providers.OpenAICompatibleConfig) []providers.OpenAICompatibleConfig {
+	merged := append([]providers.OpenAICompatibleConfig{}, base...)
+	for _, ov := range override {
+		id := providers.NormalizeEndpointID(ov.ID)
+		if id == "" {
+			continue
+		}
+		idx := -1
+		for i := range merged {
+			if providers.NormalizeEndpointID(merged[i].ID) == id {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			merged = append(merged, ov)
+			continue
+		}
+		if strings.TrimSpace(ov.Name) != "" {
+			merged[idx].Name = strings.TrimSpace(ov.Name)
+		}
+		if strings.TrimSpace(ov.BaseURL) != "" {
+			merged[idx].BaseURL = strings.TrimSpace(ov.BaseURL)
+		}
+		if strings.TrimSpace(ov.APIKey) != "" {
+			merged[idx].APIKey = strings.TrimSpace(ov.APIKey)
+		}
+		if strings.TrimSpace(ov.APIKeyHeader) != "" {
+			merged[idx].APIKeyHeader = strings.TrimSpace(ov.APIKeyHeader)
+		}
+		if len(ov.Models) > 0 {
+			merged[idx].Models = ov.Models
+		}
+		if ov.StreamUsage {
+			merged[idx].StreamUsage = true
+		}
+	}
+	return merged
+}
+
+// buildTargetHistory walks the branch from the root to the turn of leafID and
+// keeps the messages targetID may see.
+func buildTargetHistory(messages []state.Message, leafID, targetID string) []providers.HistoryMessage {
+	return historyFromMessages(targetMessages(messages, leafID, targetID))
+}
+
+// targetMessages returns the messages on the path to leafID that a target
+// sees. The newest compaction summary on the path replaces everything before
+// it.
+func targetMessages(messages []state.Message, leafID, targetID string) []state.Message {
+	path := state.ActivePath(messages, leafID)
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].Compaction && messageIncludedForTarget(path[i], targetID) {
+			path = path[i:]
+			break
+		}
+	}
+	out := make([]state.Message, 0, len(path))
+	for _, msg := range path {
 		content := mergePromptAndStateAttachments(msg.Content, msg.Attachments)
 		if strings.TrimSpace(content) == "" || strings.TrimSpace(msg.Role) == "" {
 			continue
@@ -588,15 +1285,33 @@ func buildTargetHistory(messages []state.Message, targetID string) []providers.H
 		if !messageIncludedForTarget(msg, targetID) {
 			continue
 		}
+		out = append(out, msg)
+	}
+	return out
+}
+
+func historyFromMessages(messages []state.Message) []providers.HistoryMessage {
+	history := make([]providers.HistoryMessage, 0, len(messages))
+	for _, msg := range messages {
 		history = append(history, providers.HistoryMessage{
 			Role:    msg.Role,
-			Content: content,
+			Content: mergePromptAndStateAttachments(msg.Content, msg.Attachments),
 		})
 	}
 	return history
 }
 
 func messageIncludedForTarget(msg state.Message, targetID string) bool {
+	if msg.DeletedAt != nil {
+		return false
+	}
+	if msg.Status == state.MessageStatusStreaming || msg.Status == state.MessageStatusError {
+		return false
+	}
+	// A target cancelled before its first token leaves an empty answer.
+	if msg.Status == state.MessageStatusCancelled && strings.TrimSpace(msg.Content) == "" {
+		return false
+	}
 	switch strings.TrimSpace(strings.ToLower(msg.Inclusion)) {
 	case "dont_include":
 		return false
@@ -623,143 +1338,104 @@ func messageIncludedForTarget(msg state.Message, targetID string) bool {
 	}
 }
 
-func runStreaming(
-	w http.ResponseWriter,
-	r *http.Request,
-	registry map[string]providers.Adapter,
-	chatID string,
-	prompt string,
-	targets []providers.Target,
-	effectiveConfig providers.ProviderConfig,
-	baseHistory []state.Message,
-	store *state.Store,
-	replaceByTarget map[string]string,
-	markSummary bool,
-) {
-	flusher, ok := w.(http.Flusher)
-	if !ok {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
-		return
-	}
-
-	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("X-Accel-Buffering", "no")
-
-	ctx, cancel := context.WithCancel(r.Context())
-	defer cancel()
-
-	events := make(chan providers.StreamEvent, 256)
-	var wg sync.WaitGroup
-
-	emit := func(ev providers.StreamEvent) error {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case events <- ev:
-			return nil
+// openStore opens the state in dataDir. The first SQLite start imports an
+// existing state.json once; the JSON file is left in place.
+func openStore(storage, dataDir string) (*state.Store, error) {
+	jsonPath := filepath.Join(dataDir, "state.json")
+	switch storage {
+	case "json":
+		return state.New(jsonPath)
+	case "sqlite":
+		backend, err := state.OpenSQLite(filepath.Join(dataDir, "state.db"))
+		if err != nil {
+			return nil, err
 		}
-	}
-
-	for _, target := range targets {
-		adapter, exists := registry[target.Provider]
-		if !exists {
-			_ = emit(providers.StreamEvent{
-				TargetID: target.Provider + ":" + target.Model,
-				Provider: target.Provider,
-				Model:    target.Model,
-				Event:    "error",
-				Error:    "unsupported provider",
-			})
-			continue
+		imported, err := state.ImportJSON(jsonPath, backend)
+		if err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("import %s: %w", jsonPath, err)
 		}
-
-		wg.Add(1)
-		go func(t providers.Target, a providers.Adapter) {
-			defer wg.Done()
-			targetID := t.Provider + ":" + t.Model
-			history := buildTargetHistory(baseHistory, targetID)
-
-			_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "start"})
-			err := a.Stream(ctx, providers.StreamRequest{Prompt: prompt, Target: t, Config: effectiveConfig, History: history}, emit)
-			if err != nil && !errors.Is(err, context.Canceled) {
-				_ = emit(providers.StreamEvent{
-					TargetID: targetID,
-					Provider: t.Provider,
-					Model:    t.Model,
-					Event:    "error",
-					Error:    err.Error(),
-				})
-			}
-			_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "end"})
-		}(target, adapter)
+		if imported {
+			log.Printf("imported %s into SQLite storage", jsonPath)
+		}
+		store, err := state.Open(backend)
+		if err != nil {
+			backend.Close()
+			return nil, err
+		}
+		return store, nil
+	default:
+		return nil, fmt.Errorf("unknown storage %q (want json or sqlite)", storage)
 	}
+}
 
-	go func() {
-		wg.Wait()
-		close(events)
-	}()
-
-	outputs := map[string]state.Message{}
-	enc := json.NewEncoder(w)
-	for ev := range events {
-		if ev.Event == "chunk" {
-			out := outputs[ev.TargetID]
-			out.TargetID = ev.TargetID
-			out.Provider = ev.Provider
-			out.Model = ev.Model
-			out.IsSummary = markSummary
-			if markSummary {
-				out.Inclusion = "always"
-				out.ScopeID = ""
-			} else {
-				out.Inclusion = "model_only"
-				out.ScopeID = ev.TargetID
-			}
-			out.Content += ev.Content
-			outputs[ev.TargetID] = out
+// dryRunMigrations opens the state read-only, so nothing in dataDir is
+// created, restored or upgraded.
+func dryRunMigrations(storage, dataDir string) (state.MigrationReport, error) {
+	jsonPath := filepath.Join(dataDir, "state.json")
+	switch storage {
+	case "json":
+		return state.DryRunMigrations(state.NewReadOnlyJSONBackend(jsonPath))
+	case "sqlite":
+		dbPath := filepath.Join(dataDir, "state.db")
+		if _, err := os.Stat(dbPath); errors.Is(err, os.ErrNotExist) {
+			// The first start would import and migrate state.json.
+			return state.DryRunMigrations(state.NewReadOnlyJSONBackend(jsonPath))
 		}
-
-		_, _ = fmt.Fprint(w, "event: message\n")
-		_, _ = fmt.Fprint(w, "data: ")
-		if err := enc.Encode(ev); err != nil {
-			return
+		backend, err := state.OpenSQLiteReadOnly(dbPath)
+		if err != nil {
+			return state.MigrationReport{}, err
 		}
-		_, _ = fmt.Fprint(w, "\n")
-		flusher.Flush()
+		defer backend.Close()
+		if _, found, err := backend.Load(); err == nil && !found {
+			return state.DryRunMigrations(state.NewReadOnlyJSONBackend(jsonPath))
+		}
+		return state.DryRunMigrations(backend)
+	default:
+		return state.MigrationReport{}, fmt.Errorf("unknown storage %q (want json or sqlite)", storage)
 	}
+}
 
-	assistantMessages := make([]state.Message, 0, len(outputs))
-	for _, out := range outputs {
-		assistantMessages = append(assistantMessages, out)
+// parseSearchDate accepts RFC 3339 timestamps or plain dates; a plain "to"
+// date includes the whole day.
+func parseSearchDate(raw string, endOfDay bool) (time.Time, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, nil
 	}
-	appendList := make([]state.Message, 0, len(assistantMessages))
-	for _, out := range assistantMessages {
-		if messageID, ok := replaceByTarget[out.TargetID]; ok && strings.TrimSpace(messageID) != "" {
-			if err := store.ReplaceAssistantMessage(chatID, messageID, out); err != nil {
-				log.Printf("replace assistant message failed: %v", err)
-			}
-		} else {
-			appendList = append(appendList, out)
-		}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
 	}
-	if len(appendList) > 0 {
-		if err := store.AppendAssistantMessages(chatID, appendList); err != nil {
-			log.Printf("persist assistant messages failed: %v", err)
-		}
+	t, err := time.Parse("2006-01-02", raw)
+	if err != nil {
+		return time.Time{}, err
 	}
+	if endOfDay {
+		t = t.Add(24*time.Hour - time.Nanosecond)
+	}
+	return t, nil
+}
 
-	_, _ = fmt.Fprint(w, "event: done\n")
-	_, _ = fmt.Fprint(w, "data: {\"event\":\"done\"}\n\n")
-	flusher.Flush()
+func purgeTrashLoop(store *state.Store) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		removed, err := store.PurgeTrash(time.Now().UTC().Add(-trashRetention))
+		if err != nil {
+			log.Printf("trash purge failed: %v", err)
+		} else if removed > 0 {
+			log.Printf("purged %d expired trash item(s)", removed)
+		}
+		<-ticker.C
+	}
 }
 
 func withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization,Last-Event-ID")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Run-Id")
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusNoContent)
 			return
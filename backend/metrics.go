@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"time"
+
+	"llm-mux/backend/internal/providers"
+)
+
+// streamMeter times a single target's stream. It is only touched from the
+// goroutine driving that target's adapter.
+type streamMeter struct {
+	start            time.Time
+	firstToken       time.Time
+	chars            int
+	completionTokens int
+}
+
+func newStreamMeter() *streamMeter {
+	return &streamMeter{start: time.Now()}
+}
+
+func (m *streamMeter) observe(ev providers.StreamEvent) {
+	switch ev.Event {
+	case "chunk":
+		if m.firstToken.IsZero() {
+			m.firstToken = time.Now()
+		}
+		m.chars += len(ev.Content)
+	case "usage":
+		if ev.Usage != nil {
+			m.completionTokens = ev.Usage.CompletionTokens
+		}
+	}
+}
+
+// finish returns nil when the target never produced output. Throughput is
+// measured over the generation phase only, so a slow first token does not
+// drag it down; without provider usage it falls back to the chars/4 estimate.
+func (m *streamMeter) finish() *providers.Metrics {
+	if m.firstToken.IsZero() {
+		return nil
+	}
+	end := time.Now()
+	metrics := &providers.Metrics{
+		TimeToFirstTokenMs: m.firstToken.Sub(m.start).Milliseconds(),
+		DurationMs:         end.Sub(m.start).Milliseconds(),
+	}
+	tokens := m.completionTokens
+	if tokens <= 0 {
+		tokens = int(math.Ceil(float64(m.chars) / 4.0))
+	}
+	generation := end.Sub(m.firstToken)
+	if generation <= 0 {
+		generation = end.Sub(m.start)
+	}
+	if generation > 0 {
+		metrics.TokensPerSecond = math.Round(float64(tokens)/generation.Seconds()*10) / 10
+	}
+	return metrics
+}
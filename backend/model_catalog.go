@@ -0,0 +1,693 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"llm-mux/backend/internal/providers"
+	"llm-mux/backend/internal/state"
+)
+
+const (
+	// modelCatalogTTL is how long a provider's model list counts as fresh.
+	// Stale lists are still served while a refresh runs in the background.
+	modelCatalogTTL = 6 * time.Hour
+	// modelCatalogRetry spaces out refreshes of a provider that keeps failing.
+	modelCatalogRetry     = 2 * time.Minute
+	modelCatalogInterval  = 15 * time.Minute
+	modelCatalogFile      = "models.json"
+	contextLimitCacheTTL  = 10 * time.Minute
+	modelCatalogFetchTime = 12 * time.Second
+)
+
+type modelInfo struct {
+	ID               string        `json:"id"`
+	Name             string        `json:"name,omitempty"`
+	ContextLength    int           `json:"contextLength,omitempty"`
+	MaxOutputTokens  int           `json:"maxOutputTokens,omitempty"`
+	Pricing          *modelPricing `json:"pricing,omitempty"`
+	InputModalities  []string      `json:"inputModalities,omitempty"`
+	OutputModalities []string      `json:"outputModalities,omitempty"`
+	// Capabilities lists what the model supports beyond chat: "tools",
+	// "vision", "reasoning" or "embedding".
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// modelPricing is in USD per million tokens.
+type modelPricing struct {
+	Prompt     float64 `json:"prompt"`
+	Completion float64 `json:"completion"`
+}
+
+// providerModels is one provider's model list as last fetched from Source.
+type providerModels struct {
+	Provider  string      `json:"provider"`
+	Source    string      `json:"source"`
+	FetchedAt time.Time   `json:"fetchedAt"`
+	Stale     bool        `json:"stale,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	Models    []modelInfo `json:"models"`
+
+	attemptedAt time.Time
+}
+
+// modelCatalog caches model metadata per provider so context limits and the
+// model list do not query providers on every request. The cache is written
+// to disk and served, stale if need be, when providers are unreachable.
+type modelCatalog struct {
+	path   string
+	client *http.Client
+
+	mu      sync.Mutex
+	entries map[string]*providerModels
+	limits  map[string]cachedContextLimit
+	locks   map[string]*sync.Mutex
+}
+
+// cachedContextLimit is a single-model lookup; failures are kept too, so an
+// unknown model is not asked about on every request.
+type cachedContextLimit struct {
+	limit     int
+	err       error
+	fetchedAt time.Time
+}
+
+func newModelCatalog(dataDir string) *modelCatalog {
+	c := &modelCatalog{
+		path:    filepath.Join(dataDir, modelCatalogFile),
+		client:  &http.Client{Timeout: modelCatalogFetchTime},
+		entries: map[string]*providerModels{},
+		limits:  map[string]cachedContextLimit{},
+		locks:   map[string]*sync.Mutex{},
+	}
+	raw, err := os.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("warning: model catalog %s unreadable: %v", c.path, err)
+		}
+		return c
+	}
+	var saved []providerModels
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		log.Printf("warning: model catalog %s unreadable: %v", c.path, err)
+		return c
+	}
+	for i := range saved {
+		saved[i].Stale = false
+		c.entries[saved[i].Provider] = &saved[i]
+	}
+	return c
+}
+
+// Models returns a provider's model list. A missing list, or one fetched from
+// a different base URL, is fetched right away; a stale one is returned as is
+// and refreshed in the background.
+func (c *modelCatalog) Models(cfg providers.ProviderConfig, provider string) providerModels {
+	source := catalogSource(cfg, provider)
+	if source == "" {
+		return providerModels{Provider: provider, Error: "unsupported provider", Models: []modelInfo{}}
+	}
+	entry, ok := c.entry(provider)
+	if !ok || entry.Source != source {
+		c.refresh(cfg, provider, false)
+		entry, _ = c.entry(provider)
+	} else if entry.Stale {
+		go c.refresh(cfg, provider, false)
+	}
+	return entry
+}
+
+// List returns the model lists of several providers, fetched concurrently;
+// force refetches them even when fresh.
+func (c *modelCatalog) List(cfg providers.ProviderConfig, ids []string, force bool) []providerModels {
+	lists := make([]providerModels, len(ids))
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			if force {
+				c.refresh(cfg, id, true)
+			}
+			lists[i] = c.Models(cfg, id)
+		}(i, id)
+	}
+	wg.Wait()
+	return lists
+}
+
+// ContextLimit looks a model up in the cached list without waiting for a
+// fetch; a missing or stale list is refreshed in the background. Models the
+// list does not know are asked about one at a time, never by downloading the
+// whole list again.
+func (c *modelCatalog) ContextLimit(cfg providers.ProviderConfig, provider, model string) (int, error) {
+	if m, ok := findModel(c.cached(cfg, provider).Models, model); ok && m.ContextLength > 0 {
+		return m.ContextLength, nil
+	}
+
+	key := provider + ":" + model
+	c.mu.Lock()
+	cached, ok := c.limits[key]
+	c.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < contextLimitCacheTTL {
+		return cached.limit, cached.err
+	}
+	limit, err := fetchContextLimit(c.client, cfg, provider, model)
+	c.mu.Lock()
+	c.limits[key] = cachedContextLimit{limit: limit, err: err, fetchedAt: time.Now()}
+	c.mu.Unlock()
+	return limit, err
+}
+
+// cached returns a provider's list as far as it is known, without fetching.
+// A missing list, a stale one or one from a different base URL is refreshed
+// in the background.
+func (c *modelCatalog) cached(cfg providers.ProviderConfig, provider string) providerModels {
+	source := catalogSource(cfg, provider)
+	if source == "" {
+		return providerModels{Provider: provider, Models: []modelInfo{}}
+	}
+	entry, ok := c.entry(provider)
+	if !ok || entry.Source != source {
+		go c.refresh(cfg, provider, false)
+		return providerModels{Provider: provider, Models: []modelInfo{}}
+	}
+	if entry.Stale {
+		go c.refresh(cfg, provider, false)
+	}
+	return entry
+}
+
+// refresh fetches a provider's model list unless it is fresh or was tried
+// recently; force skips both checks. A failed fetch keeps the previous models
+// from the same source and records the error.
+func (c *modelCatalog) refresh(cfg providers.ProviderConfig, provider string, force bool) {
+	lock := c.providerLock(provider)
+	lock.Lock()
+	defer lock.Unlock()
+
+	source := catalogSource(cfg, provider)
+	if source == "" {
+		return
+	}
+	c.mu.Lock()
+	prev := c.entries[provider]
+	c.mu.Unlock()
+	if !force && prev != nil && prev.Source == source {
+		if time.Since(prev.FetchedAt) < modelCatalogTTL || time.Since(prev.attemptedAt) < modelCatalogRetry {
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	models, err := fetchModelList(c.client, cfg, provider)
+	next := &providerModels{Provider: provider, Source: source, attemptedAt: now, Models: []modelInfo{}}
+	if err != nil {
+		log.Printf("model list for %s failed: %v", provider, err)
+		next.Error = err.Error()
+		if prev != nil && prev.Source == source {
+			next.FetchedAt = prev.FetchedAt
+			next.Models = prev.Models
+		}
+	} else {
+		next.FetchedAt = now
+		next.Models = models
+	}
+
+	c.mu.Lock()
+	c.entries[provider] = next
+	c.mu.Unlock()
+	if err := c.save(); err != nil {
+		log.Printf("save model catalog failed: %v", err)
+	}
+}
+
+// refreshLoop keeps the lists of every configured provider fresh.
+func (c *modelCatalog) refreshLoop(store *state.Store) {
+	ticker := time.NewTicker(modelCatalogInterval)
+	defer ticker.Stop()
+	for {
+		cfg := store.GetConfig()
+		for _, provider := range configuredProviders(cfg) {
+			c.refresh(cfg, provider, false)
+		}
+		<-ticker.C
+	}
+}
+
+func (c *modelCatalog) entry(provider string) (providerModels, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[provider]
+	if !ok {
+		return providerModels{Provider: provider, Models: []modelInfo{}}, false
+	}
+	out := *e
+	out.Models = append([]modelInfo{}, e.Models...)
+	out.Stale = time.Since(e.FetchedAt) >= modelCatalogTTL
+	return out, true
+}
+
+func (c *modelCatalog) providerLock(provider string) *sync.Mutex {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lock, ok := c.locks[provider]
+	if !ok {
+		lock = &sync.Mutex{}
+		c.locks[provider] = lock
+	}
+	return lock
+}
+
+func (c *modelCatalog) save() error {
+	c.mu.Lock()
+	saved := make([]providerModels, 0, len(c.entries))
+	for _, e := range c.entries {
+		saved = append(saved, *e)
+	}
+	c.mu.Unlock()
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Provider < saved[j].Provider })
+	payload, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return state.WriteFileAtomic(c.path, payload)
+}
+
+// configuredProviders lists the providers with enough config to be in use.
+func configuredProviders(cfg providers.ProviderConfig) []string {
+	var out []string
+	if strings.TrimSpace(cfg.OpenRouter.APIKey) != "" {
+		out = append(out, "openrouter")
+	}
+	if strings.TrimSpace(cfg.Ollama.BaseURL) != "" {
+		out = append(out, "ollama")
+	}
+	if strings.TrimSpace(cfg.Anthropic.APIKey) != "" {
+		out = append(out, "anthropic")
+	}
+	if strings.TrimSpace(cfg.Gemini.APIKey) != "" {
+		out = append(out, "gemini")
+	}
+	for _, ep := range cfg.OpenAICompatible {
+		if id := providers.NormalizeEndpointID(ep.ID); id != "" {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// catalogSource is the base URL a provider's list comes from; a changed base
+// URL invalidates the cached list.
+func catalogSource(cfg providers.ProviderConfig, provider string) string {
+	switch provider {
+	case "openrouter":
+		return openRouterBaseURL(cfg.OpenRouter)
+	case "ollama":
+		return ollamaBaseURL(cfg.Ollama)
+	case "anthropic":
+		return providers.AnthropicBaseURL(cfg.Anthropic)
+	case "gemini":
+		return providers.GeminiBaseURL(cfg.Gemini)
+	default:
+		if endpoint, ok := cfg.Endpoint(provider); ok {
+			return strings.TrimSuffix(strings.TrimSpace(endpoint.BaseURL), "/")
+		}
+		return ""
+	}
+}
+
+func fetchModelList(client *http.Client, cfg providers.ProviderConfig, provider string) ([]modelInfo, error) {
+	switch provider {
+	case "openrouter":
+		return fetchOpenRouterModels(client, cfg.OpenRouter)
+	case "ollama":
+		return fetchOllamaModels(client, cfg.Ollama)
+	case "anthropic":
+		return fetchAnthropicModels(client, cfg.Anthropic)
+	case "gemini":
+		return fetchGeminiModels(client, cfg.Gemini)
+	default:
+		if endpoint, ok := cfg.Endpoint(provider); ok {
+			return fetchOpenAICompatibleModels(client, endpoint)
+		}
+		return nil, fmt.Errorf("unsupported provider")
+	}
+}
+
+func findModel(models []modelInfo, model string) (modelInfo, bool) {
+	want := strings.ToLower(strings.TrimSpace(model))
+	for _, m := range models {
+		if strings.ToLower(m.ID) == want {
+			return m, true
+		}
+	}
+	return modelInfo{}, false
+}
+
+func openRouterBaseURL(cfg providers.OpenRouterConfig) string {
+	baseURL := strings.TrimSpace(cfg.BaseURL)
+	if baseURL == "" {
+		baseURL = "https://openrouter.ai/api/v1"
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+func ollamaBaseURL(cfg providers.OllamaConfig) string {
+	baseURL := strings.TrimSpace(cfg.BaseURL)
+	if baseURL == "" {
+		baseURL = "http://localhost:11434"
+	}
+	return strings.TrimSuffix(baseURL, "/")
+}
+
+// getJSON sends req and decodes the JSON reply into out; label names the
+// provider in error messages.
+func getJSON(client *http.Client, req *http.Request, label string, out any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %d: %s", label, resp.StatusCode, strings.TrimSpace(string(b)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func fetchOpenRouterModels(client *http.Client, cfg providers.OpenRouterConfig) ([]modelInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, openRouterBaseURL(cfg)+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(cfg.APIKey) != "" {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(cfg.APIKey))
+	}
+	var raw struct {
+		Data []struct {
+			ID            string `json:"id"`
+			Name          string `json:"name"`
+			ContextLength any    `json:"context_length"`
+			Architecture  struct {
+				InputModalities  []string `json:"input_modalities"`
+				OutputModalities []string `json:"output_modalities"`
+			} `json:"architecture"`
+			Pricing struct {
+				Prompt     any `json:"prompt"`
+				Completion any `json:"completion"`
+			} `json:"pricing"`
+			TopProvider struct {
+				MaxCompletionTokens any `json:"max_completion_tokens"`
+			} `json:"top_provider"`
+			SupportedParameters []string `json:"supported_parameters"`
+		} `json:"data"`
+	}
+	if err := getJSON(client, req, "openrouter", &raw); err != nil {
+		return nil, err
+	}
+	models := make([]modelInfo, 0, len(raw.Data))
+	for _, item := range raw.Data {
+		m := modelInfo{
+			ID:               strings.TrimSpace(item.ID),
+			Name:             item.Name,
+			InputModalities:  item.Architecture.InputModalities,
+			OutputModalities: item.Architecture.OutputModalities,
+		}
+		m.ContextLength, _ = toInt(item.ContextLength)
+		m.MaxOutputTokens, _ = toInt(item.TopProvider.MaxCompletionTokens)
+		prompt, okPrompt := perMillion(item.Pricing.Prompt)
+		completion, okCompletion := perMillion(item.Pricing.Completion)
+		if okPrompt || okCompletion {
+			m.Pricing = &modelPricing{Prompt: prompt, Completion: completion}
+		}
+		for _, p := range item.SupportedParameters {
+			switch p {
+			case "tools", "reasoning":
+				m.Capabilities = appendUnique(m.Capabilities, p)
+			}
+		}
+		for _, modality := range m.InputModalities {
+			if modality == "image" {
+				m.Capabilities = appendUnique(m.Capabilities, "vision")
+			}
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+func fetchOpenAICompatibleModels(client *http.Client, endpoint providers.OpenAICompatibleConfig) ([]modelInfo, error) {
+	baseURL := strings.TrimSuffix(strings.TrimSpace(endpoint.BaseURL), "/")
+	if baseURL == "" {
+		return nil, fmt.Errorf("%s.baseUrl is required", endpoint.ID)
+	}
+	req, err := http.NewRequest(http.MethodGet, baseURL+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(endpoint.APIKey) != "" {
+		header, value := providers.EndpointAuthHeader(endpoint)
+		req.Header.Set(header, value)
+	}
+	// Servers disagree on the field name: vLLM uses max_model_len, LM Studio and
+	// most gateways follow OpenRouter's context_length.
+	var raw struct {
+		Data []struct {
+			ID            string `json:"id"`
+			ContextLength any    `json:"context_length"`
+			MaxModelLen   any    `json:"max_model_len"`
+			ContextWindow any    `json:"context_window"`
+		} `json:"data"`
+	}
+	if err := getJSON(client, req, endpoint.ID, &raw); err != nil {
+		return nil, err
+	}
+	models := make([]modelInfo, 0, len(raw.Data))
+	for _, item := range raw.Data {
+		m := modelInfo{ID: strings.TrimSpace(item.ID)}
+		for _, v := range []any{item.ContextLength, item.MaxModelLen, item.ContextWindow} {
+			if n, ok := toInt(v); ok && n > 0 {
+				m.ContextLength = n
+				break
+			}
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+func fetchOllamaModels(client *http.Client, cfg providers.OllamaConfig) ([]modelInfo, error) {
+	req, err := http.NewRequest(http.MethodGet, ollamaBaseURL(cfg)+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	var raw struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := getJSON(client, req, "ollama", &raw); err != nil {
+		return nil, err
+	}
+	// Only /api/show knows context length and capabilities; Ollama is local, so
+	// asking per model is cheap.
+	models := make([]modelInfo, 0, len(raw.Models))
+	for _, item := range raw.Models {
+		m, err := fetchOllamaModel(client, cfg, item.Name)
+		if err != nil {
+			m = modelInfo{ID: item.Name}
+		}
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+func fetchOllamaModel(client *http.Client, cfg providers.OllamaConfig, model string) (modelInfo, error) {
+	body, _ := json.Marshal(map[string]string{"model": model})
+	req, err := http.NewRequest(http.MethodPost, ollamaBaseURL(cfg)+"/api/show", bytes.NewReader(body))
+	if err != nil {
+		return modelInfo{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var raw struct {
+		ModelInfo    map[string]any `json:"model_info"`
+		Details      map[string]any `json:"details"`
+		Capabilities []string       `json:"capabilities"`
+	}
+	if err := getJSON(client, req, "ollama", &raw); err != nil {
+		return modelInfo{}, err
+	}
+
+	m := modelInfo{ID: model, InputModalities: []string{"text"}, OutputModalities: []string{"text"}}
+	for k, v := range raw.ModelInfo {
+		if strings.Contains(strings.ToLower(k), "context_length") {
+			if n, ok := toInt(v); ok && n > 0 {
+				m.ContextLength = n
+				break
+			}
+		}
+	}
+	if m.ContextLength == 0 {
+		for k, v := range raw.Details {
+			if strings.Contains(strings.ToLower(k), "context") {
+				if n, ok := toInt(v); ok && n > 0 {
+					m.ContextLength = n
+					break
+				}
+			}
+		}
+	}
+	for _, c := range raw.Capabilities {
+		switch c {
+		case "tools", "vision", "embedding":
+			m.Capabilities = appendUnique(m.Capabilities, c)
+		case "thinking":
+			m.Capabilities = appendUnique(m.Capabilities, "reasoning")
+		}
+		if c == "vision" {
+			m.InputModalities = append(m.InputModalities, "image")
+		}
+	}
+	return m, nil
+}
+
+func fetchAnthropicModels(client *http.Client, cfg providers.AnthropicConfig) ([]modelInfo, error) {
+	apiKey := strings.TrimSpace(cfg.APIKey)
+	if apiKey == "" {
+		return nil, fmt.Errorf("anthropic.apiKey is required")
+	}
+	var models []modelInfo
+	afterID := ""
+	for {
+		query := url.Values{"limit": {"1000"}}
+		if afterID != "" {
+			query.Set("after_id", afterID)
+		}
+		req, err := http.NewRequest(http.MethodGet, providers.AnthropicBaseURL(cfg)+"/models?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-api-key", apiKey)
+		req.Header.Set("anthropic-version", providers.AnthropicVersion)
+		var raw struct {
+			Data []struct {
+				ID          string `json:"id"`
+				DisplayName string `json:"display_name"`
+			} `json:"data"`
+			HasMore bool   `json:"has_more"`
+			LastID  string `json:"last_id"`
+		}
+		if err := getJSON(client, req, "anthropic", &raw); err != nil {
+			return nil, err
+		}
+		// The list carries no limits; every Claude model takes text and images
+		// and supports tools.
+		for _, item := range raw.Data {
+			m := modelInfo{
+				ID:               item.ID,
+				Name:             item.DisplayName,
+				InputModalities:  []string{"text", "image"},
+				OutputModalities: []string{"text"},
+				Capabilities:     []string{"tools", "vision"},
+			}
+			m.ContextLength, _ = anthropicContextLimit(item.ID)
+			models = append(models, m)
+		}
+		if !raw.HasMore || raw.LastID == "" {
+			return models, nil
+		}
+		afterID = raw.LastID
+	}
+}
+
+func fetchGeminiModels(client *http.Client, cfg providers.GeminiConfig) ([]modelInfo, error) {
+	apiKey := strings.TrimSpace(cfg.APIKey)
+	if apiKey == "" {
+		return nil, fmt.Errorf("gemini.apiKey is required")
+	}
+	var models []modelInfo
+	pageToken := ""
+	for {
+		query := url.Values{"pageSize": {"1000"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		req, err := http.NewRequest(http.MethodGet, providers.GeminiBaseURL(cfg)+"/models?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-goog-api-key", apiKey)
+		var raw struct {
+			Models []struct {
+				Name                       string   `json:"name"`
+				DisplayName                string   `json:"displayName"`
+				InputTokenLimit            any      `json:"inputTokenLimit"`
+				OutputTokenLimit           any      `json:"outputTokenLimit"`
+				SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+				Thinking                   bool     `json:"thinking"`
+			} `json:"models"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := getJSON(client, req, "gemini", &raw); err != nil {
+			return nil, err
+		}
+		for _, item := range raw.Models {
+			m := modelInfo{ID: providers.GeminiModelName(item.Name), Name: item.DisplayName}
+			m.ContextLength, _ = toInt(item.InputTokenLimit)
+			m.MaxOutputTokens, _ = toInt(item.OutputTokenLimit)
+			for _, method := range item.SupportedGenerationMethods {
+				if method == "embedContent" {
+					m.Capabilities = appendUnique(m.Capabilities, "embedding")
+				}
+			}
+			if item.Thinking {
+				m.Capabilities = appendUnique(m.Capabilities, "reasoning")
+			}
+			models = append(models, m)
+		}
+		if raw.NextPageToken == "" {
+			return models, nil
+		}
+		pageToken = raw.NextPageToken
+	}
+}
+
+// perMillion converts OpenRouter's per-token USD price strings.
+func perMillion(v any) (float64, bool) {
+	var f float64
+	switch p := v.(type) {
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return 0, false
+		}
+		f = parsed
+	case float64:
+		f = p
+	default:
+		return 0, false
+	}
+	return f * 1e6, true
+}
+
+func appendUnique(list []string, v string) []string {
+	for _, existing := range list {
+		if existing == v {
+			return list
+		}
+	}
+	return append(list, v)
+}
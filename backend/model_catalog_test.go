@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"llm-mux/backend/internal/providers"
+)
+
+// countingServer answers the model list and single-model lookups and counts
+// the requests per path. The list waits for release.
+type countingServer struct {
+	*httptest.Server
+	release chan struct{}
+
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func newCountingServer(t *testing.T) *countingServer {
+	s := &countingServer{release: make(chan struct{}), hits: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.EscapedPath()
+		s.mu.Lock()
+		s.hits[path]++
+		s.mu.Unlock()
+		switch path {
+		case "/v1/models":
+			<-s.release
+			fmt.Fprint(w, `{"data": [{"id": "m1", "max_model_len": 32768}]}`)
+		case "/v1/models/c%2Fd":
+			fmt.Fprint(w, `{"data": {"context_length": 4096}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(func() {
+		select {
+		case <-s.release:
+		default:
+			close(s.release)
+		}
+		s.Close()
+	})
+	return s
+}
+
+func (s *countingServer) count(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[path]
+}
+
+func TestContextLimitColdCache(t *testing.T) {
+	srv := newCountingServer(t)
+	cfg := providers.ProviderConfig{OpenAICompatible: []providers.OpenAICompatibleConfig{{ID: "vllm", BaseURL: srv.URL + "/v1"}}}
+	c := newModelCatalog(t.TempDir())
+
+	// The list is still loading: no answer, and no waiting for it.
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.ContextLimit(cfg, "vllm", "m1")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("limit known before the list loaded")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ContextLimit waited for the model list")
+	}
+	close(srv.release)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := c.entry("vllm"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("model list not refreshed in the background")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Let the refresh finish saving before the data directory goes away.
+	lock := c.providerLock("vllm")
+	lock.Lock()
+	lock.Unlock()
+	if limit, err := c.ContextLimit(cfg, "vllm", "m1"); err != nil || limit != 32768 {
+		t.Fatalf("limit = %d, %v", limit, err)
+	}
+	if _, err := c.ContextLimit(cfg, "vllm", "missing"); err == nil {
+		t.Fatal("unknown model has a limit")
+	}
+	if n := srv.count("/v1/models"); n != 1 {
+		t.Fatalf("model list fetched %d times", n)
+	}
+}
+
+func TestContextLimitFreshList(t *testing.T) {
+	srv := newCountingServer(t)
+	cfg := providers.ProviderConfig{OpenRouter: providers.OpenRouterConfig{APIKey: "k", BaseURL: srv.URL + "/v1"}}
+	c := newModelCatalog(t.TempDir())
+	c.entries["openrouter"] = &providerModels{
+		Provider:  "openrouter",
+		Source:    openRouterBaseURL(cfg.OpenRouter),
+		FetchedAt: time.Now(),
+		Models:    []modelInfo{{ID: "a/b", ContextLength: 1000}},
+	}
+
+	tests := []struct {
+		model string
+		limit int
+		err   bool
+	}{
+		{"a/b", 1000, false},
+		{"c/d", 4096, false},
+		{"c/d", 4096, false},
+		{"e/f", 0, true},
+		{"e/f", 0, true},
+	}
+	for _, tt := range tests {
+		limit, err := c.ContextLimit(cfg, "openrouter", tt.model)
+		if limit != tt.limit || (err != nil) != tt.err {
+			t.Fatalf("ContextLimit(%q) = %d, %v", tt.model, limit, err)
+		}
+	}
+	if n := srv.count("/v1/models"); n != 0 {
+		t.Fatalf("model list fetched %d times", n)
+	}
+	if known, unknown := srv.count("/v1/models/c%2Fd"), srv.count("/v1/models/e%2Ff"); known != 1 || unknown != 1 {
+		t.Fatalf("single-model lookups: c/d %d, e/f %d; want one each", known, unknown)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"llm-mux/backend/internal/providers"
+	"llm-mux/backend/internal/state"
+)
+
+// Finished runs stay attachable for this long so a client that reconnects
+// late can still replay the tail of the stream.
+const runRetention = 15 * time.Minute
+
+const checkpointInterval = time.Second
+
+var (
+	errRunFinished    = errors.New("run already finished")
+	errTargetFinished = errors.New("target already finished")
+)
+
+type runSpec struct {
+	ChatID      string
+	Prompt      string
+	Targets     []providers.Target
+	Config      providers.ProviderConfig
+	BaseHistory []state.Message
+	// HistoryLeafID is where the history walk through BaseHistory ends;
+	// ParentID is the user message the new responses answer.
+	HistoryLeafID   string
+	ParentID        string
+	ReplaceByTarget map[string]string
+	MarkSummary     bool
+	// Compaction marks the summary as standing in for the history before it.
+	Compaction bool
+	// AutoTitle lets the title model name the chat once the run is done.
+	AutoTitle bool
+}
+
+type runInfo struct {
+	ID         string     `json:"id"`
+	ChatID     string     `json:"chatId"`
+	Targets    []string   `json:"targets"`
+	Events     int        `json:"events"`
+	Cancelled  []string   `json:"cancelled,omitempty"`
+	Done       bool       `json:"done"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+type runManager struct {
+	registry map[string]providers.Adapter
+	store    *state.Store
+	catalog  *modelCatalog
+
+	mu   sync.Mutex
+	runs map[string]*generationRun
+}
+
+// generationRun is a fan-out to one or more targets that runs detached from
+// any HTTP request. Every event is kept so subscribers can replay from an
+// event ID; wake is closed and replaced whenever the run changes.
+type generationRun struct {
+	id        string
+	chatID    string
+	targets   []string
+	startedAt time.Time
+	cancel    context.CancelFunc
+
+	mu sync.Mutex
+	// targetCancels and cancelled are keyed by the target's index in
+	// targets, so a model requested twice is tracked twice; a target leaves
+	// targetCancels when its goroutine exits.
+	targetCancels map[int]context.CancelFunc
+	cancelled     map[int]bool
+	events        []providers.StreamEvent
+	finished      bool
+	finishedAt    time.Time
+	wake          chan struct{}
+}
+
+func newRunManager(registry map[string]providers.Adapter, store *state.Store, catalog *modelCatalog) *runManager {
+	return &runManager{
+		registry: registry,
+		store:    store,
+		catalog:  catalog,
+		runs:     map[string]*generationRun{},
+	}
+}
+
+func (m *runManager) start(spec runSpec) *generationRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	run := &generationRun{
+		id:        state.NewID("run"),
+		chatID:    spec.ChatID,
+		startedAt: time.Now().UTC(),
+		cancel:    cancel,
+		wake:      make(chan struct{}),
+
+		targetCancels: map[int]context.CancelFunc{},
+		cancelled:     map[int]bool{},
+	}
+	for _, t := range spec.Targets {
+		run.targets = append(run.targets, t.Provider+":"+t.Model)
+	}
+
+	m.mu.Lock()
+	m.pruneLocked()
+	m.runs[run.id] = run
+	m.mu.Unlock()
+
+	events := make(chan providers.StreamEvent, 256)
+	var wg sync.WaitGroup
+
+	emit := func(ev providers.StreamEvent) error {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case events <- ev:
+			return nil
+		}
+	}
+
+	// The first target to get going compacts the shared history for all.
+	var compactOnce sync.Once
+	var compacted runCompaction
+	compact := func() runCompaction {
+		compactOnce.Do(func() { compacted = m.compactRun(ctx, spec) })
+		return compacted
+	}
+
+	for i, target := range spec.Targets {
+		adapter, exists := resolveAdapter(m.registry, spec.Config, target.Provider)
+		if !exists {
+			_ = emit(providers.StreamEvent{
+				TargetID: target.Provider + ":" + target.Model,
+				Provider: target.Provider,
+				Model:    target.Model,
+				Event:    "error",
+				Error:    "unsupported provider",
+			})
+			continue
+		}
+
+		// Each target gets its own context so it can be cancelled on its own;
+		// emit stays bound to the run context so "end" still goes out.
+		targetCtx, targetCancel := context.WithCancel(ctx)
+		run.mu.Lock()
+		run.targetCancels[i] = targetCancel
+		run.mu.Unlock()
+
+		wg.Add(1)
+		go func(i int, t providers.Target, a providers.Adapter, targetCtx context.Context) {
+			defer wg.Done()
+			defer run.targetDone(i)
+			targetID := t.Provider + ":" + t.Model
+			_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "start"})
+			shared := compact()
+			msgs := targetMessages(shared.history, spec.HistoryLeafID, targetID)
+			history := historyFromMessages(m.compactHistory(spec, t, msgs, shared.summarized[targetID], emit))
+
+			meter := newStreamMeter()
+			err := a.Stream(targetCtx, providers.StreamRequest{Prompt: spec.Prompt, Target: t, Config: spec.Config, History: history}, func(ev providers.StreamEvent) error {
+				meter.observe(ev)
+				return emit(ev)
+			})
+			if targetCtx.Err() != nil && run.wasCancelled(i) {
+				_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "cancelled"})
+			} else if err != nil && !errors.Is(err, context.Canceled) {
+				ev := providers.StreamEvent{
+					TargetID: targetID,
+					Provider: t.Provider,
+					Model:    t.Model,
+					Event:    "error",
+					Error:    err.Error(),
+				}
+				var httpErr *providers.HTTPError
+				if errors.As(err, &httpErr) {
+					ev.StatusCode = httpErr.StatusCode
+				}
+				_ = emit(ev)
+			}
+			_ = emit(providers.StreamEvent{TargetID: targetID, Provider: t.Provider, Model: t.Model, Event: "end", Metrics: meter.finish()})
+		}(i, target, adapter, targetCtx)
+	}
+
+	go func() {
+		wg.Wait()
+		close(events)
+	}()
+
+	go func() {
+		defer cancel()
+		outputs := map[string]*pendingOutput{}
+		for ev := range events {
+			p := outputs[ev.TargetID]
+			switch ev.Event {
+			case "start":
+				p = m.beginOutput(spec, ev)
+				outputs[ev.TargetID] = p
+			case "chunk":
+				if p == nil {
+					break
+				}
+				p.msg.Content += ev.Content
+				if time.Since(p.checkpointedAt) >= checkpointInterval {
+					m.checkpointOutput(spec, p)
+				}
+			case "error":
+				// Targets that fail before "start" (unknown provider) still get
+				// a message so the failure survives a reload.
+				if p == nil {
+					p = m.beginOutput(spec, ev)
+					outputs[ev.TargetID] = p
+				}
+				p.msg.Status = state.MessageStatusError
+				p.msg.Error = ev.Error
+				p.msg.ErrorStatus = ev.StatusCode
+			case "cancelled":
+				if p != nil {
+					p.msg.Status = state.MessageStatusCancelled
+				}
+			case "usage":
+				if p != nil && ev.Usage != nil {
+					usage := *ev.Usage
+					p.msg.Usage = &usage
+				}
+			case "end":
+				// Finalize before publishing "end" so a client that reloads the
+				// chat on this event sees the stored answer.
+				if p != nil {
+					p.msg.Metrics = ev.Metrics
+					m.finishOutput(spec, p)
+					delete(outputs, ev.TargetID)
+				}
+			}
+			run.publish(ev)
+		}
+		for _, p := range outputs {
+			m.finishOutput(spec, p)
+		}
+		run.finish()
+		if spec.AutoTitle {
+			m.autoTitle(spec.ChatID)
+		}
+	}()
+
+	return run
+}
+
+// pendingOutput is a target's answer while it streams. The placeholder
+// message is created on "start" and checkpointed every checkpointInterval, so
+// a crash loses at most that much output.
+type pendingOutput struct {
+	messageID      string
+	msg            state.Message
+	checkpointedAt time.Time
+}
+
+func (m *runManager) beginOutput(spec runSpec, ev providers.StreamEvent) *pendingOutput {
+	out := state.Message{
+		ParentID:   spec.ParentID,
+		TargetID:   ev.TargetID,
+		Provider:   ev.Provider,
+		Model:      ev.Model,
+		IsSummary:  spec.MarkSummary,
+		Compaction: spec.Compaction,
+		Status:     state.MessageStatusStreaming,
+	}
+	if spec.MarkSummary {
+		out.Inclusion = "always"
+	} else {
+		out.Inclusion = "model_only"
+		out.ScopeID = ev.TargetID
+	}
+
+	replaceID := strings.TrimSpace(spec.ReplaceByTarget[ev.TargetID])
+	messageID, err := m.store.BeginAssistantMessage(spec.ChatID, replaceID, out)
+	if err != nil && replaceID != "" {
+		log.Printf("regenerate into %s failed, appending instead: %v", replaceID, err)
+		messageID, err = m.store.BeginAssistantMessage(spec.ChatID, "", out)
+	}
+	if err != nil {
+		log.Printf("persist assistant placeholder failed: %v", err)
+	}
+	return &pendingOutput{messageID: messageID, msg: out, checkpointedAt: time.Now()}
+}
+
+func (m *runManager) checkpointOutput(spec runSpec, p *pendingOutput) {
+	p.checkpointedAt = time.Now()
+	if p.messageID == "" {
+		return
+	}
+	if err := m.store.CheckpointAssistantMessage(spec.ChatID, p.messageID, p.msg); err != nil {
+		log.Printf("checkpoint assistant message failed: %v", err)
+	}
+}
+
+func (m *runManager) finishOutput(spec runSpec, p *pendingOutput) {
+	if p.messageID == "" {
+		return
+	}
+	if strings.TrimSpace(p.msg.Content) == "" && p.msg.Status != state.MessageStatusError && p.msg.Status != state.MessageStatusCancelled {
+		if err := m.store.DiscardAssistantMessage(spec.ChatID, p.messageID); err != nil {
+			log.Printf("discard assistant placeholder failed: %v", err)
+		}
+		return
+	}
+	if p.msg.Status == state.MessageStatusStreaming {
+		p.msg.Status = ""
+	}
+	m.checkpointOutput(spec, p)
+}
+
+func (m *runManager) get(id string) (*generationRun, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	run, ok := m.runs[id]
+	return run, ok
+}
+
+func (m *runManager) list(chatID string) []runInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneLocked()
+	out := make([]runInfo, 0)
+	for _, run := range m.runs {
+		if chatID != "" && run.chatID != chatID {
+			continue
+		}
+		out = append(out, run.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	return out
+}
+
+func (m *runManager) pruneLocked() {
+	cutoff := time.Now().UTC().Add(-runRetention)
+	for id, run := range m.runs {
+		run.mu.Lock()
+		expired := run.finished && run.finishedAt.Before(cutoff)
+		run.mu.Unlock()
+		if expired {
+			delete(m.runs, id)
+		}
+	}
+}
+
+// cancelTargets stops every running target with the given ID, or every
+// running target when targetID is empty. Targets that already finished are
+// left alone; naming only finished ones is an error.
+func (r *generationRun) cancelTargets(targetID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finished {
+		return errRunFinished
+	}
+	known, stopped := targetID == "", false
+	for i, id := range r.targets {
+		if targetID != "" && id != targetID {
+			continue
+		}
+		known = true
+		if cancel, running := r.targetCancels[i]; running {
+			r.cancelled[i] = true
+			cancel()
+			stopped = true
+		}
+	}
+	if !known {
+		return errors.New("target not found in run")
+	}
+	if targetID != "" && !stopped {
+		return errTargetFinished
+	}
+	return nil
+}
+
+func (r *generationRun) wasCancelled(i int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cancelled[i]
+}
+
+// targetDone forgets a target's cancel func once its goroutine exits.
+func (r *generationRun) targetDone(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if cancel, ok := r.targetCancels[i]; ok {
+		cancel()
+		delete(r.targetCancels, i)
+	}
+}
+
+func (r *generationRun) publish(ev providers.StreamEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, ev)
+	close(r.wake)
+	r.wake = make(chan struct{})
+}
+
+func (r *generationRun) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finished = true
+	r.finishedAt = time.Now().UTC()
+	close(r.wake)
+	r.wake = make(chan struct{})
+}
+
+// since returns the events after the given event ID (IDs start at 1), the ID
+// they follow once after is clamped to the events that exist, whether the run
+// has finished, and a channel that is closed on the next change.
+func (r *generationRun) since(after int) ([]providers.StreamEvent, int, bool, <-chan struct{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if after < 0 {
+		after = 0
+	}
+	if after > len(r.events) {
+		after = len(r.events)
+	}
+	return append([]providers.StreamEvent(nil), r.events[after:]...), after, r.finished, r.wake
+}
+
+// wait blocks until the run has finished and returns its events.
+func (r *generationRun) wait(ctx context.Context) ([]providers.StreamEvent, error) {
+	for {
+		r.mu.Lock()
+		finished, wake := r.finished, r.wake
+		if finished {
+			events := append([]providers.StreamEvent(nil), r.events...)
+			r.mu.Unlock()
+			return events, nil
+		}
+		r.mu.Unlock()
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (r *generationRun) info() runInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	info := runInfo{
+		ID:        r.id,
+		ChatID:    r.chatID,
+		Targets:   append([]string{}, r.targets...),
+		Events:    len(r.events),
+		Done:      r.finished,
+		StartedAt: r.startedAt,
+	}
+	for i := range r.cancelled {
+		info.Cancelled = append(info.Cancelled, r.targets[i])
+	}
+	sort.Strings(info.Cancelled)
+	if r.finished {
+		finishedAt := r.finishedAt
+		info.FinishedAt = &finishedAt
+	}
+	return info
+}
+
+// runStreaming starts a detached run and streams it to the caller. Closing
+// the connection only detaches the subscriber; the run keeps going and can be
+// picked up again through /api/runs/{id}/stream.
+func runStreaming(w http.ResponseWriter, r *http.Request, runs *runManager, spec runSpec) {
+	if _, ok := w.(http.Flusher); !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
+		return
+	}
+	run := runs.start(spec)
+	serveRunStream(w, r, run, 0)
+}
+
+func serveRunStream(w http.ResponseWriter, r *http.Request, run *generationRun, after int) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.Header().Set("X-Run-Id", run.id)
+
+	enc := json.NewEncoder(w)
+	_, _ = fmt.Fprint(w, "event: run\n")
+	_, _ = fmt.Fprint(w, "data: ")
+	if err := enc.Encode(map[string]string{"event": "run", "runId": run.id, "chatId": run.chatID}); err != nil {
+		return
+	}
+	_, _ = fmt.Fprint(w, "\n")
+	flusher.Flush()
+
+	for {
+		events, from, finished, wake := run.since(after)
+		after = from
+		for _, ev := range events {
+			after++
+			_, _ = fmt.Fprintf(w, "id: %d\n", after)
+			_, _ = fmt.Fprint(w, "event: message\n")
+			_, _ = fmt.Fprint(w, "data: ")
+			if err := enc.Encode(ev); err != nil {
+				return
+			}
+			_, _ = fmt.Fprint(w, "\n")
+		}
+		if finished {
+			_, _ = fmt.Fprint(w, "event: done\n")
+			_, _ = fmt.Fprint(w, "data: {\"event\":\"done\"}\n\n")
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case <-wake:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func lastEventID(r *http.Request) int {
+	raw := strings.TrimSpace(r.Header.Get("Last-Event-ID"))
+	if raw == "" {
+		raw = strings.TrimSpace(r.URL.Query().Get("lastEventId"))
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"llm-mux/backend/internal/providers"
+	"llm-mux/backend/internal/state"
+)
+
+func newTestRun(contents ...string) *generationRun {
+	run := &generationRun{id: "run_test", chatID: "cht_test", wake: make(chan struct{})}
+	for _, c := range contents {
+		run.publish(providers.StreamEvent{TargetID: "p:m", Event: "chunk", Content: c})
+	}
+	return run
+}
+
+var eventIDPattern = regexp.MustCompile(`(?m)^id: (\d+)$`)
+
+// flushHook runs onFlush on the nth flush of the stream.
+type flushHook struct {
+	*httptest.ResponseRecorder
+	flushes int
+	nth     int
+	onFlush func()
+}
+
+func (f *flushHook) Flush() {
+	f.flushes++
+	if f.flushes == f.nth && f.onFlush != nil {
+		f.onFlush()
+	}
+	f.ResponseRecorder.Flush()
+}
+
+func streamIDs(t *testing.T, run *generationRun, after int, onWait func()) []string {
+	t.Helper()
+	// The second flush comes after the first replay, when the stream is about
+	// to wait for new events.
+	rec := &flushHook{ResponseRecorder: httptest.NewRecorder(), nth: 2, onFlush: onWait}
+	serveRunStream(rec, httptest.NewRequest("GET", "/api/runs/run_test/stream", nil), run, after)
+	body := rec.Body.String()
+	if !strings.Contains(body, "event: done") {
+		t.Fatalf("stream did not finish:\n%s", body)
+	}
+	var ids []string
+	for _, m := range eventIDPattern.FindAllStringSubmatch(body, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+func TestServeRunStreamReplay(t *testing.T) {
+	tests := []struct {
+		name  string
+		after int
+		want  string
+	}{
+		{"from start", 0, "1,2,3"},
+		{"after second", 2, "3"},
+		{"negative", -4, "1,2,3"},
+		{"caught up", 3, ""},
+		{"beyond the end", 40, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := newTestRun("a", "b", "c")
+			run.finish()
+			if got := strings.Join(streamIDs(t, run, tt.after, nil), ","); got != tt.want {
+				t.Fatalf("ids = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// A Last-Event-ID beyond the stored events must not shift the IDs of events
+// published later.
+func TestServeRunStreamOversizedLastEventID(t *testing.T) {
+	run := newTestRun("a", "b")
+	more := func() {
+		run.publish(providers.StreamEvent{TargetID: "p:m", Event: "chunk", Content: "c"})
+		run.publish(providers.StreamEvent{TargetID: "p:m", Event: "chunk", Content: "d"})
+		run.finish()
+	}
+	if got := strings.Join(streamIDs(t, run, 40, more), ","); got != "3,4" {
+		t.Fatalf("ids = %q, want \"3,4\"", got)
+	}
+}
+
+func TestCancelTargets(t *testing.T) {
+	newRun := func() (*generationRun, map[int]*bool) {
+		run := newTestRun()
+		run.targets = []string{"p:a", "p:a", "p:b"}
+		run.targetCancels = map[int]context.CancelFunc{}
+		run.cancelled = map[int]bool{}
+		called := map[int]*bool{}
+		for i := range run.targets {
+			c := false
+			called[i] = &c
+			run.targetCancels[i] = func() { c = true }
+		}
+		return run, called
+	}
+
+	t.Run("duplicate targets are both cancelled", func(t *testing.T) {
+		run, called := newRun()
+		if err := run.cancelTargets("p:a"); err != nil {
+			t.Fatal(err)
+		}
+		if !*called[0] || !*called[1] || *called[2] {
+			t.Fatalf("cancelled = %v %v %v, want true true false", *called[0], *called[1], *called[2])
+		}
+		if got := strings.Join(run.info().Cancelled, ","); got != "p:a,p:a" {
+			t.Fatalf("info.Cancelled = %q", got)
+		}
+	})
+
+	t.Run("finished target", func(t *testing.T) {
+		run, called := newRun()
+		run.targetDone(2)
+		*called[2] = false
+		if err := run.cancelTargets("p:b"); !errors.Is(err, errTargetFinished) {
+			t.Fatalf("err = %v, want errTargetFinished", err)
+		}
+		if *called[2] || run.wasCancelled(2) {
+			t.Fatal("finished target was cancelled")
+		}
+	})
+
+	t.Run("all skips finished targets", func(t *testing.T) {
+		run, _ := newRun()
+		run.targetDone(0)
+		if err := run.cancelTargets(""); err != nil {
+			t.Fatal(err)
+		}
+		if run.wasCancelled(0) || !run.wasCancelled(1) || !run.wasCancelled(2) {
+			t.Fatalf("cancelled = %v", run.cancelled)
+		}
+	})
+
+	t.Run("unknown target", func(t *testing.T) {
+		run, _ := newRun()
+		if err := run.cancelTargets("p:c"); err == nil || errors.Is(err, errTargetFinished) {
+			t.Fatalf("err = %v, want not found", err)
+		}
+	})
+
+	t.Run("finished run", func(t *testing.T) {
+		run, _ := newRun()
+		run.finish()
+		if err := run.cancelTargets(""); !errors.Is(err, errRunFinished) {
+			t.Fatalf("err = %v, want errRunFinished", err)
+		}
+	})
+}
+
+func TestFinishOutput(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     string
+		content    string
+		wantKept   bool
+		wantStatus string
+	}{
+		{name: "answer", status: state.MessageStatusStreaming, content: "hi", wantKept: true},
+		{name: "no output", status: state.MessageStatusStreaming},
+		{name: "error before output", status: state.MessageStatusError, wantKept: true, wantStatus: state.MessageStatusError},
+		{name: "cancelled before output", status: state.MessageStatusCancelled, wantKept: true, wantStatus: state.MessageStatusCancelled},
+		{name: "cancelled after output", status: state.MessageStatusCancelled, content: "h", wantKept: true, wantStatus: state.MessageStatusCancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := state.New(filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			chat, err := store.CreateChat(store.ListFolders()[0].ID, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := store.AppendUserPrompt(chat.ID, "hello", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &runManager{store: store}
+			spec := runSpec{ChatID: chat.ID, ParentID: user.ID}
+			p := m.beginOutput(spec, providers.StreamEvent{TargetID: "p:m", Provider: "p", Model: "m"})
+			p.msg.Status = tt.status
+			p.msg.Content = tt.content
+			m.finishOutput(spec, p)
+
+			tree, _ := store.GetChatTree(chat.ID)
+			var got *state.Message
+			for i := range tree.Messages {
+				if tree.Messages[i].ID == p.messageID {
+					got = &tree.Messages[i]
+				}
+			}
+			if (got != nil) != tt.wantKept {
+				t.Fatalf("kept = %v, want %v", got != nil, tt.wantKept)
+			}
+			if got != nil && got.Status != tt.wantStatus {
+				t.Fatalf("status = %q, want %q", got.Status, tt.wantStatus)
+			}
+		})
+	}
+}
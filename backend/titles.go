@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"llm-mux/backend/internal/providers"
+	"llm-mux/backend/internal/state"
+)
+
+const (
+	titleTimeout     = 30 * time.Second
+	titleMaxRunes    = 60
+	titleExcerptSize = 2000
+	titleInstruction = "Write a title of at most six words for the conversation above. " +
+		"Reply with the title only, without quotes and without a trailing period."
+)
+
+var (
+	errNoTitleModel   = errors.New("no title model configured")
+	errTitleProvider  = errors.New("unsupported title provider")
+	errNothingToTitle = errors.New("chat has no messages to title")
+)
+
+// generateTitle asks the title model to name a chat after its first exchange
+// on the active branch.
+func generateTitle(ctx context.Context, registry map[string]providers.Adapter, cfg providers.ProviderConfig, chat state.Chat) (string, error) {
+	target := providers.Target{
+		Provider:  strings.ToLower(strings.TrimSpace(cfg.Titles.Provider)),
+		Model:     strings.TrimSpace(cfg.Titles.Model),
+		MaxTokens: 64,
+	}
+	if target.Provider == "" || target.Model == "" {
+		return "", errNoTitleModel
+	}
+	adapter, ok := resolveAdapter(registry, cfg, target.Provider)
+	if !ok {
+		return "", errTitleProvider
+	}
+
+	var history []providers.HistoryMessage
+	for _, m := range chat.Messages {
+		if m.Role == "user" {
+			if len(history) > 0 {
+				break
+			}
+			history = append(history, providers.HistoryMessage{Role: "user", Content: excerpt(m.Content)})
+			continue
+		}
+		if len(history) == 1 && m.Status != state.MessageStatusError && strings.TrimSpace(m.Content) != "" {
+			history = append(history, providers.HistoryMessage{Role: "assistant", Content: excerpt(m.Content)})
+			break
+		}
+	}
+	if len(history) == 0 {
+		return "", errNothingToTitle
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, titleTimeout)
+	defer cancel()
+	var out strings.Builder
+	err := adapter.Stream(ctx, providers.StreamRequest{Prompt: titleInstruction, Target: target, Config: cfg, History: history}, func(ev providers.StreamEvent) error {
+		if ev.Event == "chunk" {
+			out.WriteString(ev.Content)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	title := cleanTitle(out.String())
+	if title == "" {
+		return "", errors.New("title model returned no title")
+	}
+	return title, nil
+}
+
+// autoTitle names a chat once its first turn has been answered, when title
+// generation is enabled and nobody renamed the chat in the meantime.
+func (m *runManager) autoTitle(chatID string) {
+	cfg := m.store.GetConfig()
+	if !cfg.Titles.Enabled || !m.store.HasAutomaticTitle(chatID) {
+		return
+	}
+	chat, ok := m.store.GetChat(chatID)
+	if !ok {
+		return
+	}
+	turns := 0
+	for _, msg := range chat.Messages {
+		if msg.Role == "user" {
+			turns++
+		}
+	}
+	if turns != 1 {
+		return
+	}
+	title, err := generateTitle(context.Background(), m.registry, cfg, chat)
+	if err != nil {
+		log.Printf("generate title for %s failed: %v", chatID, err)
+		return
+	}
+	if _, err := m.store.SetGeneratedTitle(chatID, title, false); err != nil {
+		log.Printf("store title for %s failed: %v", chatID, err)
+	}
+}
+
+// cleanTitle keeps the first line of a model reply and strips the quoting and
+// decoration models like to add.
+func cleanTitle(raw string) string {
+	title := ""
+	for _, line := range strings.Split(raw, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			title = line
+			break
+		}
+	}
+	title = strings.TrimSpace(strings.TrimPrefix(title, "Title:"))
+	title = strings.Trim(title, "\"'`*#“”‘’ ")
+	title = strings.TrimRight(title, ".!")
+	if runes := []rune(title); len(runes) > titleMaxRunes {
+		title = strings.TrimSpace(string(runes[:titleMaxRunes])) + "..."
+	}
+	return strings.TrimSpace(title)
+}
+
+func excerpt(content string) string {
+	if runes := []rune(content); len(runes) > titleExcerptSize {
+		return string(runes[:titleExcerptSize]) + "..."
+	}
+	return content
+}
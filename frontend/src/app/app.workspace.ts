@@ -645,10 +645,10 @@ export class AppWorkspace {
 
     try {
       if (this.editingUserMessageMode === 'inplace') {
-        await this.chatService.editUserMessage(this.selectedChatId, editedMessageId, content, attachments);
+        const branched = await this.chatService.editUserMessage(this.selectedChatId, editedMessageId, content, attachments);
         await this.reloadChats(this.selectedChatId);
         this.closeEditUserMessageModal();
-        const edited = this.selectedChat?.messages.find((m) => m.id === editedMessageId);
+        const edited = this.selectedChat?.messages.find((m) => m.id === branched.activeLeafId);
         if (edited) {
           await this.regenerateFromMessage(edited);
         }
@@ -656,11 +656,11 @@ export class AppWorkspace {
       }
 
       const fork = await this.chatService.forkChat(this.selectedChatId, editedMessageId);
-      await this.chatService.editUserMessage(fork.id, editedMessageId, content, attachments);
+      const branched = await this.chatService.editUserMessage(fork.id, editedMessageId, content, attachments);
       await this.reloadFolders(fork.folderId);
       await this.reloadChats(fork.id);
       this.closeEditUserMessageModal();
-      const edited = this.selectedChat?.messages.find((m) => m.id === editedMessageId);
+      const edited = this.selectedChat?.messages.find((m) => m.id === branched.activeLeafId);
       if (edited) {
         await this.regenerateFromMessage(edited);
       }
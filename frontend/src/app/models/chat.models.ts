@@ -8,6 +8,15 @@ export interface ProviderRuntimeConfig {
     baseUrl: string;
     models: string[];
   };
+  titles?: {
+    enabled: boolean;
+    provider: string;
+    model: string;
+  };
+  compaction?: {
+    mode: '' | 'summarize' | 'window';
+    thresholdPercent?: number;
+  };
 }
 
 export interface ChatTarget {
@@ -25,6 +34,8 @@ export interface TextAttachment {
 export interface ChatRequest {
   chatId: string;
   prompt: string;
+  templateId?: string;
+  variables?: Record<string, string>;
   targets: ChatTarget[];
   attachments?: TextAttachment[];
   config: {
@@ -44,18 +55,52 @@ export interface StreamEvent {
   targetId: string;
   provider: string;
   model: string;
-  event: 'start' | 'chunk' | 'error' | 'end' | 'done';
+  event: 'run' | 'start' | 'compacted' | 'chunk' | 'usage' | 'cancelled' | 'error' | 'end' | 'done';
+  runId?: string;
   content?: string;
   error?: string;
+  statusCode?: number;
+  usage?: TokenUsage;
+  metrics?: ResponseMetrics;
+}
+
+export interface ResponseMetrics {
+  timeToFirstTokenMs: number;
+  durationMs: number;
+  tokensPerSecond: number;
+}
+
+export interface TokenUsage {
+  promptTokens: number;
+  completionTokens: number;
+  cost?: number;
 }
 
 export interface Folder {
   id: string;
+  parentId?: string;
   name: string;
   systemPrompt: string;
   temperature?: number;
   createdAt: string;
   updatedAt: string;
+  deletedAt?: string;
+}
+
+export interface FolderSettings {
+  systemPrompt: string;
+  temperature?: number;
+}
+
+export interface PromptTemplate {
+  id: string;
+  name: string;
+  body: string;
+  defaults?: Record<string, string>;
+  folderId?: string;
+  variables?: string[];
+  createdAt: string;
+  updatedAt: string;
 }
 
 export interface ChatSummary {
@@ -64,10 +109,18 @@ export interface ChatSummary {
   title: string;
   createdAt: string;
   updatedAt: string;
+  deletedAt?: string;
+  trashedWithFolder?: boolean;
+  activeLeafId?: string;
+  systemPrompt?: string;
+  temperature?: number;
+  targets?: ChatTarget[];
+  variables?: Record<string, string>;
 }
 
 export interface Message {
   id: string;
+  parentId?: string;
   role: 'user' | 'assistant';
   content: string;
   attachments?: TextAttachment[];
@@ -75,13 +128,18 @@ export interface Message {
   model?: string;
   targetId?: string;
   isSummary?: boolean;
+  compaction?: boolean;
   inclusion?: 'dont_include' | 'model_only' | 'always';
   scopeId?: string;
+  usage?: TokenUsage;
+  metrics?: ResponseMetrics;
   history?: MessageVersion[];
   historyIndex?: number;
-  status?: 'streaming' | 'done' | 'error';
+  status?: 'streaming' | 'done' | 'error' | 'cancelled' | 'interrupted';
   error?: string;
+  errorStatus?: number;
   createdAt: string;
+  deletedAt?: string;
 }
 
 export interface MessageVersion {
@@ -90,6 +148,8 @@ export interface MessageVersion {
   provider?: string;
   model?: string;
   targetId?: string;
+  usage?: TokenUsage;
+  metrics?: ResponseMetrics;
   createdAt: string;
 }
 
@@ -97,12 +157,70 @@ export interface ChatDetail extends ChatSummary {
   messages: Message[];
 }
 
+export interface SearchResult {
+  chatId: string;
+  chatTitle: string;
+  folderId: string;
+  messageId?: string;
+  field: 'title' | 'content' | 'history' | 'attachment';
+  snippet: string;
+  score: number;
+  createdAt: string;
+}
+
+export interface ImportResult {
+  format: 'llm-mux' | 'chatgpt' | 'openwebui';
+  imported: number;
+  chats: ChatSummary[];
+}
+
+export interface Branch {
+  messageId: string;
+  preview: string;
+  createdAt: string;
+  leafId: string;
+  active: boolean;
+}
+
+export interface TrashedMessage {
+  chatId: string;
+  chatTitle: string;
+  message: Message;
+}
+
+export interface Trash {
+  folders: Folder[];
+  chats: ChatDetail[];
+  messages: TrashedMessage[];
+}
+
+export interface ModelInfo {
+  id: string;
+  name?: string;
+  contextLength?: number;
+  maxOutputTokens?: number;
+  pricing?: { prompt: number; completion: number };
+  inputModalities?: string[];
+  outputModalities?: string[];
+  capabilities?: string[];
+}
+
+export interface ProviderModels {
+  provider: string;
+  source: string;
+  fetchedAt: string;
+  stale?: boolean;
+  error?: string;
+  models: ModelInfo[];
+}
+
 export interface ContextLimitItem {
   targetId: string;
   provider: string;
   model: string;
   maxContextTokens?: number;
   estimatedTokens?: number;
+  tokenizer?: string;
   remainingTokens?: number;
   usedPercent?: number;
   error?: string;
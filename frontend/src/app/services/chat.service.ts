@@ -1,5 +1,5 @@
 import { Injectable } from '@angular/core';
-import { ChatDetail, ChatRequest, ChatSummary, ContextLimitItem, Folder, ProviderRuntimeConfig, StreamEvent, TextAttachment } from '../models/chat.models';
+import { Branch, ChatDetail, ChatRequest, ChatSummary, ChatTarget, ContextLimitItem, Folder, FolderSettings, PromptTemplate, ProviderModels, ProviderRuntimeConfig, StreamEvent, TextAttachment } from '../models/chat.models';
 
 interface StreamCallbacks {
   onEvent: (event: StreamEvent) => void;
@@ -26,6 +26,15 @@ export class ChatService {
       ollama: {
         baseUrl: raw.ollama?.baseUrl ?? 'http://localhost:11434',
         models: raw.ollama?.models ?? ['llama3.2:latest', 'qwen2.5']
+      },
+      titles: {
+        enabled: raw.titles?.enabled ?? false,
+        provider: raw.titles?.provider ?? '',
+        model: raw.titles?.model ?? ''
+      },
+      compaction: {
+        mode: raw.compaction?.mode ?? '',
+        thresholdPercent: raw.compaction?.thresholdPercent
       }
     };
   }
@@ -40,7 +49,9 @@ export class ChatService {
       ollama: {
         baseUrl: config.ollama.baseUrl,
         models: config.ollama.models
-      }
+      },
+      titles: config.titles,
+      compaction: config.compaction
     };
     const res = await fetch(`${this.baseUrl}/api/config`, {
       method: 'PUT',
@@ -62,11 +73,11 @@ export class ChatService {
     return data.folders ?? [];
   }
 
-  async createFolder(name: string, systemPrompt: string, temperature?: number): Promise<Folder> {
+  async createFolder(name: string, systemPrompt: string, temperature?: number, parentId = ''): Promise<Folder> {
     const res = await fetch(`${this.baseUrl}/api/folders`, {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
-      body: JSON.stringify({ name, systemPrompt, temperature })
+      body: JSON.stringify({ parentId, name, systemPrompt, temperature })
     });
     if (!res.ok) {
       const body = await res.text();
@@ -88,6 +99,74 @@ export class ChatService {
     return (await res.json()) as Folder;
   }
 
+  async moveFolder(folderId: string, parentId: string): Promise<Folder> {
+    const res = await fetch(`${this.baseUrl}/api/folders/${folderId}/move`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ parentId })
+    });
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to move folder (${res.status})`);
+    }
+    return (await res.json()) as Folder;
+  }
+
+  async getFolderSettings(folderId: string): Promise<FolderSettings> {
+    const res = await fetch(`${this.baseUrl}/api/folders/${folderId}/settings`);
+    if (!res.ok) {
+      throw new Error(`Failed to load folder settings (${res.status})`);
+    }
+    return (await res.json()) as FolderSettings;
+  }
+
+  async getTemplates(folderId = ''): Promise<PromptTemplate[]> {
+    const res = await fetch(`${this.baseUrl}/api/templates?folderId=${encodeURIComponent(folderId)}`);
+    if (!res.ok) {
+      throw new Error(`Failed to load templates (${res.status})`);
+    }
+    const data = await res.json();
+    return data.templates ?? [];
+  }
+
+  async saveTemplate(
+    template: { name: string; body: string; defaults?: Record<string, string>; folderId?: string },
+    templateId = ''
+  ): Promise<PromptTemplate> {
+    const res = await fetch(`${this.baseUrl}/api/templates${templateId ? `/${templateId}` : ''}`, {
+      method: templateId ? 'PATCH' : 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(template)
+    });
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to save template (${res.status})`);
+    }
+    return (await res.json()) as PromptTemplate;
+  }
+
+  async deleteTemplate(templateId: string): Promise<void> {
+    const res = await fetch(`${this.baseUrl}/api/templates/${templateId}`, { method: 'DELETE' });
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to delete template (${res.status})`);
+    }
+  }
+
+  async renderTemplate(templateId: string, variables: Record<string, string>, chatId = ''): Promise<string> {
+    const res = await fetch(`${this.baseUrl}/api/templates/${templateId}/render`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ chatId, variables })
+    });
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to render template (${res.status})`);
+    }
+    const data = await res.json();
+    return data.prompt ?? '';
+  }
+
   async getChats(folderId: string): Promise<ChatSummary[]> {
     const res = await fetch(`${this.baseUrl}/api/chats?folderId=${encodeURIComponent(folderId)}`);
     if (!res.ok) {
@@ -119,7 +198,17 @@ export class ChatService {
     return (await res.json()) as ChatDetail;
   }
 
-  async updateChat(chatId: string, patch: { title?: string; folderId?: string }): Promise<ChatSummary> {
+  async updateChat(
+    chatId: string,
+    patch: {
+      title?: string;
+      folderId?: string;
+      systemPrompt?: string;
+      temperature?: number | null;
+      targets?: ChatTarget[];
+      variables?: Record<string, string>;
+    }
+  ): Promise<ChatSummary> {
     const res = await fetch(`${this.baseUrl}/api/chats/${chatId}`, {
       method: 'PATCH',
       headers: { 'Content-Type': 'application/json' },
@@ -148,6 +237,15 @@ export class ChatService {
     }
   }
 
+  async retitleChat(chatId: string): Promise<ChatSummary> {
+    const res = await fetch(`${this.baseUrl}/api/chats/${chatId}/retitle`, { method: 'POST' });
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to retitle chat (${res.status})`);
+    }
+    return (await res.json()) as ChatSummary;
+  }
+
   async forkChat(chatId: string, messageId: string, title = ''): Promise<ChatSummary> {
     const res = await fetch(`${this.baseUrl}/api/chats/${chatId}/fork`, {
       method: 'POST',
@@ -176,7 +274,7 @@ export class ChatService {
     );
   }
 
-  async editUserMessage(chatId: string, messageId: string, content: string, attachments: TextAttachment[]): Promise<void> {
+  async editUserMessage(chatId: string, messageId: string, content: string, attachments: TextAttachment[]): Promise<ChatDetail> {
     const res = await fetch(`${this.baseUrl}/api/chats/${chatId}/messages/${messageId}/edit`, {
       method: 'POST',
       headers: { 'Content-Type': 'application/json' },
@@ -186,6 +284,28 @@ export class ChatService {
       const body = await res.text();
       throw new Error(body || `Failed to edit message (${res.status})`);
     }
+    return (await res.json()) as ChatDetail;
+  }
+
+  async listBranches(chatId: string, messageId: string): Promise<Branch[]> {
+    const res = await fetch(`${this.baseUrl}/api/chats/${chatId}/messages/${messageId}/branches`);
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to load branches (${res.status})`);
+    }
+    const data = (await res.json()) as { branches: Branch[] };
+    return data.branches;
+  }
+
+  async activateBranch(chatId: string, messageId: string): Promise<ChatDetail> {
+    const res = await fetch(`${this.baseUrl}/api/chats/${chatId}/messages/${messageId}/activate`, {
+      method: 'POST'
+    });
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to switch branch (${res.status})`);
+    }
+    return (await res.json()) as ChatDetail;
   }
 
   async setMessageHistoryIndex(chatId: string, messageId: string, index: number): Promise<void> {
@@ -224,6 +344,23 @@ export class ChatService {
     await this.streamFromEndpoint(`${this.baseUrl}/api/chat/stream`, request, callbacks, signal);
   }
 
+  async getModels(provider?: string, refresh = false): Promise<ProviderModels[]> {
+    const params = new URLSearchParams();
+    if (provider) {
+      params.set('provider', provider);
+    }
+    if (refresh) {
+      params.set('refresh', 'true');
+    }
+    const res = await fetch(`${this.baseUrl}/api/models?${params}`);
+    if (!res.ok) {
+      const body = await res.text();
+      throw new Error(body || `Failed to load models (${res.status})`);
+    }
+    const data = await res.json();
+    return data.providers ?? [];
+  }
+
   async getContextLimits(
     targets: Array<{ provider: string; model: string }>,
     config: ChatRequest['config'],